@@ -0,0 +1,152 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errActivationLink    = errors.New("Invalid link")
+	errActivationExpired = errors.New("Link expired")
+	errActivationUsed    = errors.New("Link already used")
+)
+
+// activationLinks signs the activation links mailed by verifyUser and
+// remembers the links already used. The signature covers the identity, the
+// expiry and the activation key, so none of them can be edited. Used links
+// are kept until they expire; when Path is set they are saved there, so
+// they can not be used again after a restart.
+type activationLinks struct {
+	Key  []byte
+	Path string
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// newActivationLinks uses key to sign links. When key is empty a random key
+// is generated, so links do not survive restarts.
+func newActivationLinks(key, path string) (*activationLinks, error) {
+	l := &activationLinks{Key: []byte(key), Path: path, used: make(map[string]time.Time)}
+	if len(l.Key) == 0 {
+		l.Key = make([]byte, 32)
+		if _, err := rand.Read(l.Key); err != nil {
+			return nil, err
+		}
+	}
+	if path == "" {
+		return l, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.used); err != nil {
+		return nil, fmt.Errorf("Invalid activation state %v: %v", path, err)
+	}
+	return l, nil
+}
+
+// Sign returns the h parameter of the link
+func (l *activationLinks) Sign(identity, expires, activateKey string) string {
+	mac := hmac.New(sha256.New, l.Key)
+	// Lengths keep the fields apart, as the expiry contains colons
+	fmt.Fprintf(mac, "activate:%d:%v:%d:%v:%d:%v", len(identity), identity, len(expires), expires, len(activateKey), activateKey)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check verifies the signature and the expiry of the link and that it was
+// not used yet
+func (l *activationLinks) Check(identity, expires, activateKey, h string) (time.Time, error) {
+	if !hmac.Equal([]byte(h), []byte(l.Sign(identity, expires, activateKey))) {
+		return time.Time{}, errActivationLink
+	}
+	exp, err := time.Parse(time.RFC3339, expires)
+	if err != nil {
+		return time.Time{}, errActivationLink
+	}
+	if time.Now().After(exp) {
+		return exp, errActivationExpired
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.used[linkID(identity, activateKey)]; ok {
+		return exp, errActivationUsed
+	}
+	return exp, nil
+}
+
+// Use marks the link as used. It returns false when it already was, so only
+// one of concurrent confirmations goes on with the activation.
+func (l *activationLinks) Use(identity, activateKey string, expires time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := linkID(identity, activateKey)
+	if _, ok := l.used[id]; ok {
+		return false
+	}
+	now := time.Now()
+	for k, exp := range l.used {
+		if exp.Before(now) {
+			delete(l.used, k)
+		}
+	}
+	l.used[id] = expires
+	l.save()
+	return true
+}
+
+// Release makes the link usable again after a failed activation
+func (l *activationLinks) Release(identity, activateKey string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.used, linkID(identity, activateKey))
+	l.save()
+}
+
+// linkID keys the used links without keeping the activation keys
+func linkID(identity, activateKey string) string {
+	sum := sha256.Sum256([]byte(identity + ":" + activateKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// save writes the used links to Path. The caller holds the lock.
+func (l *activationLinks) save() {
+	if l.Path == "" {
+		return
+	}
+	if err := writeJSONFile(l.Path, l.used); err != nil {
+		log.Printf("E Failed to save activation state: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActivationLinksCheck(t *testing.T) {
+	links, _ := newActivationLinks("key", "")
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	h := links.Sign("abcd", expires, "1234")
+
+	if _, err := links.Check("abcd", expires, "1234", h); err != nil {
+		t.Fatalf("err = <%v> want <nil>", err)
+	}
+	later := time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+	for _, d := range [][4]string{
+		{"abce", expires, "1234", h},
+		{"abcd", later, "1234", h},
+		{"abcd", expires, "1235", h},
+		{"abcd", expires, "1234", ""},
+	} {
+		if _, err := links.Check(d[0], d[1], d[2], d[3]); err != errActivationLink {
+			t.Errorf("Check(%v) = <%v> want <%v>", d, err, errActivationLink)
+		}
+	}
+	other, _ := newActivationLinks("other key", "")
+	if _, err := other.Check("abcd", expires, "1234", h); err != errActivationLink {
+		t.Errorf("err = <%v> want <%v> for another key", err, errActivationLink)
+	}
+
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	if _, err := links.Check("abcd", past, "1234", links.Sign("abcd", past, "1234")); err != errActivationExpired {
+		t.Errorf("err = <%v> want <%v>", err, errActivationExpired)
+	}
+	if _, err := links.Check("abcd", "soon", "1234", links.Sign("abcd", "soon", "1234")); err != errActivationLink {
+		t.Errorf("err = <%v> want <%v> for an unparsable expiry", err, errActivationLink)
+	}
+}
+
+func TestActivationLinksUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "activation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "used.json")
+
+	links, _ := newActivationLinks("key", path)
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	h := links.Sign("abcd", expires, "1234")
+	exp, _ := links.Check("abcd", expires, "1234", h)
+
+	if !links.Use("abcd", "1234", exp) {
+		t.Fatal("first use refused")
+	}
+	if links.Use("abcd", "1234", exp) {
+		t.Error("second use accepted")
+	}
+	if _, err := links.Check("abcd", expires, "1234", h); err != errActivationUsed {
+		t.Errorf("err = <%v> want <%v>", err, errActivationUsed)
+	}
+
+	// Used links survive restarts
+	links, err = newActivationLinks("key", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := links.Check("abcd", expires, "1234", h); err != errActivationUsed {
+		t.Errorf("err = <%v> want <%v> after a restart", err, errActivationUsed)
+	}
+
+	links.Release("abcd", "1234")
+	if _, err := links.Check("abcd", expires, "1234", h); err != nil {
+		t.Errorf("err = <%v> want <nil> after Release", err)
+	}
+}
+
+func TestActivateHandlerOnce(t *testing.T) {
+	a := testApp()
+	a.Templates = loadTemplates("./templates")
+	activated := 0
+	a.ActivateUser = func(c *context, identity, key string) error {
+		activated++
+		return nil
+	}
+	q := activationQuery(a, "foo@example.com", time.Now().Add(time.Hour))
+	a.ActivationMails.Record(activationMail{UserID: "foo@example.com", MpinID: q.Get("i"), Expires: time.Now().Add(time.Hour)})
+
+	for i, want := range []string{"has been activated", "Link already used"} {
+		w := httptest.NewRecorder()
+		if s, err := activateHandler(&context{App: a}, w, mustRequest("POST", "/mpinActivate?"+q.Encode())); s != 200 || err != nil {
+			t.Fatalf("status = <%d> err = <%v>", s, err)
+		}
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("request %d: body does not contain <%v>: %s", i, want, w.Body.String())
+		}
+	}
+	if activated != 1 {
+		t.Errorf("activated %d times", activated)
+	}
+	if pending := a.ActivationMails.Pending("foo@example.com"); len(pending) != 0 {
+		t.Errorf("activation mail of the activated identity kept: %+v", pending)
+	}
+
+	// Edited links are rejected without showing the identity
+	q.Set("s", "abce")
+	w := httptest.NewRecorder()
+	activateHandler(&context{App: a}, w, mustRequest("POST", "/mpinActivate?"+q.Encode()))
+	if body := w.Body.String(); !strings.Contains(body, "Invalid link") || strings.Contains(body, "foo@example.com") || activated != 1 {
+		t.Errorf("body = <%s>", body)
+	}
+}
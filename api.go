@@ -0,0 +1,268 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// apiErrorCodes are the error codes of the /api/v1 error objects
+var apiErrorCodes = map[int]string{
+	400: "bad_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	405: "method_not_allowed",
+	410: "gone",
+	413: "too_large",
+	415: "unsupported_media_type",
+	429: "too_many_requests",
+	500: "internal_error",
+	502: "bad_gateway",
+	503: "unavailable",
+}
+
+type apiErrorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// writeAPIError writes the error object of the status. Details of server
+// errors are only logged.
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	var body apiErrorBody
+	body.Error.Code = apiErrorCodes[status]
+	if body.Error.Code == "" {
+		body.Error.Code = "error"
+	}
+	body.Error.Message = http.StatusText(status)
+	if status < 500 && err != nil && err.Error() != "" {
+		body.Error.Message = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encodeJSONResponse(w, &body)
+}
+
+// apiMiddleware answers the errors of the middleware with JSON error
+// objects instead of plain text
+func apiMiddleware(h appMiddleware) appMiddleware {
+	return func(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+		status, err := h(c, w, r)
+		if err == nil || status < 400 {
+			return status, err
+		}
+		if _, ok := err.(responseSent); ok {
+			return status, err
+		}
+		writeAPIError(w, status, err)
+		return status, responseSent{err}
+	}
+}
+
+// apiJSONRequest rejects POST bodies that are not JSON, which also keeps
+// plain cross-site forms out
+func apiJSONRequest(r *http.Request) (int, error) {
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+		return 415, errors.New("Content-Type must be application/json")
+	}
+	return 200, nil
+}
+
+func writeAPIResponse(w http.ResponseWriter, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := encodeJSONResponse(w, v); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return 200, nil
+}
+
+// apiSession is the data of the PIN pad page
+type apiSession struct {
+	Authenticated     bool   `json:"authenticated"`
+	UserID            string `json:"userId,omitempty"`
+	MpinJSURL         string `json:"mpinJSURL"`
+	ClientSettingsURL string `json:"clientSettingsURL"`
+	MobileAppFullURL  string `json:"mobileAppFullURL"`
+	SuccessLoginURL   string `json:"successLoginURL"`
+}
+
+// apiServiceProvider is a SAML service provider the user can log in to
+type apiServiceProvider struct {
+	EntityID string `json:"entityId"`
+	Name     string `json:"name"`
+	LoginURL string `json:"loginURL"`
+}
+
+// apiMe is the data of the protected page
+type apiMe struct {
+	UserID           string               `json:"userId"`
+	AuthTime         *time.Time           `json:"authTime,omitempty"`
+	ServiceProviders []apiServiceProvider `json:"serviceProviders,omitempty"`
+}
+
+// apiActivation is the data of the activation page
+type apiActivation struct {
+	Valid      bool   `json:"valid"`
+	Activated  bool   `json:"activated"`
+	UserID     string `json:"userId,omitempty"`
+	Issued     string `json:"issued,omitempty"`
+	DeviceName string `json:"deviceName,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// Session state and PIN pad settings, as shown by the index page
+func apiSessionHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	if next := r.URL.Query().Get("next"); next != "" {
+		setLoginNext(c, next)
+	}
+	ret := apiSession{
+		Authenticated:     c.LoggedUser != "",
+		UserID:            c.LoggedUser,
+		MpinJSURL:         c.App.Options.MpinJSURL,
+		ClientSettingsURL: c.App.Options.ClientSettingsURL,
+		MobileAppFullURL:  c.App.Options.MobileAppFullURL,
+		SuccessLoginURL:   successLoginURL(c),
+	}
+	return writeAPIResponse(w, &ret)
+}
+
+// The logged in user, as shown by the protected page
+func apiMeHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	if c.LoggedUser == "" {
+		return 401, errors.New("Login required")
+	}
+	ret := apiMe{UserID: c.LoggedUser}
+	authTime := c.AuthTime
+	if authTime.IsZero() {
+		if item, err := c.App.Store.Get(c.SessionID); err == nil {
+			authTime = item.AuthTime
+		}
+	}
+	if !authTime.IsZero() {
+		ret.AuthTime = &authTime
+	}
+	if c.App.SAML != nil {
+		for _, sp := range c.App.SAML.ServiceProviders() {
+			ret.ServiceProviders = append(ret.ServiceProviders, apiServiceProvider{
+				EntityID: sp.EntityID,
+				Name:     sp.DisplayName(),
+				LoginURL: "/saml/login?sp=" + url.QueryEscape(sp.EntityID),
+			})
+		}
+	}
+	return writeAPIResponse(w, &ret)
+}
+
+// End the session, like GET /logout
+func apiLogoutHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "POST"); err != nil {
+		return s, err
+	}
+	if s, err := apiJSONRequest(r); err != nil {
+		return s, err
+	}
+	loggedIn := c.LoggedUser != ""
+	endSession(c, w)
+	return writeAPIResponse(w, map[string]bool{"loggedOut": loggedIn})
+}
+
+// Activation link info on GET and confirmation on POST, as done by the
+// activation page. GET takes the link parameters i, e, s and h in the
+// query, POST in a JSON body.
+func apiActivationHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	var rq struct {
+		Identity    string `json:"i"`
+		Expires     string `json:"e"`
+		ActivateKey string `json:"s"`
+		Signature   string `json:"h"`
+	}
+	if r.Method == "POST" {
+		if s, err := apiJSONRequest(r); err != nil {
+			return s, err
+		}
+		if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+			return 400, errors.New("BAD REQUEST. INVALID JSON")
+		}
+	} else {
+		q := r.URL.Query()
+		rq.Identity, rq.Expires, rq.ActivateKey, rq.Signature = q.Get("i"), q.Get("e"), q.Get("s"), q.Get("h")
+	}
+	if rq.Identity == "" {
+		return 400, errors.New("BAD REQUEST. INVALID IDENTITY")
+	}
+
+	params, err := verifyActivation(c, rq.Identity, rq.Expires, rq.ActivateKey, rq.Signature)
+	if err == errActivationLink {
+		return 400, err
+	} else if params.UserID == "" {
+		return 400, errors.New("BAD REQUEST. INVALID IDENTITY")
+	}
+	ret := apiActivation{
+		Valid:      params.IsValid,
+		UserID:     params.UserID,
+		Issued:     params.Issued,
+		DeviceName: params.DeviceName,
+		Message:    params.ErrorMessage,
+	}
+	if r.Method == "POST" {
+		if err != nil {
+			return 410, err
+		}
+		if s, err := throttleUser(c, w, params.UserID); err != nil {
+			return s, err
+		}
+		if c.App.RPS.Breaker.IsOpen() {
+			return 503, errCircuitOpen
+		}
+		if !c.App.Activation.Use(params.Identity, params.ActivateKey, params.Expires) {
+			return 410, errActivationUsed
+		}
+		if err := c.App.ActivateUser(c, params.Identity, params.ActivateKey); err != nil {
+			c.App.Activation.Release(params.Identity, params.ActivateKey)
+			return 400, errors.New("Activation failed")
+		}
+		ret.Activated = true
+		c.App.Identities.Activated(params.Identity)
+		c.App.ActivationMails.Remove(params.Identity)
+		c.App.Webhooks.Fire(webhookActivated, params.UserID, map[string]string{"deviceName": params.DeviceName})
+	}
+	return writeAPIResponse(w, &ret)
+}
+
+// Unknown /api/v1 paths
+func apiNotFoundHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	return 404, errors.New("Not found")
+}
@@ -0,0 +1,184 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveAPI runs the handlers wrapped like the /api/v1 routes
+func serveAPI(a *app, r *http.Request, mws ...appMiddleware) *httptest.ResponseRecorder {
+	for i, mw := range mws {
+		mws[i] = apiMiddleware(mw)
+	}
+	w := httptest.NewRecorder()
+	appHandler{a, mws}.ServeHTTP(w, r)
+	return w
+}
+
+func apiErrorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	var body apiErrorBody
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("not an error object: %s", w.Body.String())
+	}
+	return body.Error.Code
+}
+
+func TestAPIErrors(t *testing.T) {
+	a := testApp()
+	w := serveAPI(a, mustRequest("GET", "/api/v1/nothing"), apiNotFoundHandler)
+	if w.Code != 404 || apiErrorCode(t, w) != "not_found" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+
+	w = serveAPI(a, mustRequest("DELETE", "/api/v1/me"), apiMeHandler)
+	if w.Code != 405 || apiErrorCode(t, w) != "method_not_allowed" {
+		t.Errorf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+
+	// Server errors do not leak details
+	failing := func(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+		return 500, errors.New("ldap://10.0.0.1 unreachable")
+	}
+	w = serveAPI(a, mustRequest("GET", "/api/v1/me"), failing)
+	if w.Code != 500 || strings.Contains(w.Body.String(), "ldap") {
+		t.Errorf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+}
+
+func TestAPISessionAndMe(t *testing.T) {
+	a := testApp()
+	w := serveAPI(a, mustRequest("GET", "/api/v1/me"), sessionHandler, apiMeHandler)
+	if w.Code != 401 || apiErrorCode(t, w) != "unauthorized" {
+		t.Fatalf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+
+	r := mustRequest("GET", "/api/v1/session?next=/protected/account")
+	w = serveAPI(a, r, sessionHandler, apiSessionHandler)
+	var s apiSession
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil || s.Authenticated || s.SuccessLoginURL != "/protected/account" {
+		t.Fatalf("session = %+v %s", s, w.Body.String())
+	}
+	cookie := (&http.Response{Header: w.Header()}).Cookies()[0]
+
+	// Log in the session
+	item, _ := a.Store.Get(cookie.Value)
+	item.User = "foo@example.com"
+	item.AuthTime = time.Now()
+	a.Store.Put(cookie.Value, item)
+
+	r = mustRequest("GET", "/api/v1/me")
+	r.AddCookie(cookie)
+	w = serveAPI(a, r, sessionHandler, apiMeHandler)
+	var me apiMe
+	if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil || me.UserID != "foo@example.com" || me.AuthTime == nil {
+		t.Fatalf("me = %+v %s", me, w.Body.String())
+	}
+
+	// Logout needs a JSON request
+	r = mustRequest("POST", "/api/v1/logout")
+	r.AddCookie(cookie)
+	if w = serveAPI(a, r, sessionHandler, apiLogoutHandler); w.Code != 415 {
+		t.Errorf("code = <%d> want <415>", w.Code)
+	}
+	r, _ = http.NewRequest("POST", "/api/v1/logout", strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	r.AddCookie(cookie)
+	w = serveAPI(a, r, sessionHandler, apiLogoutHandler)
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"loggedOut":true}` {
+		t.Errorf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+	if _, err := a.Store.Get(cookie.Value); err == nil {
+		t.Errorf("session not deleted")
+	}
+}
+
+func activationQuery(a *app, userID string, expires time.Time) url.Values {
+	identity, _ := json.Marshal(map[string]interface{}{"userID": userID, "issued": "2016-05-10 12:00:00", "mobile": 0})
+	i, e := hex.EncodeToString(identity), expires.UTC().Format(time.RFC3339)
+	return url.Values{"i": {i}, "e": {e}, "s": {"abcd"}, "h": {a.Activation.Sign(i, e, "abcd")}}
+}
+
+func postActivation(a *app, q url.Values) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"i": q.Get("i"), "e": q.Get("e"), "s": q.Get("s"), "h": q.Get("h")})
+	r, _ := http.NewRequest("POST", "/api/v1/activation", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return serveAPI(a, r, apiActivationHandler)
+}
+
+func TestAPIActivation(t *testing.T) {
+	a := testApp()
+	var activated []string
+	a.ActivateUser = func(c *context, identity, key string) error {
+		activated = append(activated, identity)
+		return nil
+	}
+
+	q := activationQuery(a, "foo@example.com", time.Now().Add(time.Hour))
+	a.ActivationMails.Record(activationMail{UserID: "foo@example.com", MpinID: q.Get("i"), Expires: time.Now().Add(time.Hour)})
+	w := serveAPI(a, mustRequest("GET", "/api/v1/activation?"+q.Encode()), apiActivationHandler)
+	var ret apiActivation
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil || !ret.Valid || ret.Activated || ret.UserID != "foo@example.com" || ret.DeviceName != "PC" {
+		t.Fatalf("activation = %+v %s", ret, w.Body.String())
+	}
+	if len(activated) != 0 {
+		t.Fatalf("GET activated the identity")
+	}
+
+	w = postActivation(a, q)
+	ret = apiActivation{}
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil || !ret.Activated || len(activated) != 1 {
+		t.Fatalf("activation = %+v %s", ret, w.Body.String())
+	}
+	if pending := a.ActivationMails.Pending("foo@example.com"); len(pending) != 0 {
+		t.Errorf("activation mail of the activated identity kept: %+v", pending)
+	}
+
+	// Links can be confirmed once
+	if w = postActivation(a, q); w.Code != 410 || len(activated) != 1 {
+		t.Errorf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+
+	// Expired links can not be confirmed
+	q = activationQuery(a, "foo@example.com", time.Now().Add(-time.Hour))
+	if w = postActivation(a, q); w.Code != 410 || apiErrorCode(t, w) != "gone" || len(activated) != 1 {
+		t.Errorf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+
+	// Nor edited ones
+	q = activationQuery(a, "foo@example.com", time.Now().Add(-time.Hour))
+	q.Set("e", time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	if w = postActivation(a, q); w.Code != 400 || len(activated) != 1 {
+		t.Errorf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+
+	w = serveAPI(a, mustRequest("GET", "/api/v1/activation?i=zz"), apiActivationHandler)
+	if w.Code != 400 || apiErrorCode(t, w) != "bad_request" {
+		t.Errorf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+}
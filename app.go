@@ -19,13 +19,15 @@
 package main
 
 import (
+	"./rpstest"
+	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"sync"
 	"time"
 )
@@ -33,6 +35,14 @@ import (
 type session struct {
 	Expires time.Time
 	User    string
+	// AuthTime is the time of the last successful login
+	AuthTime time.Time
+	// Next is the URL to resume after the login
+	Next string
+	// Pending is an M-Pin login waiting for the LDAP password
+	Pending pendingLogin
+	// MpinID is the identity of the login, when RPS sends it
+	MpinID string
 }
 
 type storage map[string]session
@@ -81,17 +91,66 @@ func (s storage) Delete(sessionID string) {
 	mu.Unlock()
 }
 
+// DeleteMpinID ends the sessions logged in with the identity and returns
+// their IDs
+func (s storage) DeleteMpinID(mpinID string) (ended []string) {
+	if mpinID == "" {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for k, v := range s {
+		if v.MpinID == mpinID {
+			delete(s, k)
+			ended = append(ended, k)
+		}
+	}
+	return
+}
+
 type app struct {
-	Store        storage
-	Options      *options
-	RpsProxy     *httputil.ReverseProxy
-	Fetch        func(a *app, url string, method string, q interface{}, d interface{}) (err error)
-	Mail         func(userID, deviceName, validateURL string, o *options) (err error)
+	Store    storage
+	Options  *options
+	RpsProxy http.Handler
+	RPSAllow rpsAllowlist
+	RPS      *RPSClient
+	Fetch    func(a *app, url string, method string, q interface{}, d interface{}) (err error)
+	Mail     func(userID, deviceName, validateURL string, o *options) (err error)
+	// Notify sends the approval mails
+	Notify       func(userID, subject, text string, o *options) error
 	Authenticate func(*context, string) (string, string, int)
 	LoginResult  func(*context, string, string, int, string) error
 	ActivateUser func(*context, string, string) error
-	Templates    map[string]*template.Template
-	tlsConfig    *tls.Config
+	// CheckPassword checks the LDAP password of the second login step
+	CheckPassword func(*context, string, string) error
+	Templates     map[string]*template.Template
+	OTPs          *otpStore
+	IPLimiter     *rateLimiter
+	UserLimiter   *rateLimiter
+	// ResendUserLimiter and ResendIPLimiter limit activation mails sent again
+	ResendUserLimiter *rateLimiter
+	ResendIPLimiter   *rateLimiter
+	ActivationMails   *activationMails
+	TrustedProxies    trustedProxies
+	Lockouts          *lockoutStore
+	Revocation        RevocationPolicy
+	Permit            *permitRules
+	Policy            *accessPolicy
+	Logout            *logoutTokens
+	Activation        *activationLinks
+	StepUp            stepUpRules
+	OIDC              *oidcProvider
+	SAML              *samlIdP
+	Tokens            *tokenIssuer
+	Gateway           *gateway
+	Identity          *identityHeaders
+	Webhooks          *webhooks
+	Password          *passwordFactor
+	Approvals         *approvals
+	Identities        *identityRegistry
+	// FormKey signs the form tokens of the logged in pages
+	FormKey   []byte
+	tlsConfig *tls.Config
 }
 
 type context struct {
@@ -99,6 +158,19 @@ type context struct {
 	LoggedUser string
 	App        *app
 	UserID     string
+	MpinID     string
+	// LogoutToken is sent to RPS as logoutData instead of the session ID
+	LogoutToken string
+	OTP         string
+	OTPTTL      time.Duration
+	// Grant and AuthTime are set for requests with a bearer access token
+	Grant    string
+	AuthTime time.Time
+	// PasswordPending is set when the M-Pin login still needs the LDAP
+	// password
+	PasswordPending bool
+	// ClientIP is the client address of the login, for the access policy
+	ClientIP net.IP
 }
 
 func newApp() *app {
@@ -107,21 +179,101 @@ func newApp() *app {
 	a.Options = getOptions()
 	a.Fetch = fetchJSON
 	a.Mail = sendActivationMail
+	a.Notify = sendNotificationMail
 	a.Authenticate = authenticateToRPS
 	a.LoginResult = sendLoginResult
 	a.ActivateUser = activateUserRPS
-
-	rpsDirector := func(req *http.Request) {
-		req.URL.Scheme = a.Options.RPSSchema
-		req.URL.Host = a.Options.RPSHost
+	a.CheckPassword = ldapCheckPassword
+	a.OTPs = newOTPStore()
+	a.IPLimiter = newRateLimiter(a.Options.RateLimitIP)
+	a.UserLimiter = newRateLimiter(a.Options.RateLimitUser)
+	a.ResendUserLimiter = newRateLimiterPer(a.Options.ResendLimitUser, time.Hour)
+	a.ResendIPLimiter = newRateLimiterPer(a.Options.ResendLimitIP, time.Hour)
+	a.ActivationMails = newActivationMails()
+	trusted, err := parseTrustedProxies(a.Options.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if a.Options.CACertFile == "" {
-		a.RpsProxy = &httputil.ReverseProxy{Director: rpsDirector}
-	} else {
+	a.TrustedProxies = trusted
+	lockouts, err := newLockoutStore(a.Options.LockoutThreshold, a.Options.LockoutDuration, a.Options.LockoutMax, a.Options.LockoutState)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.Lockouts = lockouts
+	if a.Revocation, err = newRevocationPolicy(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.Permit, err = newPermitRules(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	logoutTTL := a.Options.LogoutTokenTTL
+	if logoutTTL <= 0 {
+		logoutTTL = time.Duration(a.Options.SessionMaxAge) * time.Second
+	}
+	if a.Logout, err = newLogoutTokens(a.Options.LogoutKey, logoutTTL); err != nil {
+		log.Fatal(err)
+	}
+	if a.Activation, err = newActivationLinks(a.Options.ActivationKey, a.Options.ActivationState); err != nil {
+		log.Fatal(err)
+	}
+	if a.StepUp, err = parseStepUpRules(a.Options.StepUp); err != nil {
+		log.Fatal(err)
+	}
+	if a.OIDC, err = newOIDCProvider(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.SAML, err = newSAMLIdP(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.Tokens, err = newTokenIssuer(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.Identity, err = newIdentityHeaders(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.Gateway, err = newGateway(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.Webhooks, err = newWebhooks(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.Password, err = newPasswordFactor(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.Approvals, err = newApprovals(a.Options); err != nil {
+		log.Fatal(err)
+	}
+	if a.Identities, err = newIdentityRegistry(a.Options.IdentitiesFile); err != nil {
+		log.Fatal(err)
+	}
+	a.FormKey = make([]byte, 32)
+	if _, err := rand.Read(a.FormKey); err != nil {
+		log.Fatal(err)
+	}
+	if a.Options.PolicyFile != "" {
+		if a.Policy, err = loadAccessPolicy(a.Options.PolicyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if a.Options.CACertFile != "" {
 		a.tlsConfig = loadCACerts(a.Options.CACertFile)
-		transport := &http.Transport{TLSClientConfig: a.tlsConfig}
-		a.RpsProxy = &httputil.ReverseProxy{Director: rpsDirector, Transport: transport}
 	}
+	a.RPS = newRPSClient(a.Options, a.tlsConfig)
+	// Typed RPS calls go through a.Fetch, so it can be replaced in tests
+	a.RPS.Fetch = func(url, method string, q, d interface{}) error {
+		return a.Fetch(&a, url, method, q, d)
+	}
+
+	for _, b := range a.RPS.Pool.Backends {
+		b.Proxy = newRPSProxy(&a, b)
+	}
+	a.RpsProxy = a.RPS.Pool
+	allow, err := parseRPSAllowlist(a.Options.RPSAllow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.RPSAllow = allow
 	a.Templates = loadTemplates(a.Options.TemplatesPath)
 
 	return &a
@@ -129,6 +281,12 @@ func newApp() *app {
 
 type appMiddleware func(*context, http.ResponseWriter, *http.Request) (int, error)
 
+// responseSent wraps an error returned by a middleware that has already
+// written its own error response
+type responseSent struct {
+	error
+}
+
 type appHandler struct {
 	AppContext *app
 	Hs         []appMiddleware
@@ -146,6 +304,9 @@ func (ah appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
                 status_tmp = status
 		if err != nil && status >= 400 {
 			log.Printf("E %v %v HTTP %d %v %v %v", c.SessionID, "", status, r.URL.Path, r.RemoteAddr, err)
+			if _, ok := err.(responseSent); ok {
+				return
+			}
 			switch status {
 			case http.StatusNotFound:
 				http.NotFound(w, r)
@@ -170,34 +331,88 @@ func init() {
 
 func main() {
 
+	if o := getOptions(); o.FakeRPS {
+		fake := rpstest.NewServer()
+		o.RPSHost = fake.Host()
+		o.RPSSchema = "http"
+		log.Printf("W Using fake RPS on %v, every login succeeds as %v", o.RPSHost, fake.UserID)
+	}
+
 	app := newApp()
+	app.RPS.Pool.StartHealthChecks(app.RPS.Client, app.Options.RPSHealthPath, app.Options.RPSHealthInterval)
+	app.Webhooks.Start()
 
 	chain := func(mws ...appMiddleware) appHandler {
 		return appHandler{app, mws}
 	}
+	// apiChain answers errors with JSON error objects
+	apiChain := func(mws ...appMiddleware) appHandler {
+		for i, mw := range mws {
+			mws[i] = apiMiddleware(mw)
+		}
+		return appHandler{app, mws}
+	}
 
 	// Static file server
 	http.Handle(app.Options.StaticURLBase, http.FileServer(http.Dir(app.Options.ResourcesBasePath)))
 	http.Handle(app.Options.MobileAppFullURL, http.StripPrefix(app.Options.MobileAppFullURL, http.FileServer(http.Dir(app.Options.MobileAppPath))))
 
 	// M-PIN handlers
-	var rpsProxyHandler = func(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
-		c.App.RpsProxy.ServeHTTP(w, r)
-		return 200, nil
-	}
 	http.Handle(fmt.Sprintf("/%s/", app.Options.RpsPrefix), chain(sessionHandler, rpsProxyHandler))
+	// RPS makes this request, so it is throttled per user only
 	http.Handle("/mpinVerify", chain(baseHandler, sessionHandler, verifyUserHandler))
-	http.Handle("/mpinAuthenticate", chain(baseHandler, sessionHandler, authenticateUserHandler))
-	http.Handle("/mpinActivate", chain(baseHandler, sessionHandler, activateHandler))
+	http.Handle("/mpinAuthenticate", chain(baseHandler, throttleHandler, sessionHandler, rpsAvailableHandler, authenticateUserHandler))
+	http.Handle("/mpinActivate", chain(baseHandler, throttleHandler, sessionHandler, rpsAvailableHandler, activateHandler))
+	http.Handle("/activation/resend", chain(baseHandler, throttleHandler, sessionHandler, resendActivationHandler))
 	http.Handle("/mpinPermitUser", chain(baseHandler, sessionHandler, permitUserHandler))
 
 	// Application handlers
-	http.Handle("/protected", chain(baseHandler, sessionHandler, protectedHandler))
+	http.Handle("/protected", chain(baseHandler, sessionHandler, bearerHandler, protectedHandler))
+	http.Handle("/protected/", chain(baseHandler, sessionHandler, bearerHandler, protectedHandler))
+	http.Handle("/protected/identities", chain(baseHandler, sessionHandler, identitiesHandler))
 	http.Handle("/about", chain(baseHandler, sessionHandler, aboutHandler))
-	http.Handle("/logout", chain(baseHandler, sessionHandler, logoutHandler))
+	http.Handle("/logout", chain(baseHandler, sessionHandler, bearerHandler, logoutHandler))
+	http.Handle("/api/token/refresh", chain(baseHandler, throttleHandler, tokensHandler, tokenRefreshHandler))
+	http.Handle("/otp", chain(baseHandler, sessionHandler, otpHandler))
+	http.Handle("/otp/verify", chain(baseHandler, throttleHandler, otpVerifyHandler))
+
+	// OpenID Connect provider
+	http.Handle("/.well-known/openid-configuration", chain(baseHandler, oidcHandler, oidcDiscoveryHandler))
+	http.Handle("/oidc/jwks", chain(baseHandler, oidcHandler, oidcJWKSHandler))
+	http.Handle("/oidc/authorize", chain(baseHandler, oidcHandler, sessionHandler, oidcAuthorizeHandler))
+	http.Handle("/oidc/token", chain(baseHandler, throttleHandler, oidcHandler, oidcTokenHandler))
+	http.Handle("/oidc/userinfo", chain(baseHandler, oidcHandler, oidcUserinfoHandler))
+
+	// JSON API for custom frontends
+	http.Handle("/api/v1/session", apiChain(baseHandler, sessionHandler, apiSessionHandler))
+	http.Handle("/api/v1/me", apiChain(baseHandler, sessionHandler, bearerHandler, apiMeHandler))
+	http.Handle("/api/v1/logout", apiChain(baseHandler, sessionHandler, bearerHandler, apiLogoutHandler))
+	http.Handle("/api/v1/activation", apiChain(baseHandler, throttleHandler, sessionHandler, apiActivationHandler))
+	http.Handle("/api/v1/", apiChain(baseHandler, apiNotFoundHandler))
+
+	// Forward authentication for nginx auth_request and Traefik ForwardAuth
+	http.Handle("/auth/verify", chain(bearerHandler, authVerifyHandler))
+
+	// SAML 2.0 identity provider
+	http.Handle("/saml/metadata", chain(baseHandler, samlHandler, samlMetadataHandler))
+	http.Handle("/saml/sso", chain(baseHandler, samlHandler, sessionHandler, samlSSOHandler))
+	http.Handle("/saml/login", chain(baseHandler, samlHandler, sessionHandler, samlLoginHandler))
+
+	http.Handle("/login", chain(baseHandler, sessionHandler, rpsAvailableHandler, indexHandler))
+	http.Handle("/login/password", chain(baseHandler, throttleHandler, sessionHandler, passwordHandler))
+	if app.Gateway == nil {
+		http.Handle("/", chain(baseHandler, sessionHandler, rpsAvailableHandler, indexHandler))
+	} else {
+		// Everything else goes to the upstream application
+		http.Handle("/", gatewayRouter(chain(baseHandler, sessionHandler, rpsAvailableHandler, indexHandler), chain(sessionHandler, gatewayHandler)))
+	}
 
-	http.Handle("/login", chain(baseHandler, sessionHandler, indexHandler))
-	http.Handle("/", chain(baseHandler, sessionHandler, indexHandler))
+	// Monitoring handlers
+	http.Handle("/health", chain(baseHandler, healthHandler))
+	http.Handle("/metrics", chain(baseHandler, metricsHandler))
+	http.Handle("/admin/unlock", chain(baseHandler, adminHandler, adminUnlockHandler))
+	http.Handle("/admin/webhooks", chain(baseHandler, adminHandler, adminWebhooksHandler))
+	http.Handle("/admin/approvals", chain(baseHandler, throttleHandler, sessionHandler, approvalsHandler))
 
 	if !app.Options.EnableTLS {
 		http.ListenAndServe(fmt.Sprintf("%v:%v", app.Options.Address, app.Options.Port), nil)
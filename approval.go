@@ -0,0 +1,288 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoRegistration = errors.New("Registration not found")
+
+// registration is an identity waiting for an approver. ActivateKey is set
+// for identities activated through RPS, ActivationCode for those activated
+// with a code mailed to the user.
+type registration struct {
+	UserID         string    `json:"userId"`
+	MpinID         string    `json:"mpinId"`
+	DeviceName     string    `json:"deviceName"`
+	ActivateKey    string    `json:"activateKey,omitempty"`
+	ActivationCode int       `json:"activationCode,omitempty"`
+	Requested      time.Time `json:"requested"`
+	Expires        time.Time `json:"expires"`
+}
+
+// approvals queues the registrations from /mpinVerify until one of the
+// Approvers, logged in with M-Pin, approves or rejects them. When Path is
+// set the queue is saved there, so it survives restarts.
+type approvals struct {
+	Approvers []string
+	Path      string
+
+	mu      sync.Mutex
+	pending map[string]*registration
+}
+
+// newApprovals returns nil when no approver is set
+func newApprovals(o *options) (*approvals, error) {
+	var approvers []string
+	for _, a := range strings.Split(o.Approvers, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			approvers = append(approvers, a)
+		}
+	}
+	if len(approvers) == 0 {
+		return nil, nil
+	}
+	a := &approvals{
+		Approvers: approvers,
+		Path:      o.ApprovalQueue,
+		pending:   make(map[string]*registration),
+	}
+	if a.Path == "" {
+		return a, nil
+	}
+	data, err := ioutil.ReadFile(a.Path)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.pending); err != nil {
+		return nil, fmt.Errorf("Invalid approval queue %v: %v", a.Path, err)
+	}
+	return a, nil
+}
+
+// IsApprover reports whether the user may approve registrations
+func (a *approvals) IsApprover(userID string) bool {
+	for _, approver := range a.Approvers {
+		if strings.EqualFold(approver, userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue adds the registration. It returns false when the identity was
+// already waiting.
+func (a *approvals) Queue(reg registration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gc(time.Now())
+	_, waiting := a.pending[reg.MpinID]
+	a.pending[reg.MpinID] = &reg
+	a.save()
+	return !waiting
+}
+
+// Pending returns the registrations waiting, oldest first
+func (a *approvals) Pending() (l []registration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gc(time.Now())
+	for _, reg := range a.pending {
+		l = append(l, *reg)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Requested.Before(l[j].Requested) })
+	return
+}
+
+// Take removes the registration of the identity from the queue, so only one
+// approver decides on it
+func (a *approvals) Take(mpinID string) (registration, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gc(time.Now())
+	reg, ok := a.pending[mpinID]
+	if !ok {
+		return registration{}, errNoRegistration
+	}
+	delete(a.pending, mpinID)
+	a.save()
+	return *reg, nil
+}
+
+// Put queues again a registration taken when the decision failed
+func (a *approvals) Put(reg registration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[reg.MpinID] = &reg
+	a.save()
+}
+
+// RPS no longer activates expired registrations. The caller holds the lock.
+func (a *approvals) gc(now time.Time) {
+	for k, reg := range a.pending {
+		if reg.Expires.Before(now) {
+			log.Printf("I %v %v Registration of %v expired before approval", "", reg.UserID, reg.MpinID)
+			delete(a.pending, k)
+		}
+	}
+}
+
+// save writes the queue to Path. The caller holds the lock.
+func (a *approvals) save() {
+	if a.Path == "" {
+		return
+	}
+	if err := writeJSONFile(a.Path, a.pending); err != nil {
+		log.Printf("E Failed to save approval queue: %v", err)
+	}
+}
+
+// forceActivate reports whether RPS activates identities without
+// verification. Registrations needing approval never are.
+func forceActivate(c *context) bool {
+	return c.App.Options.ForceActivate && c.App.Approvals == nil
+}
+
+// approvalPageURL is the approval page on the host of the activation URL
+func approvalPageURL(activationURL string) string {
+	u, err := url.Parse(activationURL)
+	if err != nil {
+		return "/admin/approvals"
+	}
+	return u.ResolveReference(&url.URL{Path: "/admin/approvals"}).String()
+}
+
+// queueRegistration puts the identity in the approval queue and tells the
+// approvers about it. pageURL is the approval page.
+func queueRegistration(c *context, reg registration, pageURL string) {
+	if !c.App.Approvals.Queue(reg) {
+		log.Printf("D Registration of %v already waiting for approval {%v}", reg.UserID, c.SessionID)
+		return
+	}
+	log.Printf("I %v %v Registration of %v waiting for approval", c.SessionID, reg.UserID, reg.MpinID)
+	text := fmt.Sprintf("%v registered a new %v identity and is waiting for your approval.\r\n\r\nApprove or reject it at %v", reg.UserID, reg.DeviceName, pageURL)
+	for _, approver := range c.App.Approvals.Approvers {
+		if err := c.App.Notify(approver, "M-Pin: New registration to approve", text, c.App.Options); err != nil {
+			log.Printf("W %v %v Failed to send mail to approver %v: %v", c.SessionID, reg.UserID, approver, err)
+		}
+	}
+}
+
+// approveRegistration activates the identity and tells the user
+func approveRegistration(c *context, reg registration) error {
+	if reg.ActivateKey != "" {
+		if c.App.RPS.Breaker.IsOpen() {
+			return errCircuitOpen
+		}
+		if err := c.App.ActivateUser(c, reg.MpinID, reg.ActivateKey); err != nil {
+			return err
+		}
+		c.App.Identities.Activated(reg.MpinID)
+		c.App.ActivationMails.Remove(reg.MpinID)
+		c.App.Webhooks.Fire(webhookActivated, reg.UserID, map[string]string{"deviceName": reg.DeviceName, "approvedBy": c.LoggedUser})
+		text := fmt.Sprintf("Your new %v identity has been approved. You can now log in with your PIN.", reg.DeviceName)
+		if err := c.App.Notify(reg.UserID, "M-Pin: Registration approved", text, c.App.Options); err != nil {
+			log.Printf("W %v %v Failed to send mail: %v", c.SessionID, reg.UserID, err)
+		}
+		return nil
+	}
+	// The user activates the identity with the code
+	mailActivation(c, activationMail{UserID: reg.UserID, MpinID: reg.MpinID, ActivationCode: reg.ActivationCode})
+	return nil
+}
+
+// rejectRegistration tells the user. RPS drops the identity when it
+// expires.
+func rejectRegistration(c *context, reg registration) {
+	text := fmt.Sprintf("Your new %v identity has been rejected by an administrator.", reg.DeviceName)
+	if err := c.App.Notify(reg.UserID, "M-Pin: Registration rejected", text, c.App.Options); err != nil {
+		log.Printf("W %v %v Failed to send mail: %v", c.SessionID, reg.UserID, err)
+	}
+}
+
+// List the registrations waiting on GET and approve or reject one on POST.
+// Only approvers logged in with M-Pin have access.
+func approvalsHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	if c.App.Approvals == nil {
+		return 404, errors.New("Approvals disabled")
+	}
+	if c.LoggedUser == "" {
+		setLoginNext(c, r.URL.RequestURI())
+		http.Redirect(w, r, "/", 302)
+		return 302, nil
+	}
+	if !c.App.Approvals.IsApprover(c.LoggedUser) {
+		log.Printf("W %v %v Not an approver", c.SessionID, c.LoggedUser)
+		return 403, errors.New("Forbidden")
+	}
+
+	if r.Method == "POST" {
+		if !checkFormToken(c, r) {
+			return 403, errors.New("Invalid form token")
+		}
+		action := r.PostFormValue("action")
+		if action != "approve" && action != "reject" {
+			return 400, errors.New("BAD REQUEST. INVALID ACTION")
+		}
+		reg, err := c.App.Approvals.Take(r.PostFormValue("mpinId"))
+		if err != nil {
+			http.Redirect(w, r, "/admin/approvals?done=gone", 303)
+			return 303, nil
+		}
+		c.UserID = reg.UserID
+		if action == "reject" {
+			log.Printf("I %v %v Registration of %v rejected by %v", c.SessionID, reg.UserID, reg.MpinID, c.LoggedUser)
+			rejectRegistration(c, reg)
+		} else if err := approveRegistration(c, reg); err != nil {
+			log.Printf("E %v %v Approved activation of %v failed: %v", c.SessionID, reg.UserID, reg.MpinID, err)
+			c.App.Approvals.Put(reg)
+			http.Redirect(w, r, "/admin/approvals?done=failed", 303)
+			return 303, nil
+		} else {
+			log.Printf("I %v %v Registration of %v approved by %v", c.SessionID, reg.UserID, reg.MpinID, c.LoggedUser)
+		}
+		http.Redirect(w, r, "/admin/approvals?done="+url.QueryEscape(action+"d"), 303)
+		return 303, nil
+	}
+
+	data := make(map[string]interface{})
+	data["StaticURLBase"] = c.App.Options.StaticURLBase
+	data["User"] = c.LoggedUser
+	data["Registrations"] = c.App.Approvals.Pending()
+	data["Token"] = formToken(c)
+	data["Done"] = r.URL.Query().Get("done")
+	return renderTemplate(c.App, w, "approvals.tmpl", data)
+}
@@ -0,0 +1,189 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNotification struct {
+	To, Subject, Text string
+}
+
+func testApprovalApp(t *testing.T, notified *[]testNotification, activated *[]string) *app {
+	a := testApp()
+	opts := *a.Options
+	opts.ForceActivate = true
+	opts.LDAPVerify = false
+	opts.Approvers = "admin@example.com, boss@example.com"
+	opts.VerifyIdentityURL = "https://rpa.example.com/mpinActivate"
+	a.Options = &opts
+	var err error
+	if a.Approvals, err = newApprovals(&opts); err != nil {
+		t.Fatal(err)
+	}
+	a.Templates = loadTemplates("./templates")
+	a.Notify = func(userID, subject, text string, o *options) error {
+		*notified = append(*notified, testNotification{userID, subject, text})
+		return nil
+	}
+	a.Mail = func(userID, deviceName, validateURL string, o *options) error {
+		t.Errorf("activation mail sent to %v", userID)
+		return nil
+	}
+	a.ActivateUser = func(c *context, identity, key string) error {
+		*activated = append(*activated, identity)
+		return nil
+	}
+	return a
+}
+
+func verifyForApproval(a *app, mpinID string) (int, *httptest.ResponseRecorder) {
+	body := fmt.Sprintf(`{"mpinId":%q,"userId":"foo@example.com","expireTime":"2100-01-01T00:00:00Z","mobile":1,"activateKey":%q}`, mpinID, strings.Repeat("ab", 32))
+	c, w, r := prepare("POST", "/mpinVerify", bytes.NewBufferString(body))
+	c.App = a
+	s, _ := verifyUserHandler(c, w, r)
+	return s, w
+}
+
+func TestNewApprovals(t *testing.T) {
+	if a, err := newApprovals(&options{}); a != nil || err != nil {
+		t.Errorf("newApprovals() = <%v> <%v> want nil", a, err)
+	}
+	a, _ := newApprovals(&options{Approvers: "Admin@example.com"})
+	if !a.IsApprover("admin@example.com") || a.IsApprover("foo@example.com") {
+		t.Errorf("approvers = %v", a.Approvers)
+	}
+}
+
+func TestVerifyUserApproval(t *testing.T) {
+	var notified []testNotification
+	var activated []string
+	a := testApprovalApp(t, &notified, &activated)
+
+	s, w := verifyForApproval(a, "aa")
+	var resp verifyUserResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); s != 200 || err != nil || resp.ForceActivate {
+		t.Fatalf("status = <%d> body = <%s>", s, w.Body.String())
+	}
+	if len(notified) != 2 || notified[0].To != "admin@example.com" || !strings.Contains(notified[0].Text, "https://rpa.example.com/admin/approvals") {
+		t.Fatalf("notified = %+v", notified)
+	}
+	// Approvers are told once per identity
+	verifyForApproval(a, "aa")
+	if pending := a.Approvals.Pending(); len(pending) != 1 || pending[0].UserID != "foo@example.com" || pending[0].DeviceName != "Mobile" || len(notified) != 2 {
+		t.Errorf("pending = %+v notified = %d", pending, len(notified))
+	}
+	if len(activated) != 0 {
+		t.Errorf("activated before approval: %v", activated)
+	}
+}
+
+func approvalRequest(a *app, method, loggedUser string, form url.Values) (int, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	var r *http.Request
+	if method == "POST" {
+		r, _ = http.NewRequest("POST", "/admin/approvals", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = mustRequest("GET", "/admin/approvals")
+	}
+	a.Store.Put("345", session{User: loggedUser})
+	s, _ := approvalsHandler(&context{App: a, SessionID: "345", LoggedUser: loggedUser}, w, r)
+	return s, w
+}
+
+func TestApprovalsHandler(t *testing.T) {
+	var notified []testNotification
+	var activated []string
+	a := testApprovalApp(t, &notified, &activated)
+	verifyForApproval(a, "aa")
+	verifyForApproval(a, "bb")
+	notified = nil
+
+	if s, w := approvalRequest(a, "GET", "", nil); s != 302 || w.Header().Get("Location") != "/" {
+		t.Errorf("anonymous: status = <%d> location = <%v>", s, w.Header().Get("Location"))
+	}
+	if s, _ := approvalRequest(a, "GET", "foo@example.com", nil); s != 403 {
+		t.Errorf("not an approver: status = <%d> want <403>", s)
+	}
+	if s, w := approvalRequest(a, "GET", "admin@example.com", nil); s != 200 || strings.Count(w.Body.String(), `value="approve"`) != 2 {
+		t.Fatalf("status = <%d> body = <%s>", s, w.Body.String())
+	}
+
+	form := url.Values{"mpinId": {"aa"}, "action": {"approve"}, "token": {"forged"}}
+	if s, _ := approvalRequest(a, "POST", "admin@example.com", form); s != 403 || len(activated) != 0 {
+		t.Errorf("forged token: status = <%d> activated = %v", s, activated)
+	}
+	form.Set("token", formToken(&context{App: a, SessionID: "345"}))
+	if s, w := approvalRequest(a, "POST", "admin@example.com", form); s != 303 || w.Header().Get("Location") != "/admin/approvals?done=approved" {
+		t.Fatalf("status = <%d> location = <%v>", s, w.Header().Get("Location"))
+	}
+	if len(activated) != 1 || activated[0] != "aa" || len(notified) != 1 || notified[0].To != "foo@example.com" || !strings.Contains(notified[0].Subject, "approved") {
+		t.Errorf("activated = %v notified = %+v", activated, notified)
+	}
+	// A decision is taken once
+	if s, w := approvalRequest(a, "POST", "admin@example.com", form); s != 303 || w.Header().Get("Location") != "/admin/approvals?done=gone" || len(activated) != 1 {
+		t.Errorf("status = <%d> location = <%v>", s, w.Header().Get("Location"))
+	}
+
+	form = url.Values{"mpinId": {"bb"}, "action": {"reject"}, "token": {formToken(&context{App: a, SessionID: "345"})}}
+	if s, _ := approvalRequest(a, "POST", "boss@example.com", form); s != 303 || len(activated) != 1 || len(notified) != 2 || !strings.Contains(notified[1].Subject, "rejected") {
+		t.Errorf("status = <%d> activated = %v notified = %+v", s, activated, notified)
+	}
+	if pending := a.Approvals.Pending(); len(pending) != 0 {
+		t.Errorf("pending = %+v", pending)
+	}
+}
+
+func TestApprovalsHandlerActivationFailed(t *testing.T) {
+	var notified []testNotification
+	var activated []string
+	a := testApprovalApp(t, &notified, &activated)
+	a.ActivateUser = func(c *context, identity, key string) error { return fmt.Errorf("RPS down") }
+	verifyForApproval(a, "aa")
+
+	form := url.Values{"mpinId": {"aa"}, "action": {"approve"}, "token": {formToken(&context{App: a, SessionID: "345"})}}
+	if s, w := approvalRequest(a, "POST", "admin@example.com", form); s != 303 || w.Header().Get("Location") != "/admin/approvals?done=failed" {
+		t.Fatalf("status = <%d> location = <%v>", s, w.Header().Get("Location"))
+	}
+	// The registration waits for another try
+	if pending := a.Approvals.Pending(); len(pending) != 1 {
+		t.Errorf("pending = %+v", pending)
+	}
+}
+
+func TestApprovalsExpire(t *testing.T) {
+	a, _ := newApprovals(&options{Approvers: "admin@example.com"})
+	a.Queue(registration{UserID: "foo@example.com", MpinID: "aa", Expires: time.Now().Add(-time.Second)})
+	if pending := a.Pending(); len(pending) != 0 {
+		t.Errorf("pending = %+v", pending)
+	}
+	if _, err := a.Take("aa"); err != errNoRegistration {
+		t.Errorf("err = <%v> want <%v>", err, errNoRegistration)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+var errCircuitOpen = errors.New("RPS unavailable (circuit open)")
+
+// circuitBreaker stops calls to RPS after Threshold consecutive failures.
+// After Cooldown a single probe is let through (half-open); its result
+// closes the circuit again or restarts the cooldown.
+// A nil *circuitBreaker is valid and never trips.
+type circuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	trips    int
+	rejected int
+}
+
+type breakerStats struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Trips    int    `json:"trips"`
+	Rejected int    `json:"rejected"`
+	RetryIn  int    `json:"retryInSeconds"`
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// Allow returns errCircuitOpen when the call must not be made. Every
+// allowed call has to be followed by Success or Failure.
+func (b *circuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			b.rejected++
+			return errCircuitOpen
+		}
+		log.Printf("I RPS circuit half-open, probing")
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			b.rejected++
+			return errCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *circuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		log.Printf("I RPS circuit closed")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.Threshold) {
+		log.Printf("W RPS circuit open after %d consecutive failures", b.failures)
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.trips++
+	}
+}
+
+func (b *circuitBreaker) State() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// IsOpen reports whether calls are currently being refused. It does not
+// consume the half-open probe.
+func (b *circuitBreaker) IsOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen && time.Since(b.openedAt) < b.Cooldown
+}
+
+// RetryAfter returns the time left until the next probe
+func (b *circuitBreaker) RetryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	if left := b.Cooldown - time.Since(b.openedAt); left > 0 {
+		return left
+	}
+	return 0
+}
+
+func (b *circuitBreaker) Stats() (s breakerStats) {
+	if b == nil {
+		s.State = breakerClosed.String()
+		return
+	}
+	retryIn := b.RetryAfter()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s.State = b.state.String()
+	s.Failures = b.failures
+	s.Trips = b.trips
+	s.Rejected = b.rejected
+	s.RetryIn = int((retryIn + time.Second - 1) / time.Second)
+	return
+}
+
+// breakerTransport guards the RPS proxy with the circuit breaker
+type breakerTransport struct {
+	Transport http.RoundTripper
+	Breaker   *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.Breaker.Allow(); err != nil {
+		return nil, err
+	}
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil || resp.StatusCode >= 500 {
+		t.Breaker.Failure()
+	} else {
+		t.Breaker.Success()
+	}
+	return resp, err
+}
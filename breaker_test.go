@@ -0,0 +1,116 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTrips(t *testing.T) {
+	b := newCircuitBreaker(3, time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("call %d refused: %v", i, err)
+		}
+		b.Failure()
+	}
+	if b.State() != breakerOpen {
+		t.Fatalf("state = <%v> want <%v>", b.State(), breakerOpen)
+	}
+	if err := b.Allow(); err != errCircuitOpen {
+		t.Errorf("err = <%v> want <%v>", err, errCircuitOpen)
+	}
+	if stats := b.Stats(); stats.Trips != 1 || stats.Rejected != 1 {
+		t.Errorf("stats = <%+v> want 1 trip and 1 rejected call", stats)
+	}
+}
+
+func TestCircuitBreakerSuccessResets(t *testing.T) {
+	b := newCircuitBreaker(2, time.Hour)
+	b.Allow()
+	b.Failure()
+	b.Allow()
+	b.Success()
+	b.Allow()
+	b.Failure()
+	if b.State() != breakerClosed {
+		t.Errorf("state = <%v> want <%v>", b.State(), breakerClosed)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := newCircuitBreaker(1, 10*time.Millisecond)
+	b.Allow()
+	b.Failure()
+	time.Sleep(20 * time.Millisecond)
+
+	if b.IsOpen() {
+		t.Error("circuit should accept a probe after cooldown")
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+	if err := b.Allow(); err != errCircuitOpen {
+		t.Errorf("second call during probe: err = <%v> want <%v>", err, errCircuitOpen)
+	}
+	b.Failure()
+	if b.State() != breakerOpen {
+		t.Fatalf("failed probe: state = <%v> want <%v>", b.State(), breakerOpen)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	b.Allow()
+	b.Success()
+	if b.State() != breakerClosed {
+		t.Errorf("successful probe: state = <%v> want <%v>", b.State(), breakerClosed)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Second)
+	for i := 0; i < 10; i++ {
+		b.Failure()
+	}
+	if err := b.Allow(); err != nil {
+		t.Error(err)
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestBreakerTransport(t *testing.T) {
+	b := newCircuitBreaker(1, time.Hour)
+	rt := &breakerTransport{Transport: failingTransport{}, Breaker: b}
+	r := httptest.NewRequest("GET", "http://rps/clientSettings", nil)
+
+	if _, err := rt.RoundTrip(r); err == nil || err == errCircuitOpen {
+		t.Errorf("err = <%v> want transport error", err)
+	}
+	if _, err := rt.RoundTrip(r); err != errCircuitOpen {
+		t.Errorf("err = <%v> want <%v>", err, errCircuitOpen)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// originalURI returns the URI of the request the proxy asks about. Traefik
+// sends X-Forwarded-Uri; for nginx it is set with
+// proxy_set_header X-Original-URI $request_uri.
+func originalURI(r *http.Request) string {
+	if uri := r.Header.Get("X-Forwarded-Uri"); uri != "" {
+		return uri
+	}
+	return r.Header.Get("X-Original-URI")
+}
+
+// authLoginURL returns the PIN pad URL that resumes the original request
+// after the login
+func authLoginURL(c *context, uri string) string {
+	login := c.App.Options.AuthLoginURL
+	next, ok := safeNext(uri)
+	if !ok || next == "/" {
+		return login
+	}
+	sep := "?"
+	if strings.Contains(login, "?") {
+		sep = "&"
+	}
+	return login + sep + "next=" + url.QueryEscape(next)
+}
+
+// forwardAuthUser returns the logged in user of the session cookie,
+// without creating a session for anonymous requests
+func forwardAuthUser(c *context, r *http.Request) (string, time.Time) {
+	if c.LoggedUser != "" {
+		return c.LoggedUser, c.AuthTime
+	}
+	cookie, err := getSecureCookie(r, "mpindemo_session", c.App.Options.UseSecureCookie)
+	if err != nil {
+		return "", time.Time{}
+	}
+	item, err := c.App.Store.Get(cookie.Value)
+	if err != nil {
+		return "", time.Time{}
+	}
+	c.SessionID = cookie.Value
+	return item.User, item.AuthTime
+}
+
+// sendToLogin answers with the PIN pad URL in Location. Traefik, which
+// sends X-Forwarded-Method, passes the answer to the browser, so it gets a
+// 302; nginx auth_request only accepts 401 and redirects itself.
+func sendToLogin(c *context, w http.ResponseWriter, r *http.Request, uri string) (int, error) {
+	status := 401
+	if r.Header.Get("X-Forwarded-Method") != "" {
+		status = 302
+	}
+	w.Header().Set("Location", authLoginURL(c, uri))
+	w.WriteHeader(status)
+	return status, nil
+}
+
+// authVerifyHandler answers nginx auth_request and Traefik ForwardAuth
+// subrequests. Logged in users get 200 with the identity headers, others
+// are sent to the PIN pad.
+func authVerifyHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "HEAD"); err != nil {
+		return s, err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	uri := originalURI(r)
+
+	userID, authTime := forwardAuthUser(c, r)
+	if userID == "" {
+		return sendToLogin(c, w, r, uri)
+	}
+	c.LoggedUser = userID
+	c.UserID = userID
+
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		maxAge, ok := c.App.StepUp.MaxAge(u.Path)
+		if ok && (authTime.IsZero() || time.Since(authTime) > maxAge) {
+			log.Printf("I %v %v Login within %v required for %v, stepping up", c.SessionID, userID, maxAge, u.Path)
+			return sendToLogin(c, w, r, uri)
+		}
+	}
+
+	c.App.Identity.Set(c, w.Header(), userID)
+	w.WriteHeader(200)
+	return 200, nil
+}
@@ -0,0 +1,114 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthLoginURL(t *testing.T) {
+	c := &context{App: testApp()}
+	for _, d := range []struct {
+		login, uri, want string
+	}{
+		{"/", "/reports?year=2016", "/?next=%2Freports%3Fyear%3D2016"},
+		{"/", "", "/"},
+		{"/", "/", "/"},
+		{"/", "//evil.example.com/", "/"},
+		{"/login?lang=en", "/reports", "/login?lang=en&next=%2Freports"},
+	} {
+		opts := *c.App.Options
+		opts.AuthLoginURL = d.login
+		c.App.Options = &opts
+		if got := authLoginURL(c, d.uri); got != d.want {
+			t.Errorf("authLoginURL(%q, %q) = <%v> want <%v>", d.login, d.uri, got, d.want)
+		}
+	}
+}
+
+func TestAuthVerifyHandlerAnonymous(t *testing.T) {
+	c, w, r := prepare("GET", "/auth/verify", nil)
+	r.Header.Set("X-Forwarded-Uri", "/reports")
+	if s, _ := authVerifyHandler(c, w, r); s != 401 || w.Code != 401 {
+		t.Fatalf("status = <%d> code = <%d> want <401>", s, w.Code)
+	}
+	if l := w.Header().Get("Location"); l != "/?next=%2Freports" {
+		t.Errorf("location = <%v>", l)
+	}
+	// No session is created for anonymous requests
+	if len(w.Header()["Set-Cookie"]) != 0 || len(c.App.Store) != 0 {
+		t.Errorf("session created for an anonymous request")
+	}
+
+	// Sessions without a login are anonymous
+	c, w, r = prepare("GET", "/auth/verify", nil)
+	c.App.Store.Put("345", session{})
+	r.AddCookie(&http.Cookie{Name: "mpindemo_session", Value: "345"})
+	if s, _ := authVerifyHandler(c, w, r); s != 401 {
+		t.Errorf("status = <%d> want <401>", s)
+	}
+}
+
+// Traefik passes the answer to the browser, which only follows redirects
+func TestAuthVerifyHandlerTraefik(t *testing.T) {
+	c, w, r := prepare("GET", "/auth/verify", nil)
+	r.Header.Set("X-Forwarded-Method", "GET")
+	r.Header.Set("X-Forwarded-Uri", "/reports")
+	if s, _ := authVerifyHandler(c, w, r); s != 302 || w.Code != 302 || w.Header().Get("Location") != "/?next=%2Freports" {
+		t.Errorf("status = <%d> code = <%d> location = <%v> want <302>", s, w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAuthVerifyHandlerLoggedIn(t *testing.T) {
+	c, w, r := prepare("GET", "/auth/verify", nil)
+	c.App.Store.Put("345", session{User: "foo@example.com", AuthTime: time.Now()})
+	r.AddCookie(&http.Cookie{Name: "mpindemo_session", Value: "345"})
+	r.Header.Set("X-Original-URI", "/reports")
+	if s, _ := authVerifyHandler(c, w, r); s != 200 || w.Code != 200 {
+		t.Fatalf("status = <%d> code = <%d> want <200>", s, w.Code)
+	}
+	if u := w.Header().Get("X-Remote-User"); u != "foo@example.com" {
+		t.Errorf("X-Remote-User = <%v>", u)
+	}
+}
+
+func TestAuthVerifyHandlerStepUp(t *testing.T) {
+	c, _, _ := prepare("GET", "/auth/verify", nil)
+	c.App.StepUp, _ = parseStepUpRules("/admin=5m")
+	c.App.Store.Put("345", session{User: "foo@example.com", AuthTime: time.Now().Add(-10 * time.Minute)})
+
+	for _, d := range []struct {
+		uri    string
+		status int
+	}{
+		{"/reports", 200},
+		{"/admin/users?page=2", 401},
+	} {
+		w := httptest.NewRecorder()
+		r := mustRequest("GET", "/auth/verify")
+		r.AddCookie(&http.Cookie{Name: "mpindemo_session", Value: "345"})
+		r.Header.Set("X-Forwarded-Uri", d.uri)
+		if s, _ := authVerifyHandler(&context{App: c.App}, w, r); s != d.status {
+			t.Errorf("%v: status = <%d> want <%d>", d.uri, s, d.status)
+		}
+	}
+}
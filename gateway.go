@@ -0,0 +1,225 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LDAP attributes are looked up again after this long
+const identityLDAPCacheTTL = 5 * time.Minute
+
+type identityCacheEntry struct {
+	Headers http.Header
+	Expires time.Time
+}
+
+// identityHeaders tell an application behind the RPA who is logged in: the
+// userId in User and the LDAP attributes mapped in LDAP
+type identityHeaders struct {
+	User string
+	LDAP map[string]string
+
+	mu    sync.Mutex
+	cache map[string]identityCacheEntry
+}
+
+// newIdentityHeaders parses the LDAP headers, as "attribute=Header,..."
+func newIdentityHeaders(o *options) (*identityHeaders, error) {
+	h := &identityHeaders{
+		User:  http.CanonicalHeaderKey(o.GatewayUserHeader),
+		LDAP:  make(map[string]string),
+		cache: make(map[string]identityCacheEntry),
+	}
+	for _, entry := range strings.Split(o.GatewayLDAPHeaders, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid gateway LDAP header %q, want attribute=Header", entry)
+		}
+		h.LDAP[strings.TrimSpace(parts[0])] = http.CanonicalHeaderKey(strings.TrimSpace(parts[1]))
+	}
+	return h, nil
+}
+
+// isIdentity reports whether the header name is one of the identity
+// headers. Names are also compared with '_' as '-', as some servers treat
+// them alike.
+func (h *identityHeaders) isIdentity(name string) bool {
+	name = http.CanonicalHeaderKey(strings.Replace(name, "_", "-", -1))
+	if name == h.User {
+		return true
+	}
+	for _, l := range h.LDAP {
+		if name == l {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the identity headers in header with the ones of the user
+func (h *identityHeaders) Set(c *context, header http.Header, userID string) {
+	for name := range header {
+		if h.isIdentity(name) {
+			header.Del(name)
+		}
+	}
+	header.Set(h.User, userID)
+	for name, values := range h.ldapHeaders(c, userID) {
+		header[name] = values
+	}
+}
+
+// ldapHeaders returns the LDAP attributes of the user as headers
+func (h *identityHeaders) ldapHeaders(c *context, userID string) http.Header {
+	if len(h.LDAP) == 0 || c.App.Options.LDAPServer == "" {
+		return nil
+	}
+	h.mu.Lock()
+	entry, ok := h.cache[userID]
+	h.mu.Unlock()
+	if ok && entry.Expires.After(time.Now()) {
+		return entry.Headers
+	}
+
+	var names []string
+	for name := range h.LDAP {
+		names = append(names, name)
+	}
+	ldapEntry, err := ldapUserEntry(c, userID, names)
+	if err != nil {
+		log.Printf("E %v %v Identity LDAP lookup failed: %v", c.SessionID, userID, err)
+		return nil
+	}
+	headers := make(http.Header)
+	if ldapEntry != nil {
+		for attr, name := range h.LDAP {
+			for _, v := range ldapEntry.GetAttributeValues(attr) {
+				// Values can not span lines in a header
+				headers.Add(name, strings.NewReplacer("\r", " ", "\n", " ").Replace(v))
+			}
+		}
+	}
+
+	h.mu.Lock()
+	h.cache[userID] = identityCacheEntry{Headers: headers, Expires: time.Now().Add(identityLDAPCacheTTL)}
+	h.mu.Unlock()
+	return headers
+}
+
+// gateway proxies the paths not served by the RPA to an upstream
+// application, for logged in users only
+type gateway struct {
+	Upstream *url.URL
+	Proxy    *httputil.ReverseProxy
+}
+
+// newGateway returns nil when no upstream is configured
+func newGateway(o *options) (*gateway, error) {
+	if o.GatewayUpstream == "" {
+		return nil, nil
+	}
+	upstream, err := url.Parse(o.GatewayUpstream)
+	if err != nil || upstream.Host == "" || (upstream.Scheme != "http" && upstream.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid gateway upstream %q", o.GatewayUpstream)
+	}
+	g := &gateway{Upstream: upstream}
+	g.Proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			proto := "http"
+			if req.TLS != nil {
+				proto = "https"
+			}
+			for _, h := range rpsForwardedHeaders {
+				req.Header.Del(h)
+			}
+			req.Header.Set("X-Forwarded-Proto", proto)
+			req.Header.Set("X-Forwarded-Host", req.Host)
+			req.URL.Scheme = upstream.Scheme
+			req.URL.Host = upstream.Host
+			req.URL.Path = singleJoiningSlash(upstream.Path, req.URL.Path)
+			req.URL.RawPath = ""
+			req.Host = upstream.Host
+			stripCookie(req, "mpindemo_session")
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("E Gateway upstream %v failed for %v: %v", upstream.Host, r.URL.Path, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+	return g, nil
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch {
+	case a == "" || a == "/":
+		return b
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// gatewayRouter serves "/" with the PIN pad and proxies every other path
+// not registered by the RPA
+func gatewayRouter(index, gw http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			index.ServeHTTP(w, r)
+			return
+		}
+		gw.ServeHTTP(w, r)
+	})
+}
+
+// gatewayHandler proxies the request of a logged in user to the upstream.
+// Anonymous browsers are sent to the PIN pad and come back after the login;
+// other requests get 401.
+func gatewayHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.LoggedUser == "" {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			setLoginNext(c, r.URL.RequestURI())
+			http.Redirect(w, r, "/", 302)
+			return 302, nil
+		}
+		return 401, errors.New("Login required")
+	}
+	if stepUp(c, w, r) {
+		return 302, nil
+	}
+	c.UserID = c.LoggedUser
+
+	c.App.Identity.Set(c, r.Header, c.LoggedUser)
+
+	c.App.Gateway.Proxy.ServeHTTP(w, r)
+	return 200, nil
+}
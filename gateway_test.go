@@ -0,0 +1,166 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testGatewayApp returns an app proxying to an upstream that echoes the
+// request headers as JSON
+func testGatewayApp(t *testing.T) (*app, *httptest.Server) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.RequestURI())
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	a := testApp()
+	opts := *a.Options
+	opts.GatewayUpstream = upstream.URL + "/app"
+	opts.GatewayUserHeader = "X-Remote-User"
+	opts.GatewayLDAPHeaders = "mail=X-Remote-Email"
+	a.Options = &opts
+	var err error
+	if a.Identity, err = newIdentityHeaders(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if a.Gateway, err = newGateway(&opts); err != nil {
+		t.Fatal(err)
+	}
+	return a, upstream
+}
+
+func TestNewGateway(t *testing.T) {
+	for _, d := range []struct {
+		upstream string
+		ok       bool
+	}{
+		{"", true},
+		{"http://localhost:8080", true},
+		{"https://app.example.com/base", true},
+		{"localhost:8080", false},
+		{"ftp://localhost", false},
+	} {
+		o := options{GatewayUpstream: d.upstream}
+		if _, err := newGateway(&o); (err == nil) != d.ok {
+			t.Errorf("newGateway(%q) error = %v", d.upstream, err)
+		}
+	}
+}
+
+func TestNewIdentityHeaders(t *testing.T) {
+	o := options{GatewayUserHeader: "x-remote-user", GatewayLDAPHeaders: "mail=x-remote-email, cn=X-Remote-Name"}
+	h, err := newIdentityHeaders(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.User != "X-Remote-User" || h.LDAP["mail"] != "X-Remote-Email" || h.LDAP["cn"] != "X-Remote-Name" {
+		t.Errorf("headers = <%v> <%v>", h.User, h.LDAP)
+	}
+	for _, name := range []string{"X-Remote-User", "x_remote_user", "X_Remote_Name", "X-Remote-Email"} {
+		if !h.isIdentity(name) {
+			t.Errorf("%v is not an identity header", name)
+		}
+	}
+	if h.isIdentity("X-Remote-Addr") {
+		t.Errorf("X-Remote-Addr is an identity header")
+	}
+
+	for _, s := range []string{"mail", "=X-Remote-Email", "mail="} {
+		o.GatewayLDAPHeaders = s
+		if _, err := newIdentityHeaders(&o); err == nil {
+			t.Errorf("newIdentityHeaders(%q) succeeded", s)
+		}
+	}
+}
+
+func TestGatewayHandlerAnonymous(t *testing.T) {
+	a, upstream := testGatewayApp(t)
+	defer upstream.Close()
+
+	c := &context{App: a, SessionID: "345"}
+	a.Store.Put(c.SessionID, session{})
+	w := httptest.NewRecorder()
+	if s, _ := gatewayHandler(c, w, mustRequest("GET", "/reports?year=2016")); s != 302 || w.Header().Get("Location") != "/" {
+		t.Fatalf("status = <%d> location = <%v> want <302> </>", s, w.Header().Get("Location"))
+	}
+	if next := loginNext(c); next != "/reports?year=2016" {
+		t.Errorf("next = <%v>", next)
+	}
+
+	w = httptest.NewRecorder()
+	if s, err := gatewayHandler(c, w, mustRequest("POST", "/reports")); s != 401 || err == nil {
+		t.Errorf("status = <%d> want <401>", s)
+	}
+}
+
+func TestGatewayHandlerProxy(t *testing.T) {
+	a, upstream := testGatewayApp(t)
+	defer upstream.Close()
+
+	c := &context{App: a, SessionID: "345", LoggedUser: "foo@example.com"}
+	a.Store.Put(c.SessionID, session{User: c.LoggedUser, AuthTime: time.Now()})
+	r := mustRequest("GET", "/reports?year=2016")
+	r.Header.Set("X-Remote-User", "admin@example.com")
+	r.Header["X_remote_user"] = []string{"admin@example.com"}
+	r.Header.Set("X-Remote-Email", "admin@example.com")
+	r.Header.Set("Forwarded", "for=10.0.0.1")
+	r.AddCookie(&http.Cookie{Name: "mpindemo_session", Value: "345"})
+	r.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+
+	w := httptest.NewRecorder()
+	if s, err := gatewayHandler(c, w, r); s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v>", s, err)
+	}
+	if w.Code != 200 || w.Header().Get("X-Path") != "/app/reports?year=2016" {
+		t.Fatalf("code = <%d> path = <%v>", w.Code, w.Header().Get("X-Path"))
+	}
+	var headers http.Header
+	if err := json.Unmarshal(w.Body.Bytes(), &headers); err != nil {
+		t.Fatal(err)
+	}
+	if v := headers["X-Remote-User"]; len(v) != 1 || v[0] != "foo@example.com" {
+		t.Errorf("X-Remote-User = %v", v)
+	}
+	// No LDAP server is configured in tests
+	for _, h := range []string{"X_remote_user", "X-Remote-Email", "Forwarded"} {
+		if v, ok := headers[h]; ok {
+			t.Errorf("spoofed %v = %v passed to the upstream", h, v)
+		}
+	}
+	if v := headers.Get("Cookie"); v != "app=1" {
+		t.Errorf("Cookie = <%v> want <app=1>", v)
+	}
+}
+
+func TestGatewayHandlerUpstreamDown(t *testing.T) {
+	a, upstream := testGatewayApp(t)
+	upstream.Close()
+
+	c := &context{App: a, SessionID: "345", LoggedUser: "foo@example.com"}
+	a.Store.Put(c.SessionID, session{User: c.LoggedUser, AuthTime: time.Now()})
+	w := httptest.NewRecorder()
+	gatewayHandler(c, w, mustRequest("GET", "/reports"))
+	if w.Code != 502 {
+		t.Errorf("code = <%d> want <502>", w.Code)
+	}
+}
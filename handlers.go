@@ -29,6 +29,11 @@ import (
 	"regexp"
 	"strconv"
 	"bytes"
+	"io"
+	"io/ioutil"
+	"crypto/subtle"
+	"net"
+	"sync/atomic"
 )
 
 // Add default headers
@@ -75,12 +80,16 @@ func indexHandler(c *context, w http.ResponseWriter, r *http.Request) (int, erro
 	if s, err := checkAllowedMethods(r, w, "GET", "HEAD"); err != nil {
 		return s, err
 	}
+	if next := r.URL.Query().Get("next"); next != "" {
+		setLoginNext(c, next)
+	}
 	data := make(map[string]interface{})
 	data["StaticURLBase"] = c.App.Options.StaticURLBase
 	data["MpinJSURL"] = c.App.Options.MpinJSURL
 	data["User"] = c.LoggedUser
 	data["ClientSettingsURL"] = c.App.Options.ClientSettingsURL
 	data["MobileAppFullURL"] = c.App.Options.MobileAppFullURL
+	data["SuccessLoginURL"] = successLoginURL(c)
 
 	return renderTemplate(c.App, w, "index.tmpl", data)
 }
@@ -150,6 +159,16 @@ func verifyUserHandler(c *context, w http.ResponseWriter, r *http.Request) (int,
 		return 403, errors.New("BAD REQUEST. INVALID USER ID")
 	}
 
+	if s, err := throttleUser(c, w, rq.UserID); err != nil {
+		return s, err
+	}
+	// RPS makes this request, so only the user is throttled
+	if rq.Resend = isResend(m["resend"]); rq.Resend {
+		if s, err := throttleResend(c, w, rq.UserID, ""); err != nil {
+			return s, err
+		}
+	}
+
 	if regexp.MustCompile("[^0-9a-fA-F]").Match([]byte(rq.MpinID)){
 		log.Printf("E %v %v Invalid data received. mpinId argument contains invalid characters", c.SessionID, rq.UserID)
 		return 400, errors.New("BAD REQUEST. INVALID MPIN ID")
@@ -191,7 +210,11 @@ func verifyUserHandler(c *context, w http.ResponseWriter, r *http.Request) (int,
 		}
 	}
 
-	resp := verifyUserResponse{c.App.Options.ForceActivate}
+	if !rq.Resend {
+		c.App.Webhooks.Fire(webhookRegistered, rq.UserID, map[string]string{"mpinId": rq.MpinID, "mobile": strconv.Itoa(rq.Mobile)})
+	}
+
+	resp := verifyUserResponse{forceActivate(c)}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := encodeJSONResponse(w, resp); err != nil {
@@ -264,15 +287,54 @@ func authenticateUserHandler(c *context, w http.ResponseWriter, r *http.Request)
 		return 400, errors.New("BAD REQUEST. AUTH OTT")
 	}
 
+	c.ClientIP = net.ParseIP(clientIP(c, r))
 	userID, message, status := c.App.Authenticate(c, rq.MpinResponse.AuthOTT)
 
-	c.App.LoginResult(c, userID, rq.MpinResponse.AuthOTT, status, message)
+	if s, err := throttleUser(c, w, userID); err != nil {
+		// RPS reports its own failures, only a login it accepted is denied
+		if status == 200 {
+			denyLoginResult(c, userID, rq.MpinResponse.AuthOTT, 403, err.Error())
+		}
+		return s, err
+	}
+	mpinOK := status == 200
+	switch status {
+	case 401:
+		if locked := c.App.Lockouts.Failure(userID); locked > 0 {
+			log.Printf("W %v %v Account locked for %v after failed logins", c.SessionID, userID, locked)
+		}
+	}
+
+	if err := c.App.LoginResult(c, userID, rq.MpinResponse.AuthOTT, status, message); err != nil {
+		if revoked, ok := err.(*revokedError); ok {
+			status, message = revoked.Status, revoked.Message
+		}
+	}
+	// Failures of the LDAP password step are cleared after the password
+	if mpinOK && !c.PasswordPending {
+		c.App.Lockouts.Success(userID)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	if c.App.Options.RequestOTP {
 		var ret authOTPResponse
-		ret.TTLSeconds = 64
+		ttl := c.OTPTTL
+		if ttl <= 0 {
+			ttl = c.App.Options.OTPTTL
+		}
+		// With the LDAP password step the OTP is issued after the password
+		if status == 200 && !c.PasswordPending {
+			entry, err := c.App.OTPs.Issue(c.SessionID, userID, c.OTP, ttl)
+			if err != nil {
+				return 500, err
+			}
+			if c.OTP == "" {
+				log.Printf("W %v %v RPS did not send an OTP, generated locally", c.SessionID, userID)
+			}
+			ret.OTP = entry.OTP
+		}
+		ret.TTLSeconds = int64(ttl / time.Second)
 		ret.NowTime = time.Now().Unix() * 1000
 		ret.ExpireTime = ret.NowTime + ret.TTLSeconds*1000
 		if err := encodeJSONResponse(w, &ret); err != nil {
@@ -280,8 +342,21 @@ func authenticateUserHandler(c *context, w http.ResponseWriter, r *http.Request)
 		}
 	} else {
 		var ret authRPAResponse
-		ret.SomeUserData = "This will be handled by onSuccessLogin handler."
 		ret.UserId = userID
+		ret.PasswordRequired = c.PasswordPending
+		if c.App.Tokens == nil {
+			ret.SomeUserData = "This will be handled by onSuccessLogin handler."
+		} else if status == 200 && !c.PasswordPending {
+			pair, err := c.App.Tokens.Issue(c.SessionID, userID, c.MpinID, time.Now())
+			if err != nil {
+				log.Printf("E %v %v Failed to issue tokens: %v", c.SessionID, userID, err)
+				return 500, err
+			}
+			ret.AccessToken = pair.AccessToken
+			ret.RefreshToken = pair.RefreshToken
+			ret.TokenType = pair.TokenType
+			ret.ExpiresIn = pair.ExpiresIn
+		}
 		if err := encodeJSONResponse(w, &ret); err != nil {
 			return 500, errors.New("Failed to encode response")
 		}
@@ -295,14 +370,27 @@ func activateHandler(c *context, w http.ResponseWriter, r *http.Request) (status
 		return s, err
 	}
 	params, err := verifySignature(c, r)
-	if err != nil {
+	// Invalid, expired and used links show the reason
+	if err != nil && params.ErrorMessage == "" {
 		return 500, err
 	}
 
 	if r.Method == "POST" && params.IsValid {
+		if s, err := throttleUser(c, w, params.UserID); err != nil {
+			return s, err
+		}
 
-		if err = c.App.ActivateUser(c, params.Identity, params.ActivateKey); err == nil {
+		if !c.App.Activation.Use(params.Identity, params.ActivateKey, params.Expires) {
+			log.Printf("W %v %v Activation link already used", c.SessionID, params.UserID)
+			params.IsValid = false
+			params.ErrorMessage = errActivationUsed.Error()
+		} else if err = c.App.ActivateUser(c, params.Identity, params.ActivateKey); err == nil {
 			params.Activated = true
+			c.App.Identities.Activated(params.Identity)
+			c.App.ActivationMails.Remove(params.Identity)
+			c.App.Webhooks.Fire(webhookActivated, params.UserID, map[string]string{"deviceName": params.DeviceName})
+		} else {
+			c.App.Activation.Release(params.Identity, params.ActivateKey)
 		}
 	}
 
@@ -324,16 +412,47 @@ func permitUserHandler(c *context, w http.ResponseWriter, r *http.Request) (stat
 	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
 		return s, err
 	}
-	// The revocation handler
-	// When the RPS option RPAPermitUserURL is set
-	// It will make a request for validating the identity
-	// Before giving the time permit share to the client
+	// When the RPS option RPAPermitUserURL is set, RPS calls it with the
+	// mpin_id before giving the time permit share to the client.
+	// Returning 403 shows the Unauthorized message inside the PinPad.
 
 	w.Header().Set("Content-Type", "application/json")
 
-	// If you return 403 it will show Unauthorized message inside the PinPad
-	// self.set_status(403)
+	q := r.URL.Query()
+	mpinID := q.Get("mpin_id")
+	if mpinID == "" {
+		mpinID = q.Get("mpinId")
+	}
+	// Identities revoked by their user get no more time permits
+	if c.App.Identities.IsRevoked(mpinID) {
+		log.Printf("W %v %v Time permit denied: identity %v revoked", c.SessionID, "", mpinID)
+		return 403, errors.New("User not authorized")
+	}
 
+	if c.App.Permit == nil && c.App.Policy == nil {
+		return 200, nil
+	}
+
+	id, err := decodeIdentity(mpinID)
+	if err != nil {
+		log.Printf("E %v %v Invalid mpin_id %q: %v", c.SessionID, "", mpinID, err)
+		return 400, errors.New("BAD REQUEST. INVALID MPIN ID")
+	}
+	c.UserID = id.UserID
+
+	reason, err := c.App.Permit.Check(c, id)
+	if err != nil {
+		log.Printf("E %v %v Time permit check failed: %v", c.SessionID, id.UserID, err)
+		reason = "Check failed"
+	}
+	if reason != "" {
+		log.Printf("W %v %v Time permit denied: %v", c.SessionID, id.UserID, reason)
+		return 403, errors.New("User not authorized")
+	}
+	// RPS makes this request, so the client IP is not known
+	if !checkAccessPolicy(c, newPolicyRequest(policyPhasePermit, id.UserID, mpinID, nil)) {
+		return 403, errors.New("User not authorized")
+	}
 	return 200, nil
 }
 
@@ -342,9 +461,17 @@ func protectedHandler(c *context, w http.ResponseWriter, r *http.Request) (statu
 		return s, err
 	}
 	if len(c.LoggedUser) < 1 {
-		http.Redirect(w, r, "/", 301)
+		// Resume the requested page after the login
+		setLoginNext(c, r.URL.RequestURI())
+		http.Redirect(w, r, "/", 302)
+		return 302, nil
+	} else if stepUp(c, w, r) {
+		return 302, nil
 	} else {
-		protectdePage := strings.TrimLeft(r.URL.Path, "/protected/")
+		if next := loginNext(c); next == r.URL.RequestURI() {
+			clearLoginNext(c)
+		}
+		protectdePage := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/protected"), "/")
 		var templateName string
 		if len(protectdePage) < 1 {
 			templateName = "protected.tmpl"
@@ -355,12 +482,104 @@ func protectedHandler(c *context, w http.ResponseWriter, r *http.Request) (statu
 		data["Welcome"] = false
 		data["User"] = c.LoggedUser
 		data["StaticURLBase"] = c.App.Options.StaticURLBase
+		if c.App.SAML != nil {
+			data["ServiceProviders"] = c.App.SAML.ServiceProviders()
+		}
 
 		renderTemplate(c.App, w, templateName, data)
 	}
 	return 200, nil
 }
 
+// Show the OTP issued at login, with its remaining validity
+func otpHandler(c *context, w http.ResponseWriter, r *http.Request) (status int, err error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	entry, ok := c.App.OTPs.ForSession(c.SessionID)
+	if len(c.LoggedUser) < 1 || !ok || entry.UserID != c.LoggedUser {
+		http.Redirect(w, r, "/", 302)
+		return 302, nil
+	}
+	data := make(map[string]interface{})
+	data["StaticURLBase"] = c.App.Options.StaticURLBase
+	data["User"] = c.LoggedUser
+	data["OTP"] = entry.OTP
+	data["ExpiresIn"] = int(entry.Expires.Sub(time.Now()) / time.Second)
+	data["Next"] = "/protected"
+	if next := loginNext(c); next != "" {
+		data["Next"] = next
+	}
+
+	return renderTemplate(c.App, w, "otp.tmpl", data)
+}
+
+// Verify an OTP received over a second channel, from the HTML form or as JSON
+func otpVerifyHandler(c *context, w http.ResponseWriter, r *http.Request) (status int, err error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	data := make(map[string]interface{})
+	data["StaticURLBase"] = c.App.Options.StaticURLBase
+	if r.Method == "GET" {
+		return renderTemplate(c.App, w, "otp_verify.tmpl", data)
+	}
+
+	var rq struct {
+		UserID string `json:"userId"`
+		OTP    string `json:"otp"`
+	}
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+			log.Printf("E %v %v Can not decode body as JSON", c.SessionID, "")
+			return 400, errors.New("BAD REQUEST. INVALID JSON")
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return 400, err
+		}
+		rq.UserID = r.PostFormValue("userId")
+		rq.OTP = r.PostFormValue("otp")
+	}
+	c.UserID = rq.UserID
+
+	verr := c.App.OTPs.Verify(rq.UserID, strings.TrimSpace(rq.OTP))
+	if verr != nil {
+		log.Printf("W %v %v OTP verification failed", c.SessionID, rq.UserID)
+		status = 401
+	} else {
+		log.Printf("I %v %v OTP verified", c.SessionID, rq.UserID)
+		status = 200
+	}
+
+	if isJSON {
+		var ret struct {
+			Valid   bool   `json:"valid"`
+			UserID  string `json:"userId"`
+			Message string `json:"message,omitempty"`
+		}
+		ret.Valid = verr == nil
+		ret.UserID = rq.UserID
+		if verr != nil {
+			ret.Message = verr.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := encodeJSONResponse(w, &ret); err != nil {
+			return 500, errors.New("Failed to encode response")
+		}
+		return status, nil
+	}
+
+	data["UserID"] = rq.UserID
+	data["Submitted"] = true
+	data["Valid"] = verr == nil
+	w.WriteHeader(status)
+	renderTemplate(c.App, w, "otp_verify.tmpl", data)
+	return status, nil
+}
+
 func aboutHandler(c *context, w http.ResponseWriter, r *http.Request) (status int, err error) {
 	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
 		return s, err
@@ -375,11 +594,7 @@ func logoutHandler(c *context, w http.ResponseWriter, r *http.Request) (status i
 	}
 
 	if r.Method == "GET" {
-		_, err := c.App.Store.Get(c.SessionID)
-		if err == nil {
-			c.App.Store.Delete(c.SessionID)
-		}
-		deleteCookie(w, "mpindemo_session")
+		endSession(c, w)
 		http.Redirect(w, r, "/", 301)
 		return 301, nil
 	}
@@ -400,17 +615,198 @@ func logoutHandler(c *context, w http.ResponseWriter, r *http.Request) (status i
 		log.Printf("E %v %v %v", c.SessionID, "", err)
 		return 400, errors.New("BAD REQUEST. INVALID JSON")
 	}
-	log.Printf("D Logout request. Session token: %v", data.SessionID)
-
-	item, err := c.App.Store.Get(data.SessionID)
 	c.UserID = data.UserID
+
+	// sessionToken is the logout token sent to RPS, not the session ID.
+	// It is used up only once the user matches the session.
+	sessionID, err := c.App.Logout.Lookup(data.SessionID)
+	if err != nil {
+		log.Printf("E %v %v Logout failed: %v", c.SessionID, data.UserID, err)
+		return 400, errors.New("Logout failed")
+	}
+	log.Printf("D Logout request for session %v", sessionID)
+
+	item, err := c.App.Store.Get(sessionID)
 	if item.User != data.UserID {
-		log.Printf("E %v %v The logged user %v does not match the requested user %v", c.SessionID, data.UserID, item.User, data.UserID)
+		log.Printf("E %v %v The logged user %v does not match the requested user %v", sessionID, data.UserID, item.User, data.UserID)
+		return 400, errors.New("Logout failed")
+	}
+	if _, useErr := c.App.Logout.Use(data.SessionID); useErr != nil {
+		log.Printf("E %v %v Logout failed: %v", c.SessionID, data.UserID, useErr)
 		return 400, errors.New("Logout failed")
 	}
 	if err == nil {
-		c.App.Store.Delete(data.SessionID)
+		c.App.Store.Delete(sessionID)
+		c.App.Webhooks.Fire(webhookLogout, data.UserID, nil)
+	}
+	c.App.Tokens.RevokeSession(sessionID)
+	return 200, nil
+
+}
+
+// endSession logs out the session of the request and revokes its tokens
+func endSession(c *context, w http.ResponseWriter) {
+	_, err := c.App.Store.Get(c.SessionID)
+	if err == nil {
+		c.App.Store.Delete(c.SessionID)
+	}
+	if c.LoggedUser != "" {
+		c.App.Webhooks.Fire(webhookLogout, c.LoggedUser, nil)
+	}
+	c.App.Tokens.RevokeSession(c.SessionID)
+	c.App.Tokens.Revoke(c.Grant)
+	deleteCookie(w, "mpindemo_session")
+}
+
+// Forward allowed requests to RPS
+func rpsProxyHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+c.App.Options.RpsPrefix)
+	if !c.App.RPSAllow.Allowed(r.Method, path) {
+		return 403, fmt.Errorf("RPS request %v %v not allowed", r.Method, path)
+	}
+	if r.Body != nil {
+		max := int64(c.App.Options.RPSMaxBody)
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+		if err != nil {
+			return 400, err
+		}
+		if int64(len(body)) > max {
+			return 413, fmt.Errorf("Request body larger than %d bytes", max)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	c.App.RpsProxy.ServeHTTP(w, r)
+	return 200, nil
+}
+
+// Serve a maintenance page instead of the PIN pad while the RPS circuit is open
+func rpsAvailableHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !c.App.RPS.Breaker.IsOpen() {
+		return 200, nil
+	}
+	retryAfter := int(c.App.RPS.Breaker.RetryAfter()/time.Second) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return 503, errCircuitOpen
+	}
+	data := make(map[string]interface{})
+	data["StaticURLBase"] = c.App.Options.StaticURLBase
+	data["User"] = c.LoggedUser
+	data["RetryAfter"] = retryAfter
+
+	w.WriteHeader(503)
+	renderTemplate(c.App, w, "maintenance.tmpl", data)
+	return 503, responseSent{errCircuitOpen}
+}
+
+func rpsProxyErrorHandler(a *app, b *rpsBackend) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("E RPS proxy %v %v %v: %v", b.Host, r.Method, r.URL.Path, err)
+		if isDialError(err) {
+			a.RPS.Pool.MarkDown(b.Host)
+		}
+		if err == errCircuitOpen {
+			retryAfter := int(a.RPS.Breaker.RetryAfter()/time.Second) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, http.StatusText(503), 503)
+			return
+		}
+		http.Error(w, http.StatusText(502), 502)
+	}
+}
+
+func healthHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "HEAD"); err != nil {
+		return s, err
+	}
+	var health struct {
+		Status   string          `json:"status"`
+		RPS      breakerStats    `json:"rps"`
+		Backends []backendStatus `json:"rpsBackends"`
+	}
+	health.RPS = c.App.RPS.Breaker.Stats()
+	health.Backends = c.App.RPS.Pool.Status()
+	status := 200
+	if c.App.RPS.Breaker.State() == breakerOpen {
+		health.Status = "degraded"
+		status = 503
+	} else {
+		health.Status = "ok"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := encodeJSONResponse(w, &health); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return status, nil
+}
+
+func metricsHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	stats := c.App.RPS.Breaker.Stats()
+	state := int(c.App.RPS.Breaker.State())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "rpa_rps_circuit_state", "gauge", "RPS circuit breaker state (0 closed, 1 open, 2 half-open)", state)
+	writeMetric(w, "rpa_rps_consecutive_failures", "gauge", "Consecutive failed RPS calls", stats.Failures)
+	writeMetric(w, "rpa_rps_circuit_trips_total", "counter", "Times the RPS circuit has opened", stats.Trips)
+	writeMetric(w, "rpa_rps_circuit_rejected_total", "counter", "RPS calls refused while the circuit was open", stats.Rejected)
+	writeMetric(w, "rpa_throttled_total", "counter", "Requests refused by rate limiting or lockout", int(atomic.LoadInt64(&throttled)))
+	writeMetric(w, "rpa_locked_users", "gauge", "Users locked after failed logins", c.App.Lockouts.LockedUsers())
+	fmt.Fprintf(w, "# HELP rpa_rps_backend_up RPS backend health (1 up, 0 down)\n# TYPE rpa_rps_backend_up gauge\n")
+	for _, b := range c.App.RPS.Pool.Status() {
+		var up int
+		if b.Healthy {
+			up = 1
+		}
+		fmt.Fprintf(w, "rpa_rps_backend_up{host=%q} %d\n", b.Host, up)
+	}
+	return 200, nil
+}
+
+// Allow only requests with the admin token as bearer token. The admin
+// endpoints are disabled when no token is set.
+func adminHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	token := c.App.Options.AdminToken
+	if token == "" {
+		return 404, errors.New("Admin endpoints disabled")
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return 401, errors.New("Invalid admin token")
 	}
 	return 200, nil
+}
 
+// Clear the lockout of a user
+func adminUnlockHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "POST"); err != nil {
+		return s, err
+	}
+	var rq struct {
+		UserID string `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rq); err != nil || rq.UserID == "" {
+		log.Printf("E %v %v Can not decode body as JSON", c.SessionID, "")
+		return 400, errors.New("BAD REQUEST. INVALID USER ID")
+	}
+	c.UserID = rq.UserID
+
+	var ret struct {
+		UserID   string `json:"userId"`
+		Unlocked bool   `json:"unlocked"`
+	}
+	ret.UserID = rq.UserID
+	ret.Unlocked = c.App.Lockouts.Unlock(rq.UserID)
+	log.Printf("I %v %v Unlocked by admin from %v", c.SessionID, rq.UserID, clientIP(c, r))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := encodeJSONResponse(w, &ret); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return 200, nil
 }
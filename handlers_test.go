@@ -29,6 +29,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 	"io/ioutil"
@@ -192,6 +193,148 @@ func TestPermitUserHandlerMethod(t *testing.T) {
 
 }
 
+func tripBreaker(a *app) {
+	for i := 0; i < a.RPS.Breaker.Threshold; i++ {
+		a.RPS.Breaker.Allow()
+		a.RPS.Breaker.Failure()
+	}
+}
+
+func TestRPSAvailableHandlerClosed(t *testing.T) {
+	c, w, r := prepare("GET", "/", new(bytes.Buffer))
+
+	s, err := rpsAvailableHandler(c, w, r)
+
+	if s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v> want <200> <nil>", s, err)
+	}
+}
+
+func TestRPSAvailableHandlerOpen(t *testing.T) {
+	c, w, r := prepare("GET", "/", new(bytes.Buffer))
+	c.App.Templates = loadTemplates("./templates")
+	tripBreaker(c.App)
+
+	s, err := rpsAvailableHandler(c, w, r)
+
+	if s != 503 || err == nil {
+		t.Fatalf("status = <%d> err = <%v> want <503> error", s, err)
+	}
+	if _, ok := err.(responseSent); !ok {
+		t.Errorf("err = <%#v> want responseSent", err)
+	}
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("code = <%d> Retry-After = <%s>", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), "temporarily unavailable") {
+		t.Errorf("maintenance page not rendered: %s", w.Body.String())
+	}
+}
+
+func TestRPSAvailableHandlerOpenPost(t *testing.T) {
+	c, w, r := prepare("POST", "/mpinAuthenticate", new(bytes.Buffer))
+	tripBreaker(c.App)
+
+	s, err := rpsAvailableHandler(c, w, r)
+
+	if s != 503 || err != errCircuitOpen {
+		t.Fatalf("status = <%d> err = <%v> want <503> <%v>", s, err, errCircuitOpen)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	c, w, r := prepare("GET", "/health", new(bytes.Buffer))
+
+	if s, _ := healthHandler(c, w, r); s != 200 {
+		t.Fatalf("status = <%d> want <200>", s)
+	}
+
+	tripBreaker(c.App)
+	w = httptest.NewRecorder()
+	if s, _ := healthHandler(c, w, r); s != 503 {
+		t.Fatalf("status = <%d> want <503>", s)
+	}
+	var health struct {
+		Status string       `json:"status"`
+		RPS    breakerStats `json:"rps"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != "degraded" || health.RPS.State != "open" {
+		t.Errorf("health = <%+v>", health)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	c, w, r := prepare("GET", "/metrics", new(bytes.Buffer))
+	tripBreaker(c.App)
+
+	metricsHandler(c, w, r)
+
+	if !strings.Contains(w.Body.String(), "rpa_rps_circuit_state 1\n") {
+		t.Errorf("circuit state missing from metrics: %s", w.Body.String())
+	}
+}
+
+func TestOTPHandler(t *testing.T) {
+	c, w, r := prepare("GET", "/otp", new(bytes.Buffer))
+	c.App.Templates = loadTemplates("./templates")
+	c.SessionID = "345"
+	c.LoggedUser = "foo"
+
+	if s, _ := otpHandler(c, w, r); s != 302 {
+		t.Fatalf("status = <%d> want <302> without OTP", s)
+	}
+
+	c.App.OTPs.Issue("345", "foo", "123456", time.Minute)
+	w = httptest.NewRecorder()
+	if s, err := otpHandler(c, w, r); s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v> want <200> <nil>", s, err)
+	}
+	if !strings.Contains(w.Body.String(), "123456") {
+		t.Errorf("OTP not rendered: %s", w.Body.String())
+	}
+}
+
+func TestOTPVerifyHandlerJSON(t *testing.T) {
+	c, w, r := prepare("POST", "/otp/verify", bytes.NewBufferString(`{"userId": "foo", "otp": "123456"}`))
+	r.Header.Set("Content-Type", "application/json")
+	c.App.OTPs.Issue("345", "foo", "123456", time.Minute)
+
+	if s, err := otpVerifyHandler(c, w, r); s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v> want <200> <nil>", s, err)
+	}
+	var resp struct {
+		Valid bool `json:"valid"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Valid {
+		t.Fatalf("response = <%s> err = <%v>", w.Body.String(), err)
+	}
+
+	// OTPs are single use
+	c, w, r = prepare("POST", "/otp/verify", bytes.NewBufferString(`{"userId": "foo", "otp": "123456"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if s, _ := otpVerifyHandler(c, w, r); s != 401 {
+		t.Fatalf("status = <%d> want <401>", s)
+	}
+}
+
+func TestOTPVerifyHandlerForm(t *testing.T) {
+	form := url.Values{"userId": {"foo"}, "otp": {"000000"}}
+	c, w, r := prepare("POST", "/otp/verify", bytes.NewBufferString(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.App.Templates = loadTemplates("./templates")
+	c.App.OTPs.Issue("345", "foo", "123456", time.Minute)
+
+	if s, _ := otpVerifyHandler(c, w, r); s != 401 || w.Code != 401 {
+		t.Fatalf("status = <%d> code = <%d> want <401>", s, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "invalid or expired") {
+		t.Errorf("result not rendered: %s", w.Body.String())
+	}
+}
+
 func TestProtectedHandler(t *testing.T) {
 	c, w, r := prepare("GET", "/protected", new(bytes.Buffer))
 
@@ -584,11 +727,12 @@ func testVerifyUserHandlerBasic(t *testing.T, req verifyUserRequest, deviceName,
 		t.Fatal("Failed to decode response, ", err, w.Body.String())
 	}
 
-	validateURL := fmt.Sprintf("%v?i=%v&e=%v&s=%v",
+	validateURL := fmt.Sprintf("%v?i=%v&e=%v&s=%v&h=%v",
 		c.App.Options.VerifyIdentityURL,
 		req.MpinID,
 		req.ExpireTime,
-		req.ActivateKey)
+		req.ActivateKey,
+		c.App.Activation.Sign(req.MpinID, req.ExpireTime, req.ActivateKey))
 
 	if resp.ForceActivate != c.App.Options.ForceActivate ||
 		check.DeviceName != deviceName ||
@@ -20,15 +20,20 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 )
@@ -91,39 +96,11 @@ func loadCACerts(caCertPath string) *tls.Config {
 }
 
 func fetchJSON(a *app, url string, method string, q interface{}, d interface{}) (err error) {
-	payload, err := json.Marshal(q)
-	if err != nil {
-		return
-	}
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
-	if err != nil {
-		return
+	rc := a.RPS
+	if rc == nil {
+		rc = newRPSClient(a.Options, a.tlsConfig)
 	}
-
-	var client *http.Client
-	if a.Options.CACertFile == "" {
-		client = &http.Client{}
-	} else {
-		transport := &http.Transport{TLSClientConfig: a.tlsConfig}
-		client = &http.Client{Transport: transport}
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode > 399 {
-		return fmt.Errorf("Error code %v", resp.StatusCode)
-	}
-	if d == nil {
-		return
-	}
-	decoder := json.NewDecoder(resp.Body)
-	if err = decoder.Decode(d); err != nil {
-		return err
-	}
-	return nil
+	return rc.Do(url, method, q, d)
 }
 
 func getArgument(r *http.Request, key, dflt string) []string {
@@ -157,3 +134,35 @@ func checkAllowedMethods(r *http.Request, w http.ResponseWriter, methods ...stri
 	}
 	return 405, errors.New("Method not allowed")
 }
+
+// writeJSONFile replaces the file with v encoded as JSON. The data is
+// written to a temporary file first, so a crash never leaves half a file.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeMetric writes a single sample in Prometheus text format
+func writeMetric(w io.Writer, name, kind, help string, value int) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %d\n", name, help, name, kind, name, value)
+}
+
+// formToken protects the forms of the logged in pages against cross-site
+// requests. It is bound to the session.
+func formToken(c *context) string {
+	mac := hmac.New(sha256.New, c.App.FormKey)
+	fmt.Fprintf(mac, "form:%v", c.SessionID)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkFormToken checks the token field of a POST form
+func checkFormToken(c *context, r *http.Request) bool {
+	return hmac.Equal([]byte(r.PostFormValue("token")), []byte(formToken(c)))
+}
@@ -868,3 +868,27 @@ func TestCheckAllowedMethodsNotAllow(t *testing.T) {
 		t.Errorf("Access-Control-Allow-Methods[0] = <%s> want <%s>", res.Header["Access-Control-Allow-Methods"][0], "GET")
 	}
 }
+
+func TestWriteJSONFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/state.json"
+	for _, v := range []map[string]int{{"a": 1}, {"b": 2}} {
+		if err := writeJSONFile(path, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != `{"b":2}` {
+		t.Errorf("file = <%s> want <%s>", data, `{"b":2}`)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left: %v", err)
+	}
+	if err := writeJSONFile(dir+"/missing/state.json", 1); err == nil {
+		t.Error("error expected")
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Device names given by the users are cut to this length
+const identityLabelMax = 64
+
+var errNoIdentity = errors.New("Identity not found")
+
+// identityRecord is an M-Pin identity seen by /mpinVerify. Expires is the
+// end of its registration, after which RPS no longer activates it.
+type identityRecord struct {
+	MpinID     string    `json:"mpinId"`
+	UserID     string    `json:"userId"`
+	DeviceName string    `json:"deviceName"`
+	Label      string    `json:"label,omitempty"`
+	Issued     string    `json:"issued"`
+	Registered time.Time `json:"registered"`
+	Expires    time.Time `json:"expires"`
+	Activated  time.Time `json:"activated"`
+	LastLogin  time.Time `json:"lastLogin"`
+	Revoked    time.Time `json:"revoked"`
+}
+
+// identityRegistry records the identities of the users at verify, activate
+// and login time. Identities revoked by their user are denied time permits
+// and logins; those never activated are forgotten when their registration
+// expires. When Path is set the registry is saved there on every change and
+// loaded at start.
+type identityRegistry struct {
+	Path string
+
+	mu         sync.Mutex
+	identities map[string]*identityRecord
+}
+
+func newIdentityRegistry(path string) (*identityRegistry, error) {
+	r := &identityRegistry{Path: path, identities: make(map[string]*identityRecord)}
+	if path == "" {
+		return r, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.identities); err != nil {
+		return nil, fmt.Errorf("Invalid identities file %v: %v", path, err)
+	}
+	return r, nil
+}
+
+// Register records a new identity, whose registration expires at expires.
+// Registering it again keeps its dates.
+func (r *identityRegistry) Register(mpinID, userID string, mobile int, expires time.Time) {
+	id, err := decodeIdentity(mpinID)
+	if err != nil || id.UserID != userID {
+		log.Printf("W %v %v Identity %v not recorded: does not match the user", "", userID, mpinID)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.identities[mpinID]; ok {
+		return
+	}
+	now := time.Now()
+	rec := &identityRecord{MpinID: mpinID, UserID: userID, DeviceName: "PC", Issued: id.Issued, Registered: now, Expires: expires}
+	if mobile != 0 {
+		rec.DeviceName = "Mobile"
+	}
+	r.gc(now)
+	r.identities[mpinID] = rec
+	r.save()
+}
+
+// gc drops the identities never activated whose registration expired
+func (r *identityRegistry) gc(now time.Time) {
+	for k, rec := range r.identities {
+		if rec.Activated.IsZero() && !rec.Expires.IsZero() && rec.Expires.Before(now) {
+			delete(r.identities, k)
+		}
+	}
+}
+
+// Activated records the activation of the identity, or its first login for
+// identities activated with a code
+func (r *identityRegistry) Activated(mpinID string) {
+	r.update(mpinID, func(rec *identityRecord, now time.Time) {
+		if rec.Activated.IsZero() {
+			rec.Activated = now
+		}
+	})
+}
+
+// LoggedIn records a login with the identity
+func (r *identityRegistry) LoggedIn(mpinID string) {
+	r.update(mpinID, func(rec *identityRecord, now time.Time) {
+		if rec.Activated.IsZero() {
+			rec.Activated = now
+		}
+		rec.LastLogin = now
+	})
+}
+
+func (r *identityRegistry) update(mpinID string, f func(*identityRecord, time.Time)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rec, ok := r.identities[mpinID]; ok {
+		f(rec, time.Now())
+		r.save()
+	}
+}
+
+// ForUser returns the identities of the user, newest first
+func (r *identityRegistry) ForUser(userID string) (l []identityRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rec := range r.identities {
+		if rec.UserID == userID {
+			l = append(l, *rec)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Registered.After(l[j].Registered) })
+	return
+}
+
+// Rename sets the name the user gives to the device of the identity. An
+// empty name shows the device type again.
+func (r *identityRegistry) Rename(userID, mpinID, label string) error {
+	label = strings.TrimSpace(label)
+	for len(label) > identityLabelMax {
+		_, size := utf8.DecodeLastRuneInString(label)
+		label = label[:len(label)-size]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.identities[mpinID]
+	if !ok || rec.UserID != userID {
+		return errNoIdentity
+	}
+	rec.Label = label
+	r.save()
+	return nil
+}
+
+// Revoke marks the identity of the user as revoked
+func (r *identityRegistry) Revoke(userID, mpinID string) (identityRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.identities[mpinID]
+	if !ok || rec.UserID != userID {
+		return identityRecord{}, errNoIdentity
+	}
+	if rec.Revoked.IsZero() {
+		rec.Revoked = time.Now()
+		r.save()
+	}
+	return *rec, nil
+}
+
+// IsRevoked reports whether the identity was revoked by its user
+func (r *identityRegistry) IsRevoked(mpinID string) bool {
+	if mpinID == "" {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.identities[mpinID]
+	return ok && !rec.Revoked.IsZero()
+}
+
+// save writes the registry to Path. The caller holds the lock.
+func (r *identityRegistry) save() {
+	if r.Path == "" {
+		return
+	}
+	if err := writeJSONFile(r.Path, r.identities); err != nil {
+		log.Printf("E Failed to save identities: %v", err)
+	}
+}
+
+// revokeIdentity revokes the identity in RPS and in the registry, and ends
+// the sessions and tokens of its logins. The registry denies the identity
+// even when RPS fails.
+func revokeIdentity(c *context, mpinID string) error {
+	rec, err := c.App.Identities.Revoke(c.LoggedUser, mpinID)
+	if err != nil {
+		return err
+	}
+	log.Printf("I %v %v Identity %v revoked by its user", c.SessionID, c.LoggedUser, mpinID)
+	for _, sessionID := range c.App.Store.DeleteMpinID(mpinID) {
+		log.Printf("I %v %v Session ended, identity %v revoked", sessionID, c.LoggedUser, mpinID)
+		c.App.Tokens.RevokeSession(sessionID)
+	}
+	c.App.Tokens.RevokeMpinID(mpinID)
+	if c.App.RPS.Breaker.IsOpen() {
+		log.Printf("W %v %v RPS unavailable, identity %v revoked in the RPA only", c.SessionID, c.LoggedUser, mpinID)
+	} else if err := c.App.RPS.DeleteUser(mpinID); err != nil {
+		log.Printf("W %v %v RPS failed to revoke identity %v: %v", c.SessionID, c.LoggedUser, mpinID, err)
+	}
+	c.App.Webhooks.Fire(webhookRevoked, c.LoggedUser, map[string]string{"mpinId": mpinID, "deviceName": rec.DeviceName})
+	return nil
+}
+
+// List the identities of the logged in user on GET, and rename or revoke
+// one on POST
+func identitiesHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	if c.LoggedUser == "" {
+		setLoginNext(c, r.URL.RequestURI())
+		http.Redirect(w, r, "/", 302)
+		return 302, nil
+	} else if stepUp(c, w, r) {
+		return 302, nil
+	}
+
+	if r.Method == "POST" {
+		if !checkFormToken(c, r) {
+			return 403, errors.New("Invalid form token")
+		}
+		mpinID := r.PostFormValue("mpinId")
+		var err error
+		switch r.PostFormValue("action") {
+		case "rename":
+			err = c.App.Identities.Rename(c.LoggedUser, mpinID, r.PostFormValue("label"))
+		case "revoke":
+			err = revokeIdentity(c, mpinID)
+		default:
+			return 400, errors.New("BAD REQUEST. INVALID ACTION")
+		}
+		if err != nil {
+			log.Printf("W %v %v Identity %v: %v", c.SessionID, c.LoggedUser, mpinID, err)
+			return 404, err
+		}
+		http.Redirect(w, r, "/protected/identities", 303)
+		return 303, nil
+	}
+
+	data := make(map[string]interface{})
+	data["StaticURLBase"] = c.App.Options.StaticURLBase
+	data["User"] = c.LoggedUser
+	data["Identities"] = c.App.Identities.ForUser(c.LoggedUser)
+	data["Token"] = formToken(c)
+	return renderTemplate(c.App, w, "identities.tmpl", data)
+}
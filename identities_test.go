@@ -0,0 +1,215 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSaltedMpinID(userID, salt string) string {
+	b, _ := json.Marshal(map[string]interface{}{"userID": userID, "issued": "2016-05-10 12:00:00", "mobile": 0, "salt": salt})
+	return hex.EncodeToString(b)
+}
+
+func TestIdentityRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "identities.json")
+
+	reg, _ := newIdentityRegistry(path)
+	pc, phone := testSaltedMpinID("foo@example.com", "1"), testSaltedMpinID("foo@example.com", "2")
+	reg.Register(pc, "foo@example.com", 0, time.Now().Add(time.Hour))
+	reg.Register(phone, "foo@example.com", 1, time.Now().Add(time.Hour))
+	// The mpinId must belong to the user
+	reg.Register(testSaltedMpinID("bar@example.com", "3"), "foo@example.com", 0, time.Now().Add(time.Hour))
+
+	reg.Activated(pc)
+	reg.LoggedIn(phone)
+	if err := reg.Rename("foo@example.com", phone, "  My phone "+strings.Repeat("x", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Rename("bar@example.com", phone, "Stolen"); err != errNoIdentity {
+		t.Errorf("err = <%v> want <%v> for another user", err, errNoIdentity)
+	}
+	if _, err := reg.Revoke("bar@example.com", pc); err != errNoIdentity || reg.IsRevoked(pc) {
+		t.Errorf("err = <%v> want <%v> for another user", err, errNoIdentity)
+	}
+	if _, err := reg.Revoke("foo@example.com", pc); err != nil || !reg.IsRevoked(pc) {
+		t.Errorf("err = <%v> revoked = %v", err, reg.IsRevoked(pc))
+	}
+
+	// The registry survives restarts
+	reg, err = newIdentityRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := reg.ForUser("foo@example.com")
+	if len(l) != 2 {
+		t.Fatalf("identities = %+v", l)
+	}
+	byID := map[string]identityRecord{l[0].MpinID: l[0], l[1].MpinID: l[1]}
+	if r := byID[pc]; r.DeviceName != "PC" || r.Issued != "2016-05-10 12:00:00" || r.Activated.IsZero() || r.Revoked.IsZero() {
+		t.Errorf("PC identity = %+v", r)
+	}
+	if r := byID[phone]; r.DeviceName != "Mobile" || !strings.HasPrefix(r.Label, "My phone x") || len(r.Label) != identityLabelMax || r.Activated.IsZero() || r.LastLogin.IsZero() {
+		t.Errorf("phone identity = %+v", r)
+	}
+}
+
+// Identities never activated are forgotten when their registration expires
+func TestIdentityRegistryExpired(t *testing.T) {
+	reg, _ := newIdentityRegistry("")
+	activated, expired := testSaltedMpinID("foo@example.com", "1"), testSaltedMpinID("foo@example.com", "2")
+	reg.Register(activated, "foo@example.com", 0, time.Now().Add(-time.Second))
+	reg.Activated(activated)
+	reg.Register(expired, "foo@example.com", 0, time.Now().Add(-time.Second))
+	reg.Register(testSaltedMpinID("foo@example.com", "3"), "foo@example.com", 0, time.Now().Add(time.Hour))
+	l := reg.ForUser("foo@example.com")
+	if len(l) != 2 || l[0].MpinID == expired || l[1].MpinID == expired {
+		t.Errorf("identities = %+v", l)
+	}
+}
+
+func identitiesRequest(a *app, method string, form url.Values) (int, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	r := mustRequest("GET", "/protected/identities")
+	if method == "POST" {
+		r, _ = http.NewRequest("POST", "/protected/identities", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	s, _ := identitiesHandler(&context{App: a, SessionID: "345", LoggedUser: "foo@example.com"}, w, r)
+	return s, w
+}
+
+func TestIdentitiesHandler(t *testing.T) {
+	a := testApp()
+	a.Templates = loadTemplates("./templates")
+	a.Store.Put("345", session{User: "foo@example.com"})
+	mpinID := testSaltedMpinID("foo@example.com", "1")
+	a.Identities.Register(mpinID, "foo@example.com", 1, time.Now().Add(time.Hour))
+	other := testSaltedMpinID("bar@example.com", "2")
+	a.Identities.Register(other, "bar@example.com", 0, time.Now().Add(time.Hour))
+	var deleted []string
+	a.RPS.Fetch = func(url, method string, q, d interface{}) error {
+		deleted = append(deleted, method+" "+url)
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	if s, _ := identitiesHandler(&context{App: a}, w, mustRequest("GET", "/protected/identities")); s != 302 {
+		t.Errorf("anonymous: status = <%d> want <302>", s)
+	}
+	s, w := identitiesRequest(a, "GET", nil)
+	if s != 200 || !strings.Contains(w.Body.String(), mpinID) || strings.Contains(w.Body.String(), other) {
+		t.Fatalf("status = <%d> body = <%s>", s, w.Body.String())
+	}
+
+	token := formToken(&context{App: a, SessionID: "345"})
+	if s, _ := identitiesRequest(a, "POST", url.Values{"mpinId": {mpinID}, "action": {"revoke"}, "token": {"forged"}}); s != 403 || a.Identities.IsRevoked(mpinID) {
+		t.Errorf("forged token: status = <%d>", s)
+	}
+	if s, _ := identitiesRequest(a, "POST", url.Values{"mpinId": {mpinID}, "action": {"rename"}, "label": {"Work phone"}, "token": {token}}); s != 303 {
+		t.Errorf("rename: status = <%d> want <303>", s)
+	}
+	if s, _ := identitiesRequest(a, "POST", url.Values{"mpinId": {other}, "action": {"revoke"}, "token": {token}}); s != 404 || a.Identities.IsRevoked(other) {
+		t.Errorf("identity of another user: status = <%d> want <404>", s)
+	}
+	if s, _ := identitiesRequest(a, "POST", url.Values{"mpinId": {mpinID}, "action": {"revoke"}, "token": {token}}); s != 303 || !a.Identities.IsRevoked(mpinID) {
+		t.Fatalf("revoke: status = <%d>", s)
+	}
+	if len(deleted) != 1 || !strings.HasPrefix(deleted[0], "DELETE ") || !strings.HasSuffix(deleted[0], "/user/"+mpinID) {
+		t.Errorf("RPS requests = %v", deleted)
+	}
+	if _, w := identitiesRequest(a, "GET", nil); !strings.Contains(w.Body.String(), `value="Work phone"`) || !strings.Contains(w.Body.String(), "Revoked") {
+		t.Errorf("body = <%s>", w.Body.String())
+	}
+}
+
+// Revoking a lost device ends its sessions and tokens
+func TestRevokeIdentityEndsLogins(t *testing.T) {
+	a := testApp()
+	a.Tokens = testTokenIssuer(t)
+	a.RPS.Fetch = func(url, method string, q, d interface{}) error { return nil }
+	lost, kept := testSaltedMpinID("foo@example.com", "1"), testSaltedMpinID("foo@example.com", "2")
+	a.Identities.Register(lost, "foo@example.com", 1, time.Now().Add(time.Hour))
+	a.Store.Put("345", session{User: "foo@example.com", MpinID: kept})
+	a.Store.Put("678", session{User: "foo@example.com", MpinID: lost})
+	lostPair, _ := a.Tokens.Issue("678", "foo@example.com", lost, time.Now())
+	// Tokens outliving their session
+	otherPair, _ := a.Tokens.Issue("999", "foo@example.com", lost, time.Now())
+	keptPair, _ := a.Tokens.Issue("345", "foo@example.com", kept, time.Now())
+
+	if err := revokeIdentity(&context{App: a, SessionID: "345", LoggedUser: "foo@example.com"}, lost); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Store.Get("678"); err == nil {
+		t.Error("session of the revoked identity not ended")
+	}
+	if _, err := a.Store.Get("345"); err != nil {
+		t.Error("session of another identity ended")
+	}
+	for _, pair := range []tokenPair{lostPair, otherPair} {
+		if _, err := a.Tokens.Verify(pair.AccessToken); err != errTokenRevoked {
+			t.Errorf("err = <%v> want <%v>", err, errTokenRevoked)
+		}
+		if _, _, err := a.Tokens.Refresh(pair.RefreshToken); err == nil {
+			t.Error("refresh token of the revoked identity accepted")
+		}
+	}
+	if _, err := a.Tokens.Verify(keptPair.AccessToken); err != nil {
+		t.Errorf("err = <%v> for another identity", err)
+	}
+}
+
+func TestRevokedIdentityDenied(t *testing.T) {
+	a := testApp()
+	a.RPS.Fetch = func(url, method string, q, d interface{}) error { return nil }
+	mpinID := testSaltedMpinID("foo@example.com", "1")
+	a.Identities.Register(mpinID, "foo@example.com", 0, time.Now().Add(time.Hour))
+	a.Identities.Revoke("foo@example.com", mpinID)
+
+	c, w, r := prepare("GET", "/mpinPermitUser?mpin_id="+mpinID, nil)
+	c.App = a
+	if s, _ := permitUserHandler(c, w, r); s != 403 {
+		t.Errorf("time permit: status = <%d> want <403>", s)
+	}
+
+	c = &context{App: a, SessionID: "345", MpinID: mpinID}
+	a.Store.Put(c.SessionID, session{})
+	err := sendLoginResult(c, "foo@example.com", "ott", 200, "OK")
+	if e, ok := err.(*revokedError); !ok || e.Status != 410 {
+		t.Errorf("err = <%v> want 410", err)
+	}
+	if item, _ := a.Store.Get(c.SessionID); item.User != "" {
+		t.Errorf("session logged in with a revoked identity")
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+var errInvalidJWT = errors.New("Invalid token")
+
+// jwtClaims are the registered claims used by the tokens of the RPA
+type jwtClaims struct {
+	Issuer   string `json:"iss,omitempty"`
+	Subject  string `json:"sub,omitempty"`
+	Audience string `json:"aud,omitempty"`
+	Expires  int64  `json:"exp,omitempty"`
+	IssuedAt int64  `json:"iat,omitempty"`
+	ID       string `json:"jti,omitempty"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// jwk is a public key in JSON Web Key format
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// signingKey is a private key signing tokens with RS256 (RSA) or ES256
+// (ECDSA P-256). ID is the RFC 7638 thumbprint of the public key.
+type signingKey struct {
+	ID  string
+	Alg string
+	Key crypto.Signer
+}
+
+func newSigningKey(key crypto.Signer) (*signingKey, error) {
+	k := &signingKey{Key: key}
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA signing keys must have at least 2048 bits")
+		}
+		k.Alg = "RS256"
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("ECDSA signing keys must use the P-256 curve")
+		}
+		k.Alg = "ES256"
+	default:
+		return nil, fmt.Errorf("Unsupported signing key type %T", pub)
+	}
+	// The thumbprint hashes the required members in lexicographic order
+	j := k.JWK()
+	var thumb []byte
+	if j.Kty == "RSA" {
+		thumb, _ = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{j.E, j.Kty, j.N})
+	} else {
+		thumb, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{j.Crv, j.Kty, j.X, j.Y})
+	}
+	sum := sha256.Sum256(thumb)
+	k.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return k, nil
+}
+
+// JWK returns the public key of k
+func (k *signingKey) JWK() jwk {
+	j := jwk{Use: "sig", Alg: k.Alg, Kid: k.ID}
+	switch pub := k.Key.Public().(type) {
+	case *rsa.PublicKey:
+		j.Kty = "RSA"
+		j.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		j.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		j.Kty = "EC"
+		j.Crv = "P-256"
+		j.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32)))
+		j.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))
+	}
+	return j
+}
+
+func (k *signingKey) sign(data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	if k.Alg == "RS256" {
+		return k.Key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+	// JWS uses the fixed size R || S encoding instead of ASN.1
+	r, s, err := ecdsa.Sign(rand.Reader, k.Key.(*ecdsa.PrivateKey), sum[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig, nil
+}
+
+func (k *signingKey) verify(data, sig []byte) bool {
+	sum := sha256.Sum256(data)
+	switch pub := k.Key.Public().(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		return ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	return false
+}
+
+// parseSigningKey reads an RSA or EC private key from PEM data, in PKCS#1,
+// SEC 1 or PKCS#8 format
+func parseSigningKey(data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+	return newSigningKey(signer)
+}
+
+// jwtKeys signs tokens with the first key. All keys are published and
+// accepted, so a new key can be put first while tokens signed with the
+// previous one are still valid.
+type jwtKeys []*signingKey
+
+// loadJWTKeys reads the comma separated PEM key files. When paths is empty
+// an RSA key is generated, which does not survive restarts.
+func loadJWTKeys(paths string) (jwtKeys, error) {
+	var keys jwtKeys
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseSigningKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newSigningKey(rsaKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Sign returns the compact JWS of the claims
+func (keys jwtKeys) Sign(claims interface{}) (string, error) {
+	k := keys[0]
+	header, err := json.Marshal(jwtHeader{Alg: k.Alg, Typ: "JWT", Kid: k.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := k.sign([]byte(data))
+	if err != nil {
+		return "", err
+	}
+	return data + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks the signature of the token and decodes its claims. The
+// caller checks the claims themselves.
+func (keys jwtKeys) Verify(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errInvalidJWT
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errInvalidJWT
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(b, &header); err != nil {
+		return errInvalidJWT
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errInvalidJWT
+	}
+	for _, k := range keys {
+		if k.ID != header.Kid || k.Alg != header.Alg {
+			continue
+		}
+		if !k.verify([]byte(parts[0]+"."+parts[1]), sig) {
+			return errInvalidJWT
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return errInvalidJWT
+		}
+		if err := json.Unmarshal(payload, claims); err != nil {
+			return errInvalidJWT
+		}
+		return nil
+	}
+	return errInvalidJWT
+}
+
+// Algs returns the signing algorithms of the keys
+func (keys jwtKeys) Algs() (algs []string) {
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if !seen[k.Alg] {
+			seen[k.Alg] = true
+			algs = append(algs, k.Alg)
+		}
+	}
+	return
+}
+
+// JWKS returns the public keys as a JSON Web Key Set
+func (keys jwtKeys) JWKS() interface{} {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.JWK())
+	}
+	return set
+}
@@ -0,0 +1,123 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testECKey(t *testing.T) *signingKey {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := newSigningKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestJWTSignVerify(t *testing.T) {
+	rsaKeys, err := loadJWTKeys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey := testECKey(t)
+
+	for _, keys := range []jwtKeys{rsaKeys, {ecKey}} {
+		token, err := keys.Sign(&jwtClaims{Subject: "foo@example.com", Expires: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var claims jwtClaims
+		if err := keys.Verify(token, &claims); err != nil {
+			t.Fatalf("%v: %v", keys[0].Alg, err)
+		}
+		if claims.Subject != "foo@example.com" || claims.Expires != 1234 {
+			t.Errorf("%v: claims = %+v", keys[0].Alg, claims)
+		}
+
+		parts := strings.Split(token, ".")
+		forged, _ := (jwtKeys{testECKey(t)}).Sign(&jwtClaims{Subject: "admin"})
+		for _, bad := range []string{
+			parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2],
+			parts[0] + "." + parts[1],
+			forged,
+			"",
+		} {
+			if err := keys.Verify(bad, &claims); err != errInvalidJWT {
+				t.Errorf("%v: Verify(%q) = <%v> want <%v>", keys[0].Alg, bad, err, errInvalidJWT)
+			}
+		}
+	}
+
+	// Tokens of every published key are accepted
+	rotated := jwtKeys{ecKey, rsaKeys[0]}
+	token, _ := rsaKeys.Sign(&jwtClaims{Subject: "foo"})
+	var claims jwtClaims
+	if err := rotated.Verify(token, &claims); err != nil {
+		t.Error(err)
+	}
+	if algs := rotated.Algs(); len(algs) != 2 || algs[0] != "ES256" || algs[1] != "RS256" {
+		t.Errorf("Algs() = %v", algs)
+	}
+}
+
+func TestLoadJWTKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(ecKey)
+	ecPath := filepath.Join(dir, "ec.pem")
+	ioutil.WriteFile(ecPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ = x509.MarshalPKCS8PrivateKey(p384)
+	p384Path := filepath.Join(dir, "p384.pem")
+	ioutil.WriteFile(p384Path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	keys, err := loadJWTKeys(ecPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := keys[0].JWK()
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" || jwk.Alg != "ES256" || jwk.Kid != keys[0].ID || len(keys[0].ID) != 43 {
+		t.Errorf("JWK = %+v", jwk)
+	}
+	if _, err := loadJWTKeys(p384Path); err == nil {
+		t.Error("P-384 key accepted")
+	}
+	if _, err := loadJWTKeys(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("missing key file accepted")
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errLogoutToken = errors.New("Invalid or expired logout token")
+
+type logoutEntry struct {
+	SessionID string
+	Expires   time.Time
+}
+
+// logoutTokens issues the tokens sent to RPS as logoutData instead of the
+// session ID. A token is an opaque random ID with its expiry, signed with
+// Key, and can be used once to end the session it is mapped to.
+type logoutTokens struct {
+	Key []byte
+	TTL time.Duration
+
+	mu      sync.Mutex
+	tokens  map[string]logoutEntry
+	gcCount int
+}
+
+// newLogoutTokens uses key to sign tokens. When key is empty a random key
+// is generated, so tokens do not survive restarts.
+func newLogoutTokens(key string, ttl time.Duration) (*logoutTokens, error) {
+	t := &logoutTokens{Key: []byte(key), TTL: ttl, tokens: make(map[string]logoutEntry)}
+	if len(t.Key) == 0 {
+		t.Key = make([]byte, 32)
+		if _, err := rand.Read(t.Key); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *logoutTokens) sign(id string, expires int64) string {
+	mac := hmac.New(sha256.New, t.Key)
+	fmt.Fprintf(mac, "logout:%v:%v", id, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a new logout token for the session
+func (t *logoutTokens) Issue(sessionID string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	expires := time.Now().Add(t.TTL)
+
+	t.mu.Lock()
+	t.tokens[id] = logoutEntry{SessionID: sessionID, Expires: expires}
+	t.gcCount++
+	if t.gcCount >= 1000 {
+		now := time.Now()
+		for k, v := range t.tokens {
+			if v.Expires.Before(now) {
+				delete(t.tokens, k)
+			}
+		}
+		t.gcCount = 0
+	}
+	t.mu.Unlock()
+
+	return fmt.Sprintf("%v.%v.%v", id, expires.Unix(), t.sign(id, expires.Unix())), nil
+}
+
+// Lookup checks the token and returns the session it was issued for,
+// without using it up
+func (t *logoutTokens) Lookup(token string) (sessionID string, err error) {
+	return t.check(token, false)
+}
+
+// Use checks the token and returns the session it was issued for. The
+// token can not be used again.
+func (t *logoutTokens) Use(token string) (sessionID string, err error) {
+	return t.check(token, true)
+}
+
+func (t *logoutTokens) check(token string, use bool) (sessionID string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errLogoutToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errLogoutToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(t.sign(parts[0], expires))) {
+		return "", errLogoutToken
+	}
+	if time.Now().Unix() > expires {
+		return "", errLogoutToken
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.tokens[parts[0]]
+	if !ok {
+		return "", errLogoutToken
+	}
+	if use {
+		delete(t.tokens, parts[0])
+	}
+	return e.SessionID, nil
+}
+
+// logoutToken returns the logout token of the request, issuing it for the
+// session on first use
+func logoutToken(c *context) string {
+	if c.LogoutToken == "" && c.App.Logout != nil && c.SessionID != "" {
+		token, err := c.App.Logout.Issue(c.SessionID)
+		if err != nil {
+			log.Printf("E %v %v Failed to issue logout token: %v", c.SessionID, c.UserID, err)
+			return ""
+		}
+		c.LogoutToken = token
+	}
+	return c.LogoutToken
+}
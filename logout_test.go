@@ -0,0 +1,100 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogoutTokens(t *testing.T) {
+	tokens, _ := newLogoutTokens("key", time.Minute)
+	token, err := tokens.Issue("session:345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token, "session:345") {
+		t.Errorf("token <%s> contains the session ID", token)
+	}
+
+	parts := strings.Split(token, ".")
+	tampered := fmt.Sprintf("%v.%v.%v", parts[0], "9999999999", parts[2])
+	if _, err := tokens.Use(tampered); err != errLogoutToken {
+		t.Errorf("err = <%v> want <%v> for a tampered token", err, errLogoutToken)
+	}
+	other, _ := newLogoutTokens("other key", time.Minute)
+	if _, err := other.Use(token); err != errLogoutToken {
+		t.Errorf("err = <%v> want <%v> for another key", err, errLogoutToken)
+	}
+
+	if sessionID, err := tokens.Lookup(token); err != nil || sessionID != "session:345" {
+		t.Fatalf("session = <%s> err = <%v> want <%s>", sessionID, err, "session:345")
+	}
+	if sessionID, err := tokens.Use(token); err != nil || sessionID != "session:345" {
+		t.Fatalf("session = <%s> err = <%v> want <%s>", sessionID, err, "session:345")
+	}
+	if _, err := tokens.Use(token); err != errLogoutToken {
+		t.Errorf("err = <%v> want <%v> on reuse", err, errLogoutToken)
+	}
+}
+
+func TestLogoutTokensExpired(t *testing.T) {
+	tokens, _ := newLogoutTokens("key", -time.Minute)
+	token, _ := tokens.Issue("345")
+	if _, err := tokens.Use(token); err != errLogoutToken {
+		t.Errorf("err = <%v> want <%v>", err, errLogoutToken)
+	}
+}
+
+func TestLogoutHandlerToken(t *testing.T) {
+	a := testApp()
+	a.Store.Put("345", session{User: "user01"})
+	token, _ := a.Logout.Issue("345")
+
+	// Another user can not use up the token
+	c, w, r := prepare("POST", "/logout", bytes.NewBufferString(fmt.Sprintf(`{"sessionToken": %q, "userId": "user02"}`, token)))
+	c.App = a
+	if s, _ := logoutHandler(c, w, r); s != 400 {
+		t.Fatalf("status = <%d> want <400> for another user", s)
+	}
+
+	body := fmt.Sprintf(`{"sessionToken": %q, "userId": "user01"}`, token)
+	c, w, r = prepare("POST", "/logout", bytes.NewBufferString(body))
+	c.App = a
+	if s, err := logoutHandler(c, w, r); s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v> want <200> <nil>", s, err)
+	}
+	if _, err := a.Store.Get("345"); err == nil {
+		t.Error("session not deleted")
+	}
+
+	// The raw session ID is not accepted
+	a.Store.Put("678", session{User: "user01"})
+	c, w, r = prepare("POST", "/logout", bytes.NewBufferString(`{"sessionToken": "678", "userId": "user01"}`))
+	c.App = a
+	if s, _ := logoutHandler(c, w, r); s != 400 {
+		t.Fatalf("status = <%d> want <400>", s)
+	}
+	if _, err := a.Store.Get("678"); err != nil {
+		t.Error("session deleted with the raw session ID")
+	}
+}
@@ -135,3 +135,24 @@ func sendEMpinActivationMail(userID, deviceName string, activationCode int, o *o
 
 	return sendMail(userID, body, o)
 }
+
+// sendNotificationMail sends a plain text mail to one user
+func sendNotificationMail(userID, subject, text string, o *options) (err error) {
+
+	body := bytes.NewBuffer(nil)
+
+	var writeBodyFmt = func(format string, vars ...interface{}) {
+		body.WriteString(fmt.Sprintf(format+"\r\n", vars...))
+	}
+
+	writeBodyFmt("From: %v", o.EmailSender)
+	writeBodyFmt("To: %v", userID)
+	writeBodyFmt("Subject: %v", subject)
+	writeBodyFmt("")
+	writeBodyFmt("%v", text)
+	writeBodyFmt("")
+	writeBodyFmt("Regards,")
+	writeBodyFmt("The Milagro MFA Team")
+
+	return sendMail(userID, body, o)
+}
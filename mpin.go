@@ -19,6 +19,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -26,6 +27,7 @@ import (
 	"./ldap"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -39,6 +41,8 @@ type verifyUserRequest struct {
 	ActivateKey string `json:"activateKey"`
 	ActivationCode int   `json:"activationCode"`
 	Mobile      int    `json:"mobile"`
+	// Resend is set for a request to send the activation mail again
+	Resend      bool   `json:"-"`
 }
 
 type verifyUserResponse struct {
@@ -48,45 +52,28 @@ type verifyUserResponse struct {
 func verifyUser(c *context, r *http.Request, rq *verifyUserRequest) (status int, err error) {
 
 	var baseURL string
-	if c.App.Options.VerifyIdentityURL[0] == '/' && len(r.Header["RPS-BASE-URL"]) > 0 {
+	if rpsBaseURL := r.Header.Get("RPS-BASE-URL"); c.App.Options.VerifyIdentityURL[0] == '/' && rpsBaseURL != "" {
 		baseURL = fmt.Sprintf(
-			"%v/%v", strings.TrimRight(r.Header["RPS-BASE-URL"][0], "/"),
+			"%v/%v", strings.TrimRight(rpsBaseURL, "/"),
 			strings.TrimLeft(c.App.Options.VerifyIdentityURL, "/"))
 	} else {
 		baseURL = c.App.Options.VerifyIdentityURL
 	}
 
-	if c.App.Options.ForceActivate {
+	// Registrations without a valid expiry are kept until activated
+	expires, _ := time.Parse(time.RFC3339, rq.ExpireTime)
+	if forceActivate(c) {
 		log.Println("D forceActivate option set! User activated without verification!")
+		c.App.Identities.Register(rq.MpinID, rq.UserID, rq.Mobile, expires)
+		c.App.Identities.Activated(rq.MpinID)
 	} else {
 		if c.App.Options.LDAPVerify {
-			var ldapconnection *ldap.Conn
-			addr := fmt.Sprintf("%s:%d", c.App.Options.LDAPServer, c.App.Options.LDAPPort)
-			if !c.App.Options.LDAPUseTLS {
-				ldapconnection, err = ldap.Dial("tcp", addr)
-				if err != nil {
-					log.Printf("E %v %v Remote LDAP connection failed: %v", c.SessionID, rq.UserID, err)
-					return 500, err
-				}
-			} else {
-				tlsConfig := c.App.tlsConfig
-				tlsConfig.ServerName = c.App.Options.LDAPServer
-				ldapconnection, err = ldap.DialTLS("tcp", addr, c.App.tlsConfig)
-				if err != nil {
-					log.Printf("E %v %v Remote LDAP connection failed: %v", c.SessionID, rq.UserID, err)
-					return 500, err
-				}
+			ldapconnection, err := dialLDAP(c, rq.UserID)
+			if err != nil {
+				return 500, err
 			}
 			defer ldapconnection.Close()
 
-			if c.App.Options.LDAPBindDN != "" && c.App.Options.LDAPBindPWD != "" {
-				err = ldapconnection.Bind(c.App.Options.LDAPBindDN, c.App.Options.LDAPBindPWD)
-				if err != nil {
-					log.Printf("E %v %v Bind failed: %v", c.SessionID, rq.UserID, err)
-					return 500, err
-				}
-			}
-
 			ldapFilter := fmt.Sprintf(c.App.Options.LDAPFilter, ldap.EscapeFilter(rq.UserID))
 			searchRequest := ldap.NewSearchRequest(c.App.Options.LDAPBaseDN, ldap.ScopeWholeSubtree, 
 				ldap.NeverDerefAliases, 
@@ -108,35 +95,98 @@ func verifyUser(c *context, r *http.Request, rq *verifyUserRequest) (status int,
 				}
 			}
 		}
+		c.App.Identities.Register(rq.MpinID, rq.UserID, rq.Mobile, expires)
+
+		if c.App.Approvals != nil {
+			reg := registration{
+				UserID:         rq.UserID,
+				MpinID:         rq.MpinID,
+				DeviceName:     "PC",
+				ActivateKey:    rq.ActivateKey,
+				ActivationCode: rq.ActivationCode,
+				Requested:      time.Now(),
+			}
+			if rq.Mobile != 0 {
+				reg.DeviceName = "Mobile"
+			}
+			if reg.Expires, err = time.Parse(time.RFC3339, rq.ExpireTime); err != nil {
+				log.Printf("E %v %v Invalid expireTime %v: %v", c.SessionID, rq.UserID, rq.ExpireTime, err)
+				return 400, err
+			}
+			queueRegistration(c, reg, approvalPageURL(baseURL))
+			return 200, nil
+		}
 
-		validateURL := ""
-		activationCode := 0
-
-		if(rq.ActivateKey != "") {
-			validateURL = fmt.Sprintf("%v?i=%v&e=%v&s=%v", baseURL, rq.MpinID, rq.ExpireTime, rq.ActivateKey)
-			log.Printf("D Sending activation email for user %v: %v {%v}", rq.UserID, activationCode, c.SessionID)
-			var deviceName string
+		m := activationMail{UserID: rq.UserID, MpinID: rq.MpinID, ActivationCode: rq.ActivationCode}
+		// Registrations without a valid expiry can not be sent again
+		m.Expires, _ = time.Parse(time.RFC3339, rq.ExpireTime)
+		if rq.ActivateKey != "" {
+			m.ValidateURL = fmt.Sprintf("%v?i=%v&e=%v&s=%v&h=%v", baseURL, rq.MpinID, rq.ExpireTime, rq.ActivateKey,
+				c.App.Activation.Sign(rq.MpinID, rq.ExpireTime, rq.ActivateKey))
 			if rq.Mobile == 0 {
-				deviceName = "PC"
+				m.DeviceName = "PC"
 			} else {
-				deviceName = "Mobile"
-			}
-			if err := c.App.Mail(rq.UserID, deviceName, validateURL, c.App.Options); err != nil {
-				log.Printf("W %v %v Failed to send mail", c.SessionID, rq.UserID)
+				m.DeviceName = "Mobile"
 			}
+		}
+		mailActivation(c, m)
+		if sends := c.App.ActivationMails.Record(m); rq.Resend {
+			log.Printf("I %v %v Activation mail sent again, send %d", c.SessionID, rq.UserID, sends)
+		}
+	}
+	return 200, nil
+}
 
+// mailActivation sends the activation link or code of the identity
+func mailActivation(c *context, m activationMail) {
+	if m.ValidateURL != "" {
+		log.Printf("D Sending activation email for user %v: %v {%v}", m.UserID, m.MpinID, c.SessionID)
+		if err := c.App.Mail(m.UserID, m.DeviceName, m.ValidateURL, c.App.Options); err != nil {
+			log.Printf("W %v %v Failed to send mail", c.SessionID, m.UserID)
 		}
-		if(rq.ActivationCode != 0) {
-			activationCode = rq.ActivationCode
-				log.Printf("D Sending activation email for user %v: %v {%v}", rq.UserID, activationCode, c.SessionID)
-			deviceName := "PC"
+	}
+	if m.ActivationCode != 0 {
+		log.Printf("D Sending activation email for user %v: %v {%v}", m.UserID, m.ActivationCode, c.SessionID)
+		deviceName := "PC"
 
-			if err := sendEMpinActivationMail(rq.UserID, deviceName, activationCode, c.App.Options); err != nil {
-				log.Printf("W %v %v Failed to send mail: %v", c.SessionID, rq.UserID, err)
-			}
+		if err := sendEMpinActivationMail(m.UserID, deviceName, m.ActivationCode, c.App.Options); err != nil {
+			log.Printf("W %v %v Failed to send mail: %v", c.SessionID, m.UserID, err)
 		}
 	}
-	return 200, nil
+}
+
+// dialLDAP connects to the LDAP server and binds with the configured
+// credentials, if any
+func dialLDAP(c *context, userID string) (ldapconnection *ldap.Conn, err error) {
+	addr := fmt.Sprintf("%s:%d", c.App.Options.LDAPServer, c.App.Options.LDAPPort)
+	if !c.App.Options.LDAPUseTLS {
+		ldapconnection, err = ldap.Dial("tcp", addr)
+		if err != nil {
+			log.Printf("E %v %v Remote LDAP connection failed: %v", c.SessionID, userID, err)
+			return nil, err
+		}
+	} else {
+		// The CA config is shared with the RPS client, so it is not modified
+		tlsConfig := &tls.Config{ServerName: c.App.Options.LDAPServer}
+		if c.App.tlsConfig != nil {
+			tlsConfig.RootCAs = c.App.tlsConfig.RootCAs
+		}
+		ldapconnection, err = ldap.DialTLS("tcp", addr, tlsConfig)
+		if err != nil {
+			log.Printf("E %v %v Remote LDAP connection failed: %v", c.SessionID, userID, err)
+			return nil, err
+		}
+	}
+
+	if c.App.Options.LDAPBindDN != "" && c.App.Options.LDAPBindPWD != "" {
+		err = ldapconnection.Bind(c.App.Options.LDAPBindDN, c.App.Options.LDAPBindPWD)
+		if err != nil {
+			log.Printf("E %v %v Bind failed: %v", c.SessionID, userID, err)
+			ldapconnection.Close()
+			return nil, err
+		}
+	}
+	return ldapconnection, nil
 }
 
 // Authenticate to RPA
@@ -148,14 +198,23 @@ type authRPARequest struct {
 }
 
 type authOTPResponse struct {
-	ExpireTime int64 `json:"expireTime"`
-	TTLSeconds int64 `json:"ttlSeconds"`
-	NowTime    int64 `json:"nowTime"`
+	OTP        string `json:"otp"`
+	ExpireTime int64  `json:"expireTime"`
+	TTLSeconds int64  `json:"ttlSeconds"`
+	NowTime    int64  `json:"nowTime"`
 }
 
 type authRPAResponse struct {
-	SomeUserData string `json:"someUserData"`
-	UserId string `json:"userId"`
+	SomeUserData string `json:"someUserData,omitempty"`
+	UserId       string `json:"userId"`
+	// Set with -jwt-tokens
+	AccessToken  string `json:"accessToken,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	TokenType    string `json:"tokenType,omitempty"`
+	ExpiresIn    int64  `json:"expiresIn,omitempty"`
+	// The LDAP password is needed on /login/password before the session
+	// is logged in
+	PasswordRequired bool `json:"passwordRequired,omitempty"`
 }
 
 // Authenticate to RPS
@@ -171,18 +230,16 @@ type authRPSResponse struct {
 	Status  int    `json:"status"`
 	UserID  string `json:"userId"`
 	Message string `json:"message"`
+	MpinID  string `json:"mpinId"`
+	// Sent when RPS has the requestOTP option set
+	OTP        string `json:"otp"`
+	TTLSeconds int64  `json:"ttlSeconds"`
 }
 
 func authenticateToRPS(c *context, authOTT string) (userID, message string, status int) {
 
-	url := fmt.Sprintf("%v://%v/authenticate", c.App.Options.RPSSchema, c.App.Options.RPSHost)
-	var req authRPSRequest
-	req.AuthOTT = authOTT
-	req.LogoutData.SessionToken = c.SessionID
-
-	var resp authRPSResponse
-
-	if err := c.App.Fetch(c.App, url, "POST", &req, &resp); err != nil {
+	resp, err := c.App.RPS.Authenticate(authOTT, c.SessionID, logoutToken(c))
+	if err != nil {
 		log.Printf("E %v %v %v", c.SessionID, "", err)
 		log.Printf("E %v %v Invalid data from RPS", c.SessionID, "")
 		status = resp.Status
@@ -193,6 +250,9 @@ func authenticateToRPS(c *context, authOTT string) (userID, message string, stat
 	message = resp.Message
 	userID = resp.UserID
 	c.UserID = resp.UserID
+	c.MpinID = resp.MpinID
+	c.OTP = resp.OTP
+	c.OTPTTL = time.Duration(resp.TTLSeconds) * time.Second
 	return
 }
 
@@ -204,6 +264,7 @@ type sendLoginResultReq struct {
 		SessionToken string `json:"sessionToken"`
 		UserID       string `json:"userId"`
 	} `json:"logoutData"`
+	LogoutURL string `json:"logoutURL,omitempty"`
 }
 
 // Activate
@@ -218,6 +279,7 @@ type signature struct {
 	Activated    bool
 	DeviceName   string
 	ActivateKey  string
+	Expires      time.Time
 }
 
 func verifySignature(c *context, r *http.Request) (s signature, err error) {
@@ -227,9 +289,14 @@ func verifySignature(c *context, r *http.Request) (s signature, err error) {
 		return s, err
 	}
 
-	s.Identity = getArgument(r, "i", "")[0]
-	expires := getArgument(r, "e", "")[0]
-	s.ActivateKey = getArgument(r, "s", "")[0]
+	return verifyActivation(c, getArgument(r, "i", "")[0], getArgument(r, "e", "")[0], getArgument(r, "s", "")[0], getArgument(r, "h", "")[0])
+}
+
+// verifyActivation decodes the identity of an activation link and checks
+// its signature h, that it has not expired and that it was not used
+func verifyActivation(c *context, identity, expires, activateKey, h string) (s signature, err error) {
+	s.Identity = identity
+	s.ActivateKey = activateKey
 	log.Printf("D /mpinActivate request for identity: %v {%v}", s.Identity, c.SessionID)
 
 	b, err := hex.DecodeString(s.Identity)
@@ -255,14 +322,23 @@ func verifySignature(c *context, r *http.Request) (s signature, err error) {
 		return s, err
 	}
 	if len(data.UserID) > 0 && err == nil {
+		var exp time.Time
+		exp, err = c.App.Activation.Check(identity, expires, activateKey, h)
+		if err == errActivationLink {
+			// The identity is not trusted without the signature
+			log.Printf("W %v %v /mpinActivate: Invalid link signature", c.SessionID, data.UserID)
+			s.ErrorMessage = err.Error()
+			return s, err
+		}
 		s.UserID = data.UserID
 		s.Issued = data.Issued
+		s.Expires = exp
 
 		s.HumanIssued = t.Format(time.RFC822Z)
 
-		if expires < time.Now().UTC().Format(time.RFC3339) {
+		if err != nil {
 			s.IsValid = false
-			s.ErrorMessage = "Link expired"
+			s.ErrorMessage = err.Error()
 		} else {
 			s.IsValid = true
 			s.ErrorMessage = ""
@@ -281,7 +357,7 @@ func verifySignature(c *context, r *http.Request) (s signature, err error) {
 		s.Issued = ""
 	}
 	log.Printf("D siganture is %+v {%v}", s, c.SessionID)
-	if !s.IsValid {
+	if !s.IsValid && err == nil {
 		err = errors.New(s.ErrorMessage)
 	}
 	return
@@ -290,13 +366,8 @@ func verifySignature(c *context, r *http.Request) (s signature, err error) {
 
 func activateUserRPS(c *context, identity, activateKey string) (err error) {
 
-	url := fmt.Sprintf("%v://%v/user/%v", c.App.Options.RPSSchema, c.App.Options.RPSHost, identity)
-	var q struct {
-		ActivateKey string `json:"activateKey"`
-	}
-	q.ActivateKey = activateKey
-	if err = c.App.Fetch(c.App, url, "POST", &q, nil); err != nil {
-		log.Printf("E %v %v URL: %v: Error: %v", c.SessionID, "", url, err)
+	if err = c.App.RPS.ActivateUser(identity, activateKey); err != nil {
+		log.Printf("E %v %v URL: %v: Error: %v", c.SessionID, "", c.App.RPS.URL("/user/"+identity), err)
 	}
 	return
 }
@@ -307,41 +378,79 @@ func sendLoginResult(c *context, userID string, authOTT string, status int, mess
 		return
 	}
 
-	// The Revocation check based on userId or mpinId can be performed here
-	// The new status can be
-	// 200 - Login successful
-	// 401 - Invalid PIN
+	// The revocation and access policies can turn the successful login into
 	// 403 - User not authorized. Login denied without deleting the client's token.
-	// 408 - The authentication has been expired.
 	// 410 - Login denied permanently. Will delete the client's token.
-
-	// Example:
-
-	// if strings.HasSuffix(resp.userId, "@certivox.com") || strings.HasSuffix(resp.userId, "@miracl.com") {
-	//  status = 403
-	// }
+	if c.App.Identities.IsRevoked(c.MpinID) {
+		log.Printf("W %v %v Login with revoked identity %v", c.SessionID, userID, c.MpinID)
+		status, message = 410, "Identity revoked"
+		err = &revokedError{Status: status, Message: message}
+		c.App.Webhooks.Fire(webhookLoginDenied, userID, map[string]string{"status": strconv.Itoa(status), "message": message})
+	} else if !checkAccessPolicy(c, newPolicyRequest(policyPhaseAuthenticate, userID, c.MpinID, c.ClientIP)) {
+		status, message = 403, "Access denied by policy"
+		err = &revokedError{Status: status, Message: message}
+		c.App.Webhooks.Fire(webhookLoginDenied, userID, map[string]string{"status": strconv.Itoa(status), "message": message})
+	} else if newStatus, newMessage := checkRevocation(c, userID); newStatus != 200 {
+		status, message = newStatus, newMessage
+		err = &revokedError{Status: status, Message: message}
+		c.App.Webhooks.Fire(webhookLoginDenied, userID, map[string]string{"status": strconv.Itoa(status), "message": message})
+	}
 
 	// If the RPS waitLoginResult option is set, /loginResult request must be made
 	// It can contain logoutData and logoutURL for mobile Logout functionality
 
-	url := fmt.Sprintf("%v://%v/loginResult", c.App.Options.RPSSchema, c.App.Options.RPSHost)
 	var req sendLoginResultReq
 	req.AuthOTT = authOTT
 	req.Status = status
 	req.Message = message
-	req.LogoutData.SessionToken = c.SessionID
+	// The mobile app posts logoutData to logoutURL to end the session
+	req.LogoutData.SessionToken = logoutToken(c)
 	req.LogoutData.UserID = userID
+	req.LogoutURL = c.App.Options.LogoutURL
 
-	c.App.Fetch(c.App, url, "POST", &req, nil)
+	if rpsErr := c.App.RPS.LoginResult(c.SessionID, &req); rpsErr != nil {
+		log.Printf("E %v %v /loginResult failed: %v", c.SessionID, userID, rpsErr)
+	}
 
 	if status == 200 {
+		c.App.Identities.LoggedIn(c.MpinID)
+		// Identities activated with the code are first seen at login
+		c.App.ActivationMails.Remove(c.MpinID)
+		c.PasswordPending = c.App.Password.Required(c, userID)
 
 		if len(c.SessionID) > 0 {
-			var item session
-			item.User = userID
-			log.Printf("D Authenticated user %v {%v}", item.User, c.SessionID)
+			// Keep the URL to resume, set before the login
+			item, _ := c.App.Store.Get(c.SessionID)
+			item.Expires = time.Time{}
+			item.MpinID = c.MpinID
+			if c.PasswordPending {
+				// The session is logged in after the LDAP password
+				item.User = ""
+				item.Pending = pendingLogin{UserID: userID, Started: time.Now(), OTP: c.OTP, OTPTTL: c.OTPTTL}
+				log.Printf("D User %v needs the LDAP password {%v}", userID, c.SessionID)
+			} else {
+				item.User = userID
+				item.AuthTime = time.Now()
+				log.Printf("D Authenticated user %v {%v}", item.User, c.SessionID)
+			}
 			c.App.Store.Put(c.SessionID, item)
 		}
+		if !c.PasswordPending {
+			c.App.Webhooks.Fire(webhookLogin, userID, nil)
+		}
 	}
 	return
 }
+
+// denyLoginResult reports to RPS that the RPA refused a login RPS accepted,
+// for example because the account is locked
+func denyLoginResult(c *context, userID string, authOTT string, status int, message string) {
+	var req sendLoginResultReq
+	req.AuthOTT = authOTT
+	req.Status = status
+	req.Message = message
+	if err := c.App.RPS.LoginResult(c.SessionID, &req); err != nil {
+		log.Printf("E %v %v /loginResult failed: %v", c.SessionID, userID, err)
+	}
+	c.App.Webhooks.Fire(webhookLoginDenied, userID, map[string]string{"status": strconv.Itoa(status), "message": message})
+}
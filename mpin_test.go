@@ -19,14 +19,19 @@
 package main
 
 import (
+	"./rpstest"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"testing"
+	"time"
 )
 
 // type identity struct {
@@ -35,12 +40,13 @@ import (
 //     Mobile int    `json:"mobile"`
 //  }
 
-func encodeIdentity(identity string, expires string, activateKey string) string {
+func encodeIdentity(identity string, expires string, activateKey string, h string) string {
 
 	data := url.Values{}
 	data.Set("i", identity)
 	data.Set("e", expires)
 	data.Set("s", activateKey)
+	data.Set("h", h)
 
 	return data.Encode()
 }
@@ -52,7 +58,7 @@ func testVerifySignature(t *testing.T, i string, expires, activateKey string, ex
 	c := context{App: testApp()}
 	c.SessionID = session
 
-	body := encodeIdentity(i, expires, activateKey)
+	body := encodeIdentity(i, expires, activateKey, c.App.Activation.Sign(i, expires, activateKey))
 	t.Logf("Encoded identity %v", body)
 
 	//r, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
@@ -91,6 +97,7 @@ var testSignatureData = []signatureTest{
 			HumanIssued: "01 Jan 00 00:00 +0000",
 			DeviceName:  "PC",
 			ActivateKey: "dsfdsfasfdsf",
+			Expires:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
 			IsValid:     true,
 		},
 		valid: true,
@@ -108,6 +115,7 @@ var testSignatureData = []signatureTest{
 			HumanIssued: "01 Jan 00 00:00 +0000",
 			DeviceName:  "Mobile",
 			ActivateKey: "dsfdsfasfdsf",
+			Expires:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
 			IsValid:     true,
 		},
 		valid: true,
@@ -212,7 +220,7 @@ func testAuthenticateToRPS(t *testing.T, authOTT, user, message, session string,
 			t.Fatalf("Wrong request struct %+v", q)
 		}
 
-		if rq.AuthOTT != authOTT || rq.LogoutData.SessionToken != session {
+		if sessionID, err := a.Logout.Use(rq.LogoutData.SessionToken); rq.AuthOTT != authOTT || err != nil || sessionID != session {
 			t.Fatalf("RPS request data wrong, %+v", rq)
 		}
 		response := fmt.Sprintf(`{"userId": "%v", "status": %v, "message": "%v"}`, user, status, message)
@@ -268,7 +276,7 @@ func testSendLoginResult(t *testing.T, userID, authOTT, message, session string,
 			t.Fatalf("Wrong request struct %+v", q)
 		}
 		if rq.AuthOTT != authOTT ||
-			rq.LogoutData.SessionToken != session ||
+			rq.LogoutData.SessionToken != c.LogoutToken ||
 			rq.Message != message ||
 			rq.Status != status ||
 			rq.LogoutData.UserID != userID {
@@ -374,3 +382,110 @@ func TestActivateUser(t *testing.T) {
 	}
 
 }
+
+// Against the fake RPS
+
+func TestAuthenticateToRPSFake(t *testing.T) {
+	fake := rpstest.NewServer()
+	defer fake.Close()
+	c := context{App: testAppForRPS(fake.Host()), SessionID: "345"}
+
+	for _, status := range []int{200, 401, 403, 408, 410} {
+		fake.Script("/authenticate", rpstest.Auth(status, "foo"))
+		u, _, s := authenticateToRPS(&c, "123")
+		if s != status || u != "foo" {
+			t.Errorf("user = <%s> status = <%d> want <%s> <%d>", u, s, "foo", status)
+		}
+	}
+
+	fake.Script("/authenticate", rpstest.Response{Status: 200, Body: rpstest.Raw("{not json")})
+	if _, m, _ := authenticateToRPS(&c, "123"); m != "Server error" {
+		t.Errorf("message = <%s> want <%s>", m, "Server error")
+	}
+
+	r, ok := fake.Last("/authenticate")
+	if !ok {
+		t.Fatal("/authenticate not called")
+	}
+	var rq authRPSRequest
+	if err := r.JSON(&rq); err != nil || rq.AuthOTT != "123" || rq.LogoutData.SessionToken == "345" {
+		t.Errorf("request = <%s> err = <%v>", r.Body, err)
+	}
+	if sessionID, err := c.App.Logout.Use(rq.LogoutData.SessionToken); err != nil || sessionID != "345" {
+		t.Errorf("logout token for <%s> err = <%v> want <%s>", sessionID, err, "345")
+	}
+}
+
+func TestAuthenticateToRPSFakeOTP(t *testing.T) {
+	fake := rpstest.NewServer()
+	defer fake.Close()
+	c := context{App: testAppForRPS(fake.Host()), SessionID: "345"}
+
+	fake.Script("/authenticate", rpstest.AuthOTP(200, "foo", "123456", 90))
+	if _, _, s := authenticateToRPS(&c, "123"); s != 200 {
+		t.Fatalf("status = <%d> want <%d>", s, 200)
+	}
+	if c.OTP != "123456" || c.OTPTTL != 90*time.Second {
+		t.Errorf("otp = <%s> ttl = <%v> want <%s> <%v>", c.OTP, c.OTPTTL, "123456", 90*time.Second)
+	}
+}
+
+func TestSendLoginResultFake(t *testing.T) {
+	fake := rpstest.NewServer()
+	defer fake.Close()
+	c := context{App: testAppForRPS(fake.Host()), SessionID: "345"}
+
+	if err := sendLoginResult(&c, "foo", "123", 200, "OK"); err != nil {
+		t.Fatal(err)
+	}
+	r, ok := fake.Last("/loginResult")
+	if !ok {
+		t.Fatal("/loginResult not called")
+	}
+	var rq sendLoginResultReq
+	if err := r.JSON(&rq); err != nil || rq.AuthOTT != "123" || rq.Status != 200 || rq.LogoutData.UserID != "foo" {
+		t.Errorf("request = <%s> err = <%v>", r.Body, err)
+	}
+}
+
+func TestActivateUserFake(t *testing.T) {
+	fake := rpstest.NewServer()
+	defer fake.Close()
+	c := context{App: testAppForRPS(fake.Host()), SessionID: "345"}
+
+	if err := activateUserRPS(&c, "abcd", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.Activated("abcd") {
+		t.Error("identity not activated")
+	}
+	if err := activateUserRPS(&c, "ef01", ""); err == nil {
+		t.Error("error expected for missing activateKey")
+	}
+}
+
+// LDAPS dials leave the CA config of the RPS client alone
+func TestDialLDAPTLSConfig(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	a := testApp()
+	opts := *a.Options
+	opts.LDAPUseTLS = true
+	opts.LDAPServer = "127.0.0.1"
+	opts.LDAPPort = port
+	a.Options = &opts
+	for _, cfg := range []*tls.Config{nil, {RootCAs: x509.NewCertPool()}} {
+		a.tlsConfig = cfg
+		if _, err := dialLDAP(&context{App: a}, "foo"); err == nil {
+			t.Error("error expected")
+		}
+		if cfg != nil && cfg.ServerName != "" {
+			t.Errorf("shared ServerName = <%v> want <>", cfg.ServerName)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcClient is a relying party registered in the -oidc-clients file. A
+// client without secret is public and must use PKCE.
+type oidcClient struct {
+	ID           string   `json:"client_id"`
+	Secret       string   `json:"client_secret,omitempty"`
+	Name         string   `json:"client_name,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// RedirectURI returns the registered redirect URI matching uri exactly. An
+// empty uri selects the only registered one.
+func (cl *oidcClient) RedirectURI(uri string) (string, bool) {
+	if uri == "" && len(cl.RedirectURIs) == 1 {
+		return cl.RedirectURIs[0], true
+	}
+	for _, u := range cl.RedirectURIs {
+		if u == uri {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+type oidcCode struct {
+	ClientID    string
+	RedirectURI string
+	UserID      string
+	Scope       string
+	Nonce       string
+	Challenge   string
+	AuthTime    time.Time
+	Expires     time.Time
+
+	// RedirectURIGiven is set when the authorization request had a
+	// redirect_uri, which the token request must then repeat
+	RedirectURIGiven bool
+}
+
+type oidcAccessToken struct {
+	ClientID string
+	UserID   string
+	Scope    string
+	Expires  time.Time
+}
+
+// oidcProvider issues authorization codes, access tokens and ID tokens to
+// the registered clients for the users logged in with the PIN pad
+type oidcProvider struct {
+	Issuer   string
+	Clients  map[string]*oidcClient
+	Keys     jwtKeys
+	CodeTTL  time.Duration
+	TokenTTL time.Duration
+
+	mu      sync.Mutex
+	codes   map[string]oidcCode
+	tokens  map[string]oidcAccessToken
+	gcCount int
+}
+
+// newOIDCProvider returns nil when no issuer is configured
+func newOIDCProvider(o *options) (*oidcProvider, error) {
+	if o.OIDCIssuer == "" {
+		return nil, nil
+	}
+	p := &oidcProvider{
+		Issuer:   strings.TrimSuffix(o.OIDCIssuer, "/"),
+		Clients:  make(map[string]*oidcClient),
+		CodeTTL:  o.OIDCCodeTTL,
+		TokenTTL: o.OIDCTokenTTL,
+		codes:    make(map[string]oidcCode),
+		tokens:   make(map[string]oidcAccessToken),
+	}
+	if o.OIDCClients != "" {
+		data, err := ioutil.ReadFile(o.OIDCClients)
+		if err != nil {
+			return nil, err
+		}
+		var clients []*oidcClient
+		if err := json.Unmarshal(data, &clients); err != nil {
+			return nil, fmt.Errorf("Invalid OIDC clients %v: %v", o.OIDCClients, err)
+		}
+		for _, cl := range clients {
+			if cl.ID == "" || len(cl.RedirectURIs) == 0 {
+				return nil, fmt.Errorf("OIDC client %q needs client_id and redirect_uris", cl.ID)
+			}
+			p.Clients[cl.ID] = cl
+		}
+	}
+	keys, err := loadJWTKeys(o.OIDCKeys)
+	if err != nil {
+		return nil, err
+	}
+	if o.OIDCKeys == "" {
+		log.Printf("W No OIDC signing key configured, ID tokens are signed with a generated key")
+	}
+	p.Keys = keys
+	return p, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// gc drops expired codes and tokens every 1000 calls. The caller holds the
+// lock.
+func (p *oidcProvider) gc() {
+	p.gcCount++
+	if p.gcCount < 1000 {
+		return
+	}
+	now := time.Now()
+	for k, v := range p.codes {
+		if v.Expires.Before(now) {
+			delete(p.codes, k)
+		}
+	}
+	for k, v := range p.tokens {
+		if v.Expires.Before(now) {
+			delete(p.tokens, k)
+		}
+	}
+	p.gcCount = 0
+}
+
+// IssueCode returns a new authorization code
+func (p *oidcProvider) IssueCode(code oidcCode) (string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	code.Expires = time.Now().Add(p.CodeTTL)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gc()
+	p.codes[id] = code
+	return id, nil
+}
+
+// UseCode returns the authorization code and removes it, so it can be
+// exchanged only once
+func (p *oidcProvider) UseCode(id string) (oidcCode, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code, ok := p.codes[id]
+	delete(p.codes, id)
+	if !ok || code.Expires.Before(time.Now()) {
+		return oidcCode{}, false
+	}
+	return code, true
+}
+
+// IssueAccessToken returns a new opaque access token for the userinfo
+// endpoint
+func (p *oidcProvider) IssueAccessToken(code oidcCode) (string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gc()
+	p.tokens[id] = oidcAccessToken{ClientID: code.ClientID, UserID: code.UserID, Scope: code.Scope, Expires: time.Now().Add(p.TokenTTL)}
+	return id, nil
+}
+
+// AccessToken looks up a valid access token
+func (p *oidcProvider) AccessToken(id string) (oidcAccessToken, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	token, ok := p.tokens[id]
+	if !ok || token.Expires.Before(time.Now()) {
+		return oidcAccessToken{}, false
+	}
+	return token, true
+}
+
+// idTokenClaims are the claims of the ID token. The subject is the userId
+// returned by RPS.
+type idTokenClaims struct {
+	jwtClaims
+	AuthTime int64  `json:"auth_time,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// IDToken returns the signed ID token for the code
+func (p *oidcProvider) IDToken(code oidcCode) (string, error) {
+	now := time.Now()
+	var claims idTokenClaims
+	claims.Issuer = p.Issuer
+	claims.Subject = code.UserID
+	claims.Audience = code.ClientID
+	claims.IssuedAt = now.Unix()
+	claims.Expires = now.Add(p.TokenTTL).Unix()
+	if !code.AuthTime.IsZero() {
+		claims.AuthTime = code.AuthTime.Unix()
+	}
+	claims.Nonce = code.Nonce
+	claims.Email = scopeEmail(code.Scope, code.UserID)
+	return p.Keys.Sign(&claims)
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeEmail returns the userId as email claim when the email scope was
+// granted and the userId is an address
+func scopeEmail(scope, userID string) string {
+	if hasScope(scope, "email") && strings.Contains(userID, "@") {
+		return userID
+	}
+	return ""
+}
+
+// oidcHandler answers 404 when the OIDC provider is not enabled
+func oidcHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.App.OIDC == nil {
+		return 404, errors.New("OIDC provider disabled")
+	}
+	return 200, nil
+}
+
+// OpenID Provider metadata
+func oidcDiscoveryHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	p := c.App.OIDC
+	ret := map[string]interface{}{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/oidc/authorize",
+		"token_endpoint":                        p.Issuer + "/oidc/token",
+		"userinfo_endpoint":                     p.Issuer + "/oidc/userinfo",
+		"jwks_uri":                              p.Issuer + "/oidc/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": p.Keys.Algs(),
+		"scopes_supported":                      []string{"openid", "email"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := encodeJSONResponse(w, ret); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return 200, nil
+}
+
+// Public keys of the ID token signatures
+func oidcJWKSHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := encodeJSONResponse(w, c.App.OIDC.Keys.JWKS()); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return 200, nil
+}
+
+// oidcRedirect sends the authorization response or error back to the client
+func oidcRedirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) (int, error) {
+	sep := "?"
+	if strings.Contains(redirectURI, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, redirectURI+sep+params.Encode(), 302)
+	return 302, nil
+}
+
+// Authorization endpoint. The user logs in with the PIN pad, which resumes
+// the authorization request afterwards.
+func oidcAuthorizeHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return 400, err
+	}
+	p := c.App.OIDC
+	q := r.Form
+
+	// Without a valid client and redirect URI the error can not be sent to
+	// the client
+	client, ok := p.Clients[q.Get("client_id")]
+	if !ok {
+		log.Printf("W %v %v Unknown OIDC client %q", c.SessionID, c.LoggedUser, q.Get("client_id"))
+		return 400, errors.New("Unknown client_id")
+	}
+	redirectURI, ok := client.RedirectURI(q.Get("redirect_uri"))
+	if !ok {
+		log.Printf("W %v %v Unregistered redirect_uri %q for OIDC client %v", c.SessionID, c.LoggedUser, q.Get("redirect_uri"), client.ID)
+		return 400, errors.New("Invalid redirect_uri")
+	}
+
+	reply := url.Values{}
+	if state := q.Get("state"); state != "" {
+		reply.Set("state", state)
+	}
+	fail := func(code, description string) (int, error) {
+		log.Printf("W %v %v OIDC authorization for %v failed: %v", c.SessionID, c.LoggedUser, client.ID, description)
+		reply.Set("error", code)
+		reply.Set("error_description", description)
+		return oidcRedirect(w, r, redirectURI, reply)
+	}
+
+	if q.Get("response_type") != "code" {
+		return fail("unsupported_response_type", "Only the code response type is supported")
+	}
+	if !hasScope(q.Get("scope"), "openid") {
+		return fail("invalid_scope", "The openid scope is required")
+	}
+	challenge := q.Get("code_challenge")
+	if challenge != "" && q.Get("code_challenge_method") != "S256" {
+		return fail("invalid_request", "Only the S256 code challenge method is supported")
+	}
+	if challenge == "" && client.Secret == "" {
+		return fail("invalid_request", "PKCE is required for public clients")
+	}
+
+	// A login older than max_age seconds is stale
+	fresh := true
+	item, err := c.App.Store.Get(c.SessionID)
+	if maxAge := q.Get("max_age"); maxAge != "" && err == nil {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil || seconds < 0 {
+			return fail("invalid_request", "Invalid max_age")
+		}
+		fresh = !item.AuthTime.IsZero() && time.Since(item.AuthTime) <= time.Duration(seconds)*time.Second
+	}
+	if c.LoggedUser == "" || !fresh {
+		if q.Get("prompt") == "none" {
+			return fail("login_required", "The user is not logged in")
+		}
+		setLoginNext(c, r.URL.Path+"?"+q.Encode())
+		http.Redirect(w, r, "/", 302)
+		return 302, nil
+	}
+	if next := loginNext(c); strings.HasPrefix(next, r.URL.Path+"?") {
+		clearLoginNext(c)
+	}
+
+	code, err := p.IssueCode(oidcCode{
+		ClientID:         client.ID,
+		RedirectURI:      redirectURI,
+		RedirectURIGiven: q.Get("redirect_uri") != "",
+		UserID:           c.LoggedUser,
+		Scope:            q.Get("scope"),
+		Nonce:            q.Get("nonce"),
+		Challenge:        challenge,
+		AuthTime:         item.AuthTime,
+	})
+	if err != nil {
+		log.Printf("E %v %v Failed to issue OIDC code: %v", c.SessionID, c.LoggedUser, err)
+		return fail("server_error", "Failed to issue the code")
+	}
+	c.UserID = c.LoggedUser
+	log.Printf("I %v %v OIDC code issued to %v", c.SessionID, c.LoggedUser, client.ID)
+	reply.Set("code", code)
+	return oidcRedirect(w, r, redirectURI, reply)
+}
+
+// oidcError writes an OAuth 2.0 error response
+func oidcError(w http.ResponseWriter, status int, code, description string) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == 401 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+	}
+	w.WriteHeader(status)
+	encodeJSONResponse(w, map[string]string{"error": code, "error_description": description})
+	return status, nil
+}
+
+// oidcClientAuth authenticates the client with HTTP Basic or the form
+// parameters. Public clients only send their client_id.
+func oidcClientAuth(p *oidcProvider, r *http.Request) (*oidcClient, bool) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// The credentials are form encoded before Basic encoding
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, ok := p.Clients[id]
+	if !ok {
+		return nil, false
+	}
+	if client.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) != 1 {
+		return nil, false
+	}
+	return client, true
+}
+
+// pkceS256 returns the S256 code challenge of the verifier
+func pkceS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Token endpoint, exchanging an authorization code for an ID token and an
+// access token
+func oidcTokenHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "POST"); err != nil {
+		return s, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return oidcError(w, 400, "invalid_request", "Invalid form")
+	}
+	p := c.App.OIDC
+
+	client, ok := oidcClientAuth(p, r)
+	if !ok {
+		log.Printf("W %v %v OIDC client authentication failed from %v", c.SessionID, "", clientIP(c, r))
+		return oidcError(w, 401, "invalid_client", "Client authentication failed")
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		return oidcError(w, 400, "unsupported_grant_type", "Only the authorization_code grant is supported")
+	}
+	code, ok := p.UseCode(r.PostForm.Get("code"))
+	if !ok || code.ClientID != client.ID {
+		return oidcError(w, 400, "invalid_grant", "Invalid or expired code")
+	}
+	c.UserID = code.UserID
+	// RFC 6749 section 4.1.3
+	if uri := r.PostForm.Get("redirect_uri"); (uri != "" || code.RedirectURIGiven) && uri != code.RedirectURI {
+		return oidcError(w, 400, "invalid_grant", "redirect_uri does not match")
+	}
+	if code.Challenge != "" {
+		verifier := r.PostForm.Get("code_verifier")
+		if len(verifier) < 43 || len(verifier) > 128 ||
+			subtle.ConstantTimeCompare([]byte(pkceS256(verifier)), []byte(code.Challenge)) != 1 {
+			log.Printf("W %v %v OIDC code verifier mismatch for %v", c.SessionID, code.UserID, client.ID)
+			return oidcError(w, 400, "invalid_grant", "Invalid code_verifier")
+		}
+	}
+
+	idToken, err := p.IDToken(code)
+	if err != nil {
+		log.Printf("E %v %v Failed to sign ID token: %v", c.SessionID, code.UserID, err)
+		return 500, err
+	}
+	accessToken, err := p.IssueAccessToken(code)
+	if err != nil {
+		log.Printf("E %v %v Failed to issue access token: %v", c.SessionID, code.UserID, err)
+		return 500, err
+	}
+	log.Printf("I %v %v OIDC tokens issued to %v", c.SessionID, code.UserID, client.ID)
+
+	var ret struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		IDToken     string `json:"id_token"`
+		Scope       string `json:"scope"`
+	}
+	ret.AccessToken = accessToken
+	ret.TokenType = "Bearer"
+	ret.ExpiresIn = int(p.TokenTTL / time.Second)
+	ret.IDToken = idToken
+	ret.Scope = code.Scope
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := encodeJSONResponse(w, &ret); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return 200, nil
+}
+
+// UserInfo endpoint
+func oidcUserinfoHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	auth := r.Header.Get("Authorization")
+	token, ok := c.App.OIDC.AccessToken(strings.TrimPrefix(auth, "Bearer "))
+	if !strings.HasPrefix(auth, "Bearer ") || !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return 401, errors.New("Invalid access token")
+	}
+	c.UserID = token.UserID
+
+	var ret struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email,omitempty"`
+	}
+	ret.Subject = token.UserID
+	ret.Email = scopeEmail(token.Scope, token.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	if err := encodeJSONResponse(w, &ret); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return 200, nil
+}
@@ -0,0 +1,264 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func testOIDCApp(t *testing.T) *app {
+	a := testApp()
+	keys, err := loadJWTKeys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.OIDC = &oidcProvider{
+		Issuer: "https://rpa.example.com",
+		Clients: map[string]*oidcClient{
+			"wiki": {ID: "wiki", Secret: "s3cret", RedirectURIs: []string{"https://wiki.example.com/cb"}},
+			"spa":  {ID: "spa", RedirectURIs: []string{"https://spa.example.com/cb", "http://localhost:3000/cb"}},
+		},
+		Keys:     keys,
+		CodeTTL:  time.Minute,
+		TokenTTL: time.Hour,
+		codes:    make(map[string]oidcCode),
+		tokens:   make(map[string]oidcAccessToken),
+	}
+	return a
+}
+
+func oidcAuthorize(a *app, sessionID, user, query string) (int, *httptest.ResponseRecorder) {
+	c := &context{App: a, SessionID: sessionID, LoggedUser: user}
+	w := httptest.NewRecorder()
+	s, _ := oidcAuthorizeHandler(c, w, mustRequest("GET", "/oidc/authorize?"+query))
+	return s, w
+}
+
+func oidcToken(a *app, form url.Values, user, password string) *httptest.ResponseRecorder {
+	c := &context{App: a}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/oidc/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		r.SetBasicAuth(user, password)
+	}
+	oidcTokenHandler(c, w, r)
+	return w
+}
+
+func TestOIDCCodeFlowPKCE(t *testing.T) {
+	a := testOIDCApp(t)
+	a.Store.Put("345", session{})
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://spa.example.com/cb"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {pkceS256(testVerifier)},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	// Anonymous users log in with the PIN pad first
+	_, w := oidcAuthorize(a, "345", "", query)
+	if w.Code != 302 || w.Header().Get("Location") != "/" {
+		t.Fatalf("code = <%d> location = <%v> want <302> </>", w.Code, w.Header().Get("Location"))
+	}
+	item, _ := a.Store.Get("345")
+	if !strings.HasPrefix(item.Next, "/oidc/authorize?") {
+		t.Fatalf("next = <%v>", item.Next)
+	}
+	a.Store.Put("345", session{User: "foo@example.com", AuthTime: time.Now(), Next: item.Next})
+
+	_, w = oidcAuthorize(a, "345", "foo@example.com", query)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != 302 || !strings.HasPrefix(location.String(), "https://spa.example.com/cb?") {
+		t.Fatalf("code = <%d> location = <%v>", w.Code, location)
+	}
+	if location.Query().Get("state") != "xyz" || location.Query().Get("code") == "" {
+		t.Fatalf("location = <%v>", location)
+	}
+	if item, _ := a.Store.Get("345"); item.Next != "" {
+		t.Errorf("next = <%v> not cleared", item.Next)
+	}
+	code := location.Query().Get("code")
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://spa.example.com/cb"},
+		"client_id":     {"spa"},
+		"code_verifier": {"wrong-verifier-wrong-verifier-wrong-verifier"},
+	}
+	if w := oidcToken(a, form, "", ""); w.Code != 400 || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Fatalf("wrong verifier: code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+
+	// A failed exchange consumes the code
+	_, w = oidcAuthorize(a, "345", "foo@example.com", query)
+	location, _ = url.Parse(w.Header().Get("Location"))
+	form.Set("code", location.Query().Get("code"))
+	form.Set("code_verifier", testVerifier)
+	w = oidcToken(a, form, "", "")
+	if w.Code != 200 {
+		t.Fatalf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+	var ret struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		IDToken     string `json:"id_token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &ret)
+	var claims idTokenClaims
+	if err := a.OIDC.Keys.Verify(ret.IDToken, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "foo@example.com" || claims.Audience != "spa" || claims.Issuer != "https://rpa.example.com" ||
+		claims.Nonce != "n-0S6" || claims.Email != "foo@example.com" || claims.AuthTime == 0 || claims.Expires <= time.Now().Unix() {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	// Codes are single use
+	if w := oidcToken(a, form, "", ""); w.Code != 400 {
+		t.Errorf("code reused: code = <%d>", w.Code)
+	}
+
+	c := &context{App: a}
+	w = httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/oidc/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+ret.AccessToken)
+	if s, _ := oidcUserinfoHandler(c, w, r); s != 200 || !strings.Contains(w.Body.String(), `"sub":"foo@example.com"`) {
+		t.Errorf("userinfo: status = <%d> body = <%s>", s, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer "+ret.IDToken)
+	if s, _ := oidcUserinfoHandler(c, w, r); s != 401 {
+		t.Errorf("userinfo with ID token: status = <%d> want <401>", s)
+	}
+}
+
+func TestOIDCTokenRedirectURIRequired(t *testing.T) {
+	a := testOIDCApp(t)
+	a.Store.Put("345", session{User: "foo", AuthTime: time.Now()})
+	_, w := oidcAuthorize(a, "345", "foo", "response_type=code&client_id=wiki&scope=openid&redirect_uri=https://wiki.example.com/cb")
+	location, _ := url.Parse(w.Header().Get("Location"))
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {location.Query().Get("code")}}
+	if w := oidcToken(a, form, "wiki", "s3cret"); w.Code != 400 || !strings.Contains(w.Body.String(), "redirect_uri") {
+		t.Errorf("code = <%d> body = <%s> want <400>", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCConfidentialClient(t *testing.T) {
+	a := testOIDCApp(t)
+	a.Store.Put("345", session{User: "foo", AuthTime: time.Now()})
+	_, w := oidcAuthorize(a, "345", "foo", "response_type=code&client_id=wiki&scope=openid")
+	location, _ := url.Parse(w.Header().Get("Location"))
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("location = <%v>", location)
+	}
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}}
+
+	if w := oidcToken(a, form, "wiki", "wrong"); w.Code != 401 || !strings.Contains(w.Body.String(), "invalid_client") {
+		t.Fatalf("wrong secret: code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+	if w := oidcToken(a, form, "spa", ""); w.Code != 400 {
+		t.Fatalf("other client: code = <%d> want <400>", w.Code)
+	}
+	_, w = oidcAuthorize(a, "345", "foo", "response_type=code&client_id=wiki&scope=openid")
+	location, _ = url.Parse(w.Header().Get("Location"))
+	form.Set("code", location.Query().Get("code"))
+	if w := oidcToken(a, form, "wiki", "s3cret"); w.Code != 200 {
+		t.Fatalf("code = <%d> body = <%s>", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCAuthorizeErrors(t *testing.T) {
+	a := testOIDCApp(t)
+	a.Store.Put("345", session{User: "foo", AuthTime: time.Now().Add(-time.Hour)})
+	challenge := "&code_challenge=" + pkceS256(testVerifier) + "&code_challenge_method=S256"
+
+	for _, d := range []struct {
+		query string
+		code  int
+		error string
+	}{
+		{"response_type=code&client_id=nope&scope=openid", 400, ""},
+		{"response_type=code&client_id=spa&scope=openid", 400, ""},
+		{"response_type=code&client_id=spa&scope=openid&redirect_uri=https://evil.example.com/cb", 400, ""},
+		{"response_type=token&client_id=wiki&scope=openid", 302, "unsupported_response_type"},
+		{"response_type=code&client_id=wiki&scope=email", 302, "invalid_scope"},
+		{"response_type=code&client_id=spa&scope=openid&redirect_uri=http://localhost:3000/cb", 302, "invalid_request"},
+		{"response_type=code&client_id=wiki&scope=openid&code_challenge=abc&code_challenge_method=plain", 302, "invalid_request"},
+		{"response_type=code&client_id=wiki&scope=openid&max_age=60&prompt=none", 302, "login_required"},
+		{"response_type=code&client_id=spa&scope=openid&redirect_uri=http://localhost:3000/cb" + challenge, 302, ""},
+	} {
+		s, w := oidcAuthorize(a, "345", "foo", d.query)
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if s != d.code || location.Query().Get("error") != d.error {
+			t.Errorf("%v: status = <%d> location = <%v> want <%d> error <%v>", d.query, s, location, d.code, d.error)
+		}
+	}
+
+	// A stale login goes back to the PIN pad
+	_, w := oidcAuthorize(a, "345", "foo", "response_type=code&client_id=wiki&scope=openid&max_age=60")
+	if w.Header().Get("Location") != "/" {
+		t.Errorf("stale login: location = <%v> want </>", w.Header().Get("Location"))
+	}
+}
+
+func mustRequest(method, path string) *http.Request {
+	r, _ := http.NewRequest(method, path, new(bytes.Buffer))
+	return r
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	a := testOIDCApp(t)
+	c := &context{App: a}
+	w := httptest.NewRecorder()
+	oidcDiscoveryHandler(c, w, mustRequest("GET", "/.well-known/openid-configuration"))
+	var ret map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret["issuer"] != "https://rpa.example.com" || ret["jwks_uri"] != "https://rpa.example.com/oidc/jwks" {
+		t.Errorf("discovery = %v", ret)
+	}
+
+	w = httptest.NewRecorder()
+	oidcJWKSHandler(c, w, mustRequest("GET", "/oidc/jwks"))
+	if !strings.Contains(w.Body.String(), `"kid":"`+a.OIDC.Keys[0].ID+`"`) {
+		t.Errorf("jwks = %s", w.Body.String())
+	}
+
+	c.App.OIDC = nil
+	if s, _ := oidcHandler(c, httptest.NewRecorder(), mustRequest("GET", "/oidc/jwks")); s != 404 {
+		t.Errorf("disabled provider: status = <%d> want <404>", s)
+	}
+}
@@ -23,49 +23,118 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type options struct {
-	Address           string
-	Port              int
-	EnableTLS         bool
-	CertFile          string
-	KeyFile           string
-	CookieSecret      string
-	ResourcesBasePath string
-	MpinJSURL         string
-	ForceActivate     bool
-	RPSHost           string
-	RPSSchema         string
-	CACertFile        string
-	RpsPrefix         string
-	ClientSettingsURL string
-	VerifyIdentityURL string
-	RequestOTP        bool
-	LDAPVerify        bool
-	LDAPVerifyShow    bool
-	LDAPServer        string
-	LDAPPort          int
-	LDAPBindDN        string
-	LDAPBindPWD       string
-	LDAPBaseDN        string
-	LDAPFilter        string
-	LDAPUseTLS        bool
-	EmailSubject      string
-	EmailSender       string
-	SMTPServer        string
-	SMTPSPort         int
-	SMTPSUser         string
-	SMTPPassword      string
-	SMTPSUseTLS       bool
-	MobileSupport     bool
-	MobileAppPath     string
-	MobileAppFullURL  string
-	UseSecureCookie   bool
-	StaticPath        string
-	TemplatesPath     string
-	StaticURLBase     string
-	SessionMaxAge     int
+	Address                 string
+	Port                    int
+	EnableTLS               bool
+	CertFile                string
+	KeyFile                 string
+	CookieSecret            string
+	ResourcesBasePath       string
+	MpinJSURL               string
+	ForceActivate           bool
+	RPSHost                 string
+	RPSSchema               string
+	RPSBalance              string
+	RPSHealthPath           string
+	RPSHealthInterval       time.Duration
+	CACertFile              string
+	RPSTimeout              time.Duration
+	RPSRetries              int
+	RPSRetryBackoff         time.Duration
+	RPSBreakerThreshold     int
+	RPSBreakerCooldown      time.Duration
+	RpsPrefix               string
+	RPSAllow                string
+	RPSMaxBody              int
+	RPSStripResponseHeaders string
+	FakeRPS                 bool
+	ClientSettingsURL       string
+	VerifyIdentityURL       string
+	RequestOTP              bool
+	OTPTTL                  time.Duration
+	RateLimitIP             int
+	RateLimitUser           int
+	TrustedProxies          string
+	LockoutThreshold        int
+	LockoutDuration         time.Duration
+	LockoutMax              time.Duration
+	LockoutState            string
+	AdminToken              string
+	RevokeDenylist          string
+	RevokeRules             string
+	RevokeLDAP              bool
+	RevokeFailOpen          bool
+	PermitAllow             string
+	PermitDeny              string
+	PermitLDAP              bool
+	PermitLDAPGroup         string
+	PolicyFile              string
+	PolicyShadow            bool
+	LogoutURL               string
+	LogoutKey               string
+	LogoutTokenTTL          time.Duration
+	StepUp                  string
+	OIDCIssuer              string
+	OIDCClients             string
+	OIDCKeys                string
+	OIDCCodeTTL             time.Duration
+	OIDCTokenTTL            time.Duration
+	SAMLURL                 string
+	SAMLEntityID            string
+	SAMLServiceProviders    string
+	SAMLCert                string
+	SAMLKey                 string
+	SAMLAssertionTTL        time.Duration
+	JWTTokens               bool
+	JWTKeys                 string
+	JWTIssuer               string
+	JWTAccessTTL            time.Duration
+	JWTRefreshTTL           time.Duration
+	GatewayUpstream         string
+	GatewayUserHeader       string
+	GatewayLDAPHeaders      string
+	AuthLoginURL            string
+	Webhooks                string
+	WebhooksQueue           string
+	WebhooksMaxAttempts     int
+	WebhooksTimeout         time.Duration
+	PasswordUsers           string
+	PasswordGroup           string
+	ActivationKey           string
+	ActivationState         string
+	ResendLimitUser         int
+	ResendLimitIP           int
+	Approvers               string
+	ApprovalQueue           string
+	IdentitiesFile          string
+	LDAPVerify              bool
+	LDAPVerifyShow          bool
+	LDAPServer              string
+	LDAPPort                int
+	LDAPBindDN              string
+	LDAPBindPWD             string
+	LDAPBaseDN              string
+	LDAPFilter              string
+	LDAPUseTLS              bool
+	EmailSubject            string
+	EmailSender             string
+	SMTPServer              string
+	SMTPSPort               int
+	SMTPSUser               string
+	SMTPPassword            string
+	SMTPSUseTLS             bool
+	MobileSupport           bool
+	MobileAppPath           string
+	MobileAppFullURL        string
+	UseSecureCookie         bool
+	StaticPath              string
+	TemplatesPath           string
+	StaticURLBase           string
+	SessionMaxAge           int
 }
 
 func getCurrentDir() string {
@@ -89,13 +158,81 @@ func init() {
 	flag.StringVar(&o.ResourcesBasePath, "resources-base", getCurrentDir(), "Base path for static resources - default is dynamic relative to executable")
 	flag.StringVar(&o.MpinJSURL, "pinpad-url", "https://mpin.certivox.net/v3/mpin.js", "URL for MPIN pinpad javascript files")
 	flag.BoolVar(&o.ForceActivate, "force-activate", false, "Force user activation without sending mail")
-	flag.StringVar(&o.RPSHost, "rps-host", "127.0.0.1:8011", "RPS host")
+	flag.StringVar(&o.RPSHost, "rps-host", "127.0.0.1:8011", "RPS host, or comma separated list of RPS hosts")
 	flag.StringVar(&o.RPSSchema, "rps-schema", "http", "RPS URI schema")
+	flag.StringVar(&o.RPSBalance, "rps-balance", "round-robin", "Balancing between RPS hosts: round-robin or least-conn")
+	flag.StringVar(&o.RPSHealthPath, "rps-health-path", "/clientSettings", "RPS path requested by health checks")
+	flag.DurationVar(&o.RPSHealthInterval, "rps-health-interval", 10*time.Second, "Interval between RPS health checks (0 disables them)")
 	flag.StringVar(&o.CACertFile, "ca-cert", "", "Path to CA certificates file")
+	flag.DurationVar(&o.RPSTimeout, "rps-timeout", 10*time.Second, "Timeout for a single request to RPS")
+	flag.IntVar(&o.RPSRetries, "rps-retries", 2, "Number of retries for idempotent requests to RPS")
+	flag.DurationVar(&o.RPSRetryBackoff, "rps-retry-backoff", 200*time.Millisecond, "Initial delay between retries to RPS, doubled on every retry")
+	flag.IntVar(&o.RPSBreakerThreshold, "rps-breaker-threshold", 5, "Consecutive RPS failures before the circuit opens (0 disables the breaker)")
+	flag.DurationVar(&o.RPSBreakerCooldown, "rps-breaker-cooldown", 30*time.Second, "Time the RPS circuit stays open before a probe request")
 	flag.StringVar(&o.RpsPrefix, "rps-prefix", "rps", "RPS proxy prefix")
+	flag.StringVar(&o.RPSAllow, "rps-allow", defaultRPSAllow, "RPS paths reachable through the proxy, as \"METHODS /path\" entries separated by ';' (\"*\" allows all)")
+	flag.BoolVar(&o.FakeRPS, "fake-rps", false, "Use an in-process fake RPS (development only)")
+	flag.IntVar(&o.RPSMaxBody, "rps-max-body", 64*1024, "Maximum size in bytes of a request body forwarded to RPS")
+	flag.StringVar(&o.RPSStripResponseHeaders, "rps-strip-response-headers", "Server,X-Powered-By,Set-Cookie", "Comma separated RPS response headers not passed to the client")
 	flag.StringVar(&o.ClientSettingsURL, "client-settings-url", "/rps/clientSettings", "Client settings URL")
 	flag.StringVar(&o.VerifyIdentityURL, "verify-identity-url", "http://localhost:8005/mpinActivate", "Verify identity URL")
 	flag.BoolVar(&o.RequestOTP, "request-otp", false, "Request OTP")
+	flag.DurationVar(&o.OTPTTL, "otp-ttl", 64*time.Second, "OTP validity when RPS does not send one")
+	flag.IntVar(&o.RateLimitIP, "rate-limit-ip", 60, "Authentication requests per minute per client IP (0 disables)")
+	flag.IntVar(&o.RateLimitUser, "rate-limit-user", 20, "Authentication requests per minute per user (0 disables)")
+	flag.StringVar(&o.TrustedProxies, "trusted-proxies", "", "Comma separated reverse proxy addresses or CIDR ranges whose X-Forwarded-For gives the client IP")
+	flag.IntVar(&o.LockoutThreshold, "lockout-threshold", 5, "Failed logins in a row before the user is locked (0 disables)")
+	flag.DurationVar(&o.LockoutDuration, "lockout-duration", time.Minute, "First lockout duration, doubled on every further failure")
+	flag.DurationVar(&o.LockoutMax, "lockout-max", time.Hour, "Maximum lockout duration")
+	flag.StringVar(&o.LockoutState, "lockout-state", "", "File to keep lockouts in across restarts")
+	flag.StringVar(&o.AdminToken, "admin-token", "", "Bearer token for the admin endpoints (disabled when empty)")
+	flag.StringVar(&o.RevokeDenylist, "revoke-denylist", "", "File with userIds and @domains denied at login")
+	flag.StringVar(&o.RevokeRules, "revoke-rules", "", "Rules denying userIds at login, e.g. \"@example.com; 410 ^guest-\"")
+	flag.BoolVar(&o.RevokeLDAP, "revoke-ldap", false, "Deny login to users missing or disabled in LDAP")
+	flag.BoolVar(&o.RevokeFailOpen, "revoke-fail-open", false, "Allow login when the revocation check fails")
+	flag.StringVar(&o.PermitAllow, "permit-allow", "", "Comma separated userIds and @domains allowed to get time permits")
+	flag.StringVar(&o.PermitDeny, "permit-deny", "", "Comma separated userIds and @domains denied time permits")
+	flag.BoolVar(&o.PermitLDAP, "permit-ldap", false, "Deny time permits to users missing, disabled or expired in LDAP")
+	flag.StringVar(&o.PermitLDAPGroup, "permit-ldap-group", "", "DN of the LDAP group required for time permits")
+	flag.StringVar(&o.PolicyFile, "policy-file", "", "Access policy file evaluated at login and time permit requests")
+	flag.BoolVar(&o.PolicyShadow, "policy-shadow", false, "Only log the access policy denials, without enforcing them")
+	flag.StringVar(&o.LogoutURL, "logout-url", "", "Logout URL sent to RPS for mobile logout")
+	flag.StringVar(&o.LogoutKey, "logout-key", "", "Key to sign logout tokens (random when empty)")
+	flag.DurationVar(&o.LogoutTokenTTL, "logout-token-ttl", 0, "Logout token validity (session max age when 0)")
+	flag.StringVar(&o.StepUp, "step-up", "", "Pages requiring a recent login, as comma separated \"/path=duration\" entries")
+	flag.StringVar(&o.OIDCIssuer, "oidc-issuer", "", "Issuer URL of the OpenID Connect provider (disabled when empty)")
+	flag.StringVar(&o.OIDCClients, "oidc-clients", "", "JSON file with the registered OpenID Connect clients")
+	flag.StringVar(&o.OIDCKeys, "oidc-keys", "", "Comma separated PEM files with the RSA or P-256 ID token signing keys, the first one signs")
+	flag.DurationVar(&o.OIDCCodeTTL, "oidc-code-ttl", time.Minute, "OpenID Connect authorization code validity")
+	flag.DurationVar(&o.OIDCTokenTTL, "oidc-token-ttl", time.Hour, "OpenID Connect ID and access token validity")
+	flag.StringVar(&o.SAMLURL, "saml-url", "", "Base URL of the SAML identity provider endpoints (disabled when empty)")
+	flag.StringVar(&o.SAMLEntityID, "saml-entity-id", "", "SAML identity provider entity ID (the metadata URL when empty)")
+	flag.StringVar(&o.SAMLServiceProviders, "saml-sps", "", "JSON file with the registered SAML service providers")
+	flag.StringVar(&o.SAMLCert, "saml-cert", "", "PEM certificate of the SAML signing key")
+	flag.StringVar(&o.SAMLKey, "saml-key", "", "PEM RSA or P-256 key signing SAML assertions")
+	flag.DurationVar(&o.SAMLAssertionTTL, "saml-assertion-ttl", 5*time.Minute, "SAML assertion validity")
+	flag.BoolVar(&o.JWTTokens, "jwt-tokens", false, "Return JWT access and refresh tokens after login, and accept them as bearer tokens")
+	flag.StringVar(&o.JWTKeys, "jwt-keys", "", "Comma separated PEM files with the RSA or P-256 access token signing keys, the first one signs")
+	flag.StringVar(&o.JWTIssuer, "jwt-issuer", "mpin-rpa", "Issuer of the JWT access tokens")
+	flag.DurationVar(&o.JWTAccessTTL, "jwt-access-ttl", 15*time.Minute, "JWT access token validity")
+	flag.DurationVar(&o.JWTRefreshTTL, "jwt-refresh-ttl", 24*time.Hour, "Refresh token validity")
+	flag.StringVar(&o.GatewayUpstream, "gateway-upstream", "", "Proxy the paths not served by the RPA to this URL for logged in users")
+	flag.StringVar(&o.GatewayUserHeader, "gateway-user-header", "X-Remote-User", "Header with the userId sent to the gateway upstream and returned by /auth/verify")
+	flag.StringVar(&o.GatewayLDAPHeaders, "gateway-ldap-headers", "", "Comma separated LDAP attributes sent to the gateway upstream, as attribute=Header")
+	flag.StringVar(&o.AuthLoginURL, "auth-login-url", "/", "PIN pad URL returned by /auth/verify to anonymous requests")
+	flag.StringVar(&o.Webhooks, "webhooks", "", "JSON file with the webhook subscriptions for login and registration events")
+	flag.StringVar(&o.WebhooksQueue, "webhooks-queue", "", "File to keep the webhook queue in across restarts")
+	flag.IntVar(&o.WebhooksMaxAttempts, "webhooks-max-attempts", 10, "Attempts to deliver a webhook before giving up")
+	flag.DurationVar(&o.WebhooksTimeout, "webhooks-timeout", 10*time.Second, "Timeout of a webhook request")
+	flag.StringVar(&o.PasswordUsers, "password-users", "", "Comma separated userIds and @domains that must also enter their LDAP password after the M-Pin login")
+	flag.StringVar(&o.PasswordGroup, "password-group", "", "LDAP group DN whose members must also enter their LDAP password after the M-Pin login")
+	flag.StringVar(&o.ActivationKey, "activation-key", "", "Key to sign activation links (random when empty, so links do not survive restarts)")
+	flag.StringVar(&o.ActivationState, "activation-state", "", "File to keep the used activation links in across restarts")
+	flag.IntVar(&o.ResendLimitUser, "resend-limit-user", 3, "Activation mails sent again per hour per user (0 disables)")
+	flag.IntVar(&o.ResendLimitIP, "resend-limit-ip", 10, "Activation mail resend requests per hour per client IP (0 disables)")
+	flag.StringVar(&o.Approvers, "approvers", "", "Comma separated userIds that approve new registrations on /admin/approvals (approval off when empty)")
+	flag.StringVar(&o.ApprovalQueue, "approval-queue", "", "File to keep the registrations waiting for approval in across restarts")
+	flag.StringVar(&o.IdentitiesFile, "identities", "", "File to keep the registered identities shown on /protected/identities in across restarts")
 	flag.StringVar(&o.EmailSubject, "email-subject", "M-Pin demo: New user activation", "Email subject")
 	flag.StringVar(&o.EmailSender, "email-sender", "", "Email sender")
 	flag.BoolVar(&o.LDAPVerify, "ldap-verify", false, "LDAP verify")
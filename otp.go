@@ -0,0 +1,129 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Failed verifications after which an OTP is dropped
+const otpMaxAttempts = 5
+
+type otpEntry struct {
+	UserID   string
+	OTP      string
+	Expires  time.Time
+	Failures int
+}
+
+// otpStore keeps the OTPs issued at login, one per session, until they are
+// verified once or expire. Failed verifications are counted on each OTP, so
+// they never drop the OTPs issued afterwards.
+type otpStore struct {
+	mu        sync.Mutex
+	bySession map[string]otpEntry
+}
+
+var errOTPInvalid = errors.New("Invalid or expired OTP")
+
+func newOTPStore() *otpStore {
+	return &otpStore{
+		bySession: make(map[string]otpEntry),
+	}
+}
+
+// Issue stores the OTP for the session. When RPS did not send one, a
+// six digit OTP is generated.
+func (s *otpStore) Issue(sessionID, userID, otp string, ttl time.Duration) (e otpEntry, err error) {
+	if otp == "" {
+		if otp, err = generateOTP(6); err != nil {
+			return
+		}
+	}
+	e = otpEntry{UserID: userID, OTP: otp, Expires: time.Now().Add(ttl)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gc(time.Now())
+	s.bySession[sessionID] = e
+	return
+}
+
+// ForSession returns the valid OTP issued to the session
+func (s *otpStore) ForSession(sessionID string) (e otpEntry, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok = s.bySession[sessionID]
+	if ok && e.Expires.Before(time.Now()) {
+		delete(s.bySession, sessionID)
+		return otpEntry{}, false
+	}
+	return
+}
+
+// Verify checks the OTP submitted for the user. A valid OTP is consumed.
+// A wrong one counts as a failure for each OTP of the user, and those
+// reaching otpMaxAttempts are dropped.
+func (s *otpStore) Verify(userID, otp string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gc(time.Now())
+	for k, e := range s.bySession {
+		if e.UserID == userID && subtle.ConstantTimeCompare([]byte(e.OTP), []byte(otp)) == 1 {
+			delete(s.bySession, k)
+			return nil
+		}
+	}
+
+	for k, e := range s.bySession {
+		if e.UserID != userID {
+			continue
+		}
+		if e.Failures++; e.Failures >= otpMaxAttempts {
+			delete(s.bySession, k)
+		} else {
+			s.bySession[k] = e
+		}
+	}
+	return errOTPInvalid
+}
+
+// gc drops the expired OTPs. The caller holds the lock.
+func (s *otpStore) gc(now time.Time) {
+	for k, e := range s.bySession {
+		if e.Expires.Before(now) {
+			delete(s.bySession, k)
+		}
+	}
+}
+
+func generateOTP(digits int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
@@ -0,0 +1,83 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOTPStoreVerifyOnce(t *testing.T) {
+	s := newOTPStore()
+	e, err := s.Issue("345", "foo", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.OTP) != 6 {
+		t.Errorf("otp = <%s> want 6 digits", e.OTP)
+	}
+	if err := s.Verify("bar", e.OTP); err != errOTPInvalid {
+		t.Errorf("err = <%v> want <%v> for another user", err, errOTPInvalid)
+	}
+	if err := s.Verify("foo", e.OTP); err != nil {
+		t.Errorf("err = <%v> want <nil>", err)
+	}
+	if err := s.Verify("foo", e.OTP); err != errOTPInvalid {
+		t.Errorf("err = <%v> want <%v> on reuse", err, errOTPInvalid)
+	}
+}
+
+func TestOTPStoreExpired(t *testing.T) {
+	s := newOTPStore()
+	s.Issue("345", "foo", "123456", -time.Second)
+	if _, ok := s.ForSession("345"); ok {
+		t.Error("expired OTP returned")
+	}
+	if err := s.Verify("foo", "123456"); err != errOTPInvalid {
+		t.Errorf("err = <%v> want <%v>", err, errOTPInvalid)
+	}
+}
+
+func TestOTPStoreMaxAttempts(t *testing.T) {
+	s := newOTPStore()
+	s.Issue("345", "foo", "123456", time.Minute)
+	for i := 0; i < otpMaxAttempts; i++ {
+		s.Verify("foo", "000000")
+	}
+	if err := s.Verify("foo", "123456"); err != errOTPInvalid {
+		t.Errorf("err = <%v> want <%v> after %d failures", err, errOTPInvalid, otpMaxAttempts)
+	}
+}
+
+// Failures before a login do not drop its OTP
+func TestOTPStoreFailuresPerOTP(t *testing.T) {
+	s := newOTPStore()
+	s.Issue("345", "foo", "123456", time.Minute)
+	for i := 0; i < otpMaxAttempts-1; i++ {
+		s.Verify("foo", "000000")
+	}
+	s.Issue("678", "foo", "654321", time.Minute)
+	s.Verify("foo", "000000")
+	if _, ok := s.ForSession("345"); ok {
+		t.Errorf("OTP kept after %d failures", otpMaxAttempts)
+	}
+	if err := s.Verify("foo", "654321"); err != nil {
+		t.Errorf("err = <%v> want <nil>", err)
+	}
+}
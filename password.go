@@ -0,0 +1,238 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"errors"
+	"./ldap"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// The password must be entered this long after the M-Pin login
+	passwordStepTTL = 5 * time.Minute
+	// Wrong passwords before the M-Pin login has to be repeated
+	passwordMaxAttempts = 3
+)
+
+var errInvalidPassword = errors.New("Invalid password")
+
+// pendingLogin is an M-Pin login waiting for the LDAP password
+type pendingLogin struct {
+	UserID   string
+	Started  time.Time
+	Attempts int
+	// OTP and OTPTTL are sent by RPS with the login. The OTP is issued
+	// only after the password.
+	OTP    string
+	OTPTTL time.Duration
+}
+
+// passwordFactor selects the users that must enter their LDAP password
+// after the M-Pin login: those in Users and the members of Group
+type passwordFactor struct {
+	Users []revocationRule
+	Group string
+}
+
+// newPasswordFactor returns nil when no user needs the password
+func newPasswordFactor(o *options) (*passwordFactor, error) {
+	users, err := parseUserList(o.PasswordUsers)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 && o.PasswordGroup == "" {
+		return nil, nil
+	}
+	return &passwordFactor{Users: users, Group: o.PasswordGroup}, nil
+}
+
+// Required reports whether the user must enter the LDAP password. When the
+// group can not be checked the password is required.
+func (p *passwordFactor) Required(c *context, userID string) bool {
+	if p == nil {
+		return false
+	}
+	if matchAny(p.Users, userID) {
+		return true
+	}
+	if p.Group == "" {
+		return false
+	}
+	groups, err := ldapUserGroups(c, userID)
+	if err != nil {
+		log.Printf("E %v %v LDAP group lookup failed, requiring the password: %v", c.SessionID, userID, err)
+		return true
+	}
+	return containsDN(groups, p.Group)
+}
+
+// ldapCheckPassword binds as the user's entry, found with LDAPFilter
+func ldapCheckPassword(c *context, userID, password string) error {
+	// An empty password is an unauthenticated bind, which succeeds
+	if password == "" {
+		return errInvalidPassword
+	}
+	conn, err := dialLDAP(c, userID)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	entry, err := ldapSearchUser(c, conn, userID, []string{"dn"})
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return errInvalidPassword
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return errInvalidPassword
+		}
+		return err
+	}
+	return nil
+}
+
+// pendingUser returns the login of the session waiting for the password
+func pendingUser(c *context) (pendingLogin, bool) {
+	item, err := c.App.Store.Get(c.SessionID)
+	if err != nil || item.Pending.UserID == "" || time.Since(item.Pending.Started) > passwordStepTTL {
+		return pendingLogin{}, false
+	}
+	return item.Pending, true
+}
+
+// successLoginURL is where the PIN pad goes after the login
+func successLoginURL(c *context) string {
+	if c.App.Password != nil {
+		return "/login/password"
+	}
+	return afterLoginURL(c)
+}
+
+// afterLoginURL is the page to show once the session is logged in
+func afterLoginURL(c *context) string {
+	if c.App.Options.RequestOTP {
+		return "/otp"
+	} else if next := loginNext(c); next != "" {
+		return next
+	}
+	return "/protected"
+}
+
+// Ask for the LDAP password after the M-Pin login and log the session in
+// when it is right
+func passwordHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	pending, ok := pendingUser(c)
+	if !ok {
+		// Users without the second factor pass through
+		if c.LoggedUser != "" {
+			http.Redirect(w, r, afterLoginURL(c), 302)
+		} else {
+			http.Redirect(w, r, "/", 302)
+		}
+		return 302, nil
+	}
+	c.UserID = pending.UserID
+
+	data := make(map[string]interface{})
+	data["StaticURLBase"] = c.App.Options.StaticURLBase
+	data["UserID"] = pending.UserID
+	if r.Method == "GET" {
+		return renderTemplate(c.App, w, "password.tmpl", data)
+	}
+
+	if s, err := throttleUser(c, w, pending.UserID); err != nil {
+		return s, err
+	}
+	err := c.App.CheckPassword(c, pending.UserID, r.PostFormValue("password"))
+	if err != nil && err != errInvalidPassword {
+		log.Printf("E %v %v LDAP password check failed: %v", c.SessionID, pending.UserID, err)
+		return 500, err
+	}
+
+	item, _ := c.App.Store.Get(c.SessionID)
+	if err == errInvalidPassword {
+		item.Pending.Attempts++
+		log.Printf("W %v %v Invalid LDAP password, attempt %d", c.SessionID, pending.UserID, item.Pending.Attempts)
+		if locked := c.App.Lockouts.Failure(pending.UserID); locked > 0 {
+			log.Printf("W %v %v Account locked for %v after failed logins", c.SessionID, pending.UserID, locked)
+		}
+		if item.Pending.Attempts >= passwordMaxAttempts || c.App.Lockouts.Locked(pending.UserID) > 0 {
+			// Start over with the PIN pad
+			item.Pending = pendingLogin{}
+			c.App.Store.Put(c.SessionID, item)
+			http.Redirect(w, r, "/", 302)
+			return 302, nil
+		}
+		c.App.Store.Put(c.SessionID, item)
+		data["Invalid"] = true
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(401)
+		renderTemplate(c.App, w, "password.tmpl", data)
+		return 401, nil
+	}
+
+	c.App.Lockouts.Success(pending.UserID)
+	item.Pending = pendingLogin{}
+	item.User = pending.UserID
+	item.AuthTime = time.Now()
+	c.App.Store.Put(c.SessionID, item)
+	c.LoggedUser = pending.UserID
+	log.Printf("D Authenticated user %v with LDAP password {%v}", pending.UserID, c.SessionID)
+	c.App.Webhooks.Fire(webhookLogin, pending.UserID, map[string]string{"factors": "mpin,password"})
+
+	if c.App.Options.RequestOTP {
+		ttl := pending.OTPTTL
+		if ttl <= 0 {
+			ttl = c.App.Options.OTPTTL
+		}
+		if _, err := c.App.OTPs.Issue(c.SessionID, pending.UserID, pending.OTP, ttl); err != nil {
+			return 500, err
+		}
+	}
+	// XHR clients get the tokens /mpinAuthenticate held back
+	if c.App.Tokens != nil && strings.Contains(r.Header.Get("Accept"), "application/json") {
+		pair, err := c.App.Tokens.Issue(c.SessionID, pending.UserID, item.MpinID, item.AuthTime)
+		if err != nil {
+			log.Printf("E %v %v Failed to issue tokens: %v", c.SessionID, pending.UserID, err)
+			return 500, err
+		}
+		var ret authRPAResponse
+		ret.UserId = pending.UserID
+		ret.AccessToken = pair.AccessToken
+		ret.RefreshToken = pair.RefreshToken
+		ret.TokenType = pair.TokenType
+		ret.ExpiresIn = pair.ExpiresIn
+		w.Header().Set("Content-Type", "application/json")
+		if err := encodeJSONResponse(w, &ret); err != nil {
+			return 500, errors.New("Failed to encode response")
+		}
+		return 200, nil
+	}
+	http.Redirect(w, r, afterLoginURL(c), 302)
+	return 302, nil
+}
@@ -0,0 +1,171 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordFactorRequired(t *testing.T) {
+	c := &context{App: testApp()}
+	if p, err := newPasswordFactor(&options{}); p != nil || err != nil {
+		t.Fatalf("newPasswordFactor() = <%v> <%v> want nil", p, err)
+	}
+	p, err := newPasswordFactor(&options{PasswordUsers: "admin@example.com, @secure.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []struct {
+		userID   string
+		required bool
+	}{
+		{"admin@example.com", true},
+		{"bob@secure.example.com", true},
+		{"bob@example.com", false},
+	} {
+		if required := p.Required(c, d.userID); required != d.required {
+			t.Errorf("Required(%v) = %v want %v", d.userID, required, d.required)
+		}
+	}
+	if (*passwordFactor)(nil).Required(c, "admin@example.com") {
+		t.Errorf("nil factor requires the password")
+	}
+}
+
+func TestLDAPCheckPasswordEmpty(t *testing.T) {
+	// An empty password must not reach the LDAP server
+	c := &context{App: testApp()}
+	if err := ldapCheckPassword(c, "foo@example.com", ""); err != errInvalidPassword {
+		t.Errorf("err = <%v> want <%v>", err, errInvalidPassword)
+	}
+}
+
+// testPasswordLogin runs an M-Pin login of a user needing the password
+func testPasswordLogin(t *testing.T) *context {
+	c := &context{App: testApp(), SessionID: "345"}
+	c.App.Templates = loadTemplates("./templates")
+	c.App.Password, _ = newPasswordFactor(&options{PasswordUsers: "foo@example.com"})
+	c.App.RPS.Fetch = func(url, method string, q, d interface{}) error { return nil }
+	c.App.Store.Put(c.SessionID, session{})
+	sendLoginResult(c, "foo@example.com", "ott", 200, "OK")
+	if !c.PasswordPending {
+		t.Fatalf("password not required")
+	}
+	return c
+}
+
+func postPassword(c *context, password string) (int, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/login/password", strings.NewReader(url.Values{"password": {password}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s, _ := passwordHandler(&context{App: c.App, SessionID: c.SessionID}, w, r)
+	return s, w
+}
+
+func TestPasswordHandler(t *testing.T) {
+	c := testPasswordLogin(t)
+	c.App.CheckPassword = func(c *context, userID, password string) error {
+		if userID != "foo@example.com" || password != "secret" {
+			return errInvalidPassword
+		}
+		return nil
+	}
+	item, _ := c.App.Store.Get(c.SessionID)
+	if item.User != "" || item.Pending.UserID != "foo@example.com" {
+		t.Fatalf("session logged in before the password: %+v", item)
+	}
+	if url := successLoginURL(c); url != "/login/password" {
+		t.Errorf("successLoginURL = <%v>", url)
+	}
+
+	w := httptest.NewRecorder()
+	if s, _ := passwordHandler(c, w, mustRequest("GET", "/login/password")); s != 200 || !strings.Contains(w.Body.String(), `name="password"`) {
+		t.Fatalf("status = <%d> body = <%s>", s, w.Body.String())
+	}
+
+	if s, w := postPassword(c, "wrong"); s != 401 || !strings.Contains(w.Body.String(), "not correct") {
+		t.Fatalf("status = <%d> body = <%s>", s, w.Body.String())
+	}
+	if s, w := postPassword(c, "secret"); s != 302 || w.Header().Get("Location") != "/protected" {
+		t.Fatalf("status = <%d> location = <%v>", s, w.Header().Get("Location"))
+	}
+	item, _ = c.App.Store.Get(c.SessionID)
+	if item.User != "foo@example.com" || item.Pending.UserID != "" || time.Since(item.AuthTime) > time.Minute {
+		t.Errorf("session after the password = %+v", item)
+	}
+
+	// Logged in sessions pass through
+	w = httptest.NewRecorder()
+	if s, _ := passwordHandler(&context{App: c.App, SessionID: c.SessionID, LoggedUser: "foo@example.com"}, w, mustRequest("GET", "/login/password")); s != 302 || w.Header().Get("Location") != "/protected" {
+		t.Errorf("status = <%d> location = <%v>", s, w.Header().Get("Location"))
+	}
+}
+
+func TestPasswordHandlerTokens(t *testing.T) {
+	c := testPasswordLogin(t)
+	c.App.Tokens = testTokenIssuer(t)
+	c.App.CheckPassword = func(c *context, userID, password string) error { return nil }
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/login/password", strings.NewReader(url.Values{"password": {"secret"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	if s, _ := passwordHandler(&context{App: c.App, SessionID: c.SessionID}, w, r); s != 200 {
+		t.Fatalf("status = <%d> body = <%s>", s, w.Body.String())
+	}
+	var ret authRPAResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil || ret.UserId != "foo@example.com" || ret.RefreshToken == "" {
+		t.Fatalf("body = <%s> err = <%v>", w.Body.String(), err)
+	}
+	if claims, err := c.App.Tokens.Verify(ret.AccessToken); err != nil || claims.Subject != "foo@example.com" {
+		t.Errorf("claims = %+v err = <%v>", claims, err)
+	}
+}
+
+func TestPasswordHandlerAttempts(t *testing.T) {
+	c := testPasswordLogin(t)
+	c.App.CheckPassword = func(c *context, userID, password string) error { return errInvalidPassword }
+
+	for i := 1; i < passwordMaxAttempts; i++ {
+		if s, _ := postPassword(c, "wrong"); s != 401 {
+			t.Fatalf("attempt %d: status = <%d> want <401>", i, s)
+		}
+	}
+	if s, w := postPassword(c, "wrong"); s != 302 || w.Header().Get("Location") != "/" {
+		t.Fatalf("status = <%d> location = <%v> want <302> </>", s, w.Header().Get("Location"))
+	}
+	if _, ok := pendingUser(c); ok {
+		t.Errorf("login still pending after %d wrong passwords", passwordMaxAttempts)
+	}
+
+	// Expired pending logins go back to the PIN pad
+	c = testPasswordLogin(t)
+	item, _ := c.App.Store.Get(c.SessionID)
+	item.Pending.Started = time.Now().Add(-passwordStepTTL - time.Second)
+	c.App.Store.Put(c.SessionID, item)
+	if s, w := postPassword(c, "secret"); s != 302 || w.Header().Get("Location") != "/" {
+		t.Errorf("status = <%d> location = <%v> want <302> </>", s, w.Header().Get("Location"))
+	}
+}
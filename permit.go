@@ -0,0 +1,228 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"./ldap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mpinIdentity is the decoded M-Pin ID
+type mpinIdentity struct {
+	UserID string `json:"userID"`
+	Issued string `json:"issued"`
+	Mobile int    `json:"mobile"`
+	Salt   string `json:"salt"`
+}
+
+// decodeIdentity decodes the hex encoded JSON M-Pin ID
+func decodeIdentity(mpinID string) (id mpinIdentity, err error) {
+	b, err := hex.DecodeString(mpinID)
+	if err != nil {
+		return id, err
+	}
+	if err = json.Unmarshal(b, &id); err != nil {
+		return id, err
+	}
+	if id.UserID == "" {
+		return id, errors.New("Invalid identity, no userID")
+	}
+	return id, nil
+}
+
+// permitRules decide whether RPS may issue time permits to an identity
+type permitRules struct {
+	Allow []revocationRule
+	Deny  []revocationRule
+	// LDAP checks that the user exists and is neither disabled nor expired
+	LDAP bool
+	// LDAPGroup, when set, is the DN of the group the user must be member of
+	LDAPGroup string
+}
+
+func newPermitRules(o *options) (*permitRules, error) {
+	allow, err := parseUserList(o.PermitAllow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseUserList(o.PermitDeny)
+	if err != nil {
+		return nil, err
+	}
+	p := &permitRules{Allow: allow, Deny: deny, LDAP: o.PermitLDAP || o.PermitLDAPGroup != "", LDAPGroup: o.PermitLDAPGroup}
+	if len(p.Allow) == 0 && len(p.Deny) == 0 && !p.LDAP {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// parseUserList parses a comma separated list of userIds and @domains
+func parseUserList(s string) (l []revocationRule, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		rule, err := parseRevocationRule(entry, false)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, rule)
+	}
+	return
+}
+
+func matchAny(rules []revocationRule, userID string) bool {
+	for _, rule := range rules {
+		if rule.Match(userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the reason for denying time permits to the identity, or
+// "" when they may be issued
+func (p *permitRules) Check(c *context, id mpinIdentity) (reason string, err error) {
+	if p == nil {
+		return "", nil
+	}
+	if matchAny(p.Deny, id.UserID) {
+		return "User denied", nil
+	}
+	if len(p.Allow) > 0 && !matchAny(p.Allow, id.UserID) {
+		return "User not allowed", nil
+	}
+	if p.LDAP {
+		return p.checkLDAP(c, id.UserID)
+	}
+	return "", nil
+}
+
+func (p *permitRules) checkLDAP(c *context, userID string) (reason string, err error) {
+	conn, err := dialLDAP(c, userID)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf(c.App.Options.LDAPFilter, ldap.EscapeFilter(userID))
+	searchRequest := ldap.NewSearchRequest(c.App.Options.LDAPBaseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 1, 600, false, filter,
+		[]string{"nsAccountLock", "userAccountControl", "accountExpires", "shadowExpire", "memberOf"}, nil)
+	result, err := conn.Search(searchRequest)
+	if err != nil {
+		return "", err
+	}
+	if len(result.Entries) == 0 {
+		return "User not found in LDAP", nil
+	}
+	entry := result.Entries[0]
+	if ldapEntryDisabled(entry) {
+		return "User disabled", nil
+	}
+	if expires, ok := ldapAccountExpiry(entry); ok && expires.Before(time.Now()) {
+		return fmt.Sprintf("Account expired on %v", expires.Format(time.RFC3339)), nil
+	}
+	if p.LDAPGroup != "" && !ldapMemberOf(entry, p.LDAPGroup) {
+		return fmt.Sprintf("User not member of %v", p.LDAPGroup), nil
+	}
+	return "", nil
+}
+
+// Active Directory accountExpires values meaning "never"
+const adNeverExpires = 9223372036854775807
+
+// Seconds between 1601-01-01, the Active Directory epoch, and 1970-01-01
+const adEpochOffset = 11644473600
+
+// ldapAccountExpiry reads the expiry of the account from the AD
+// accountExpires or the shadowAccount shadowExpire attribute
+func ldapAccountExpiry(e *ldap.Entry) (time.Time, bool) {
+	if v := e.GetAttributeValue("accountExpires"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && n != 0 && n != adNeverExpires {
+			return time.Unix(n/10000000-adEpochOffset, 0), true
+		}
+	}
+	if v := e.GetAttributeValue("shadowExpire"); v != "" {
+		days, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && days >= 0 {
+			return time.Unix(days*24*60*60, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ldapMemberOf checks the memberOf attribute of the entry for the group DN
+func ldapMemberOf(e *ldap.Entry, groupDN string) bool {
+	return containsDN(e.GetAttributeValues("memberOf"), groupDN)
+}
+
+// containsDN reports whether dns contains dn, ignoring case and spaces
+func containsDN(dns []string, dn string) bool {
+	dn = strings.Replace(dn, " ", "", -1)
+	for _, d := range dns {
+		if strings.EqualFold(strings.Replace(d, " ", "", -1), dn) {
+			return true
+		}
+	}
+	return false
+}
+
+// ldapUserGroups returns the memberOf attribute of the user's entry
+func ldapUserGroups(c *context, userID string) ([]string, error) {
+	entry, err := ldapUserEntry(c, userID, []string{"memberOf"})
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return entry.GetAttributeValues("memberOf"), nil
+}
+
+// ldapUserEntry returns the attributes of the user's entry, or nil when the
+// user is not found
+func ldapUserEntry(c *context, userID string, attributes []string) (*ldap.Entry, error) {
+	conn, err := dialLDAP(c, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return ldapSearchUser(c, conn, userID, attributes)
+}
+
+// ldapSearchUser finds the user's entry with LDAPFilter on an open
+// connection
+func ldapSearchUser(c *context, conn *ldap.Conn, userID string, attributes []string) (*ldap.Entry, error) {
+	filter := fmt.Sprintf(c.App.Options.LDAPFilter, ldap.EscapeFilter(userID))
+	searchRequest := ldap.NewSearchRequest(c.App.Options.LDAPBaseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 1, 600, false, filter, attributes, nil)
+	result, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+	return result.Entries[0], nil
+}
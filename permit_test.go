@@ -0,0 +1,100 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"./ldap"
+	"net"
+	"testing"
+	"time"
+)
+
+func testMpinID(userID string) string {
+	return hex.EncodeToString([]byte(fmt.Sprintf(`{"userID": %q, "issued": "2016-01-02 15:04:05", "mobile": 0}`, userID)))
+}
+
+func TestPermitUserHandlerRules(t *testing.T) {
+	for userID, want := range map[string]int{
+		"bob@example.com": 200,
+		"eve@example.com": 403,
+		"bob@other.com":   403,
+	} {
+		c, w, r := prepare("GET", "/mpinPermitUser?mpin_id="+testMpinID(userID), new(bytes.Buffer))
+		c.App.Permit = &permitRules{}
+		c.App.Permit.Allow, _ = parseUserList("@example.com")
+		c.App.Permit.Deny, _ = parseUserList("eve@example.com")
+
+		if s, _ := permitUserHandler(c, w, r); s != want {
+			t.Errorf("%v: status = <%d> want <%d>", userID, s, want)
+		}
+	}
+}
+
+func TestPermitUserHandlerInvalidID(t *testing.T) {
+	c, w, r := prepare("GET", "/mpinPermitUser?mpin_id=zz", new(bytes.Buffer))
+	c.App.Permit = &permitRules{}
+
+	if s, _ := permitUserHandler(c, w, r); s != 400 {
+		t.Errorf("status = <%d> want <400>", s)
+	}
+}
+
+type searchPermit struct{}
+
+func (searchPermit) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	group := "cn=mpin,ou=groups,c=test"
+	entries := []*ldap.Entry{
+		&ldap.Entry{"uid=member,c=test", []*ldap.EntryAttribute{
+			&ldap.EntryAttribute{"uid", []string{"member"}, nil},
+			&ldap.EntryAttribute{"memberOf", []string{group}, nil},
+			&ldap.EntryAttribute{"accountExpires", []string{"9223372036854775807"}, nil},
+		}},
+		&ldap.Entry{"uid=other,c=test", []*ldap.EntryAttribute{
+			&ldap.EntryAttribute{"uid", []string{"other"}, nil},
+			&ldap.EntryAttribute{"memberOf", []string{"cn=staff,ou=groups,c=test"}, nil},
+		}},
+		&ldap.Entry{"uid=expired,c=test", []*ldap.EntryAttribute{
+			&ldap.EntryAttribute{"uid", []string{"expired"}, nil},
+			&ldap.EntryAttribute{"memberOf", []string{group}, nil},
+			&ldap.EntryAttribute{"shadowExpire", []string{fmt.Sprint(time.Now().Unix()/86400 - 1)}, nil},
+		}},
+		&ldap.Entry{"uid=disabled,c=test", []*ldap.EntryAttribute{
+			&ldap.EntryAttribute{"uid", []string{"disabled"}, nil},
+			&ldap.EntryAttribute{"memberOf", []string{group}, nil},
+			&ldap.EntryAttribute{"nsAccountLock", []string{"true"}, nil},
+		}},
+	}
+	return ldap.ServerSearchResult{entries, []string{}, []ldap.Control{}, ldap.LDAPResultSuccess}, nil
+}
+
+func TestPermitRulesLDAP(t *testing.T) {
+	defer startTestLDAP("127.0.0.1:10392", searchPermit{})()
+	c := testLDAPContext(10392)
+	p := &permitRules{LDAP: true, LDAPGroup: "cn=mpin, ou=groups, c=test"}
+
+	for userID, allowed := range map[string]bool{"member": true, "other": false, "expired": false, "disabled": false, "missing": false} {
+		reason, err := p.Check(c, mpinIdentity{UserID: userID})
+		if err != nil || (reason == "") != allowed {
+			t.Errorf("%v: reason = <%s> err = <%v> want allowed <%t>", userID, reason, err, allowed)
+		}
+	}
+}
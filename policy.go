@@ -0,0 +1,567 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+// Access policy
+//
+// A policy file lists rules evaluated in order; the first rule whose
+// condition holds decides. Without a matching rule the default applies.
+//
+//	# comment
+//	deny if phase == permit and domain == "contractor.com" and not group "cn=staff,ou=groups,dc=example,dc=com"
+//	allow if ip in (10.0.0.0/8, 192.168.0.0/16) and time in 07:00-20:00
+//	deny if device == mobile
+//	allow if user =~ "^admin-"
+//	default deny
+//
+// Conditions are combined with and, or, not and parentheses:
+//
+//	user == "id", user != "id", user =~ "regexp", user in ("a", "b")
+//	domain == "example.com", domain in (a.com, b.com)
+//	ip in 10.0.0.0/8             client IP in CIDR (or equal to an IP)
+//	time in 22:00-06:00          server local time of day window
+//	device == pc | mobile        from the M-Pin ID, when known
+//	phase == authenticate | permit
+//	group "cn=..."               LDAP memberOf of the user
+//	true, false
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	policyPhaseAuthenticate = "authenticate"
+	policyPhasePermit       = "permit"
+)
+
+// policyRequest holds the attributes a policy is evaluated against
+type policyRequest struct {
+	Phase  string
+	UserID string
+	IP     net.IP
+	// Device is "pc", "mobile" or "" when unknown
+	Device string
+	Time   time.Time
+
+	c      *context
+	groups []string
+	looked bool
+}
+
+// newPolicyRequest describes a login or time permit request. The client IP
+// is only known for requests sent by the browser.
+func newPolicyRequest(phase, userID, mpinID string, ip net.IP) *policyRequest {
+	r := &policyRequest{Phase: phase, UserID: userID, IP: ip}
+	if id, err := decodeIdentity(mpinID); err == nil {
+		if id.Mobile != 0 {
+			r.Device = "mobile"
+		} else {
+			r.Device = "pc"
+		}
+	}
+	return r
+}
+
+func (r *policyRequest) Domain() string {
+	if i := strings.LastIndex(r.UserID, "@"); i >= 0 {
+		return strings.ToLower(r.UserID[i+1:])
+	}
+	return ""
+}
+
+// Groups returns the LDAP groups of the user, looked up once per request
+func (r *policyRequest) Groups() ([]string, error) {
+	if r.looked {
+		return r.groups, nil
+	}
+	groups, err := ldapUserGroups(r.c, r.UserID)
+	if err != nil {
+		return nil, err
+	}
+	r.groups, r.looked = groups, true
+	return groups, nil
+}
+
+type policyCond func(r *policyRequest) (bool, error)
+
+type policyRule struct {
+	Allow bool
+	Cond  policyCond
+	Line  int
+	Text  string
+}
+
+// accessPolicy is a parsed policy file
+type accessPolicy struct {
+	Rules   []policyRule
+	Default bool
+}
+
+// loadAccessPolicy parses the policy file at path
+func loadAccessPolicy(path string) (*accessPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseAccessPolicy(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return p, nil
+}
+
+// parseAccessPolicy parses policy rules, one per line
+func parseAccessPolicy(s string) (*accessPolicy, error) {
+	p := &accessPolicy{Default: true}
+	for i, text := range strings.Split(s, "\n") {
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := p.parseLine(text, i+1); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+	return p, nil
+}
+
+func (p *accessPolicy) parseLine(text string, line int) error {
+	tokens, err := tokenizePolicy(text)
+	if err != nil {
+		return err
+	}
+	if tokens[0] == "default" {
+		if len(tokens) != 2 || (tokens[1] != "allow" && tokens[1] != "deny") {
+			return fmt.Errorf("want \"default allow\" or \"default deny\"")
+		}
+		p.Default = tokens[1] == "allow"
+		return nil
+	}
+
+	rule := policyRule{Line: line, Text: text}
+	switch tokens[0] {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return fmt.Errorf("rule must start with allow, deny or default, got %q", tokens[0])
+	}
+	if len(tokens) == 1 {
+		rule.Cond = func(*policyRequest) (bool, error) { return true, nil }
+	} else {
+		if tokens[1] != "if" {
+			return fmt.Errorf("want \"if\" after %v, got %q", tokens[0], tokens[1])
+		}
+		ps := &policyParser{tokens: tokens[2:]}
+		if rule.Cond, err = ps.parseOr(); err != nil {
+			return err
+		}
+		if ps.pos < len(ps.tokens) {
+			return fmt.Errorf("unexpected %q", ps.tokens[ps.pos])
+		}
+	}
+	p.Rules = append(p.Rules, rule)
+	return nil
+}
+
+// Evaluate returns whether the request is allowed and the rule that
+// decided, nil for the default
+func (p *accessPolicy) Evaluate(r *policyRequest) (allow bool, rule *policyRule, err error) {
+	for i := range p.Rules {
+		ok, err := p.Rules[i].Cond(r)
+		if err != nil {
+			return false, &p.Rules[i], err
+		}
+		if ok {
+			return p.Rules[i].Allow, &p.Rules[i], nil
+		}
+	}
+	return p.Default, nil, nil
+}
+
+// checkAccessPolicy evaluates the policy of the app. Denials are logged;
+// in shadow mode they are not enforced. Errors deny the request.
+func checkAccessPolicy(c *context, r *policyRequest) bool {
+	if c.App.Policy == nil {
+		return true
+	}
+	r.c = c
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	allow, rule, err := c.App.Policy.Evaluate(r)
+	decidedBy := "default"
+	if rule != nil {
+		decidedBy = fmt.Sprintf("line %d: %v", rule.Line, rule.Text)
+	}
+	if err != nil {
+		log.Printf("E %v %v Access policy evaluation failed at %v: %v", c.SessionID, r.UserID, decidedBy, err)
+		allow = false
+	}
+	if allow {
+		return true
+	}
+	if c.App.Options.PolicyShadow {
+		log.Printf("W %v %v Access policy would deny %v from %v (%v), shadow mode", c.SessionID, r.UserID, r.Phase, r.IP, decidedBy)
+		return true
+	}
+	log.Printf("W %v %v Access policy denied %v from %v (%v)", c.SessionID, r.UserID, r.Phase, r.IP, decidedBy)
+	return false
+}
+
+// tokenizePolicy splits a rule into words, quoted strings (kept with their
+// quotes), operators and parentheses
+func tokenizePolicy(s string) (tokens []string, err error) {
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+		case ch == '(' || ch == ')' || ch == ',':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="), strings.HasPrefix(s[i:], "=~"):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		default:
+			j := i
+			for ; j < len(s) && !strings.ContainsRune(" \t(),\"=!", rune(s[j])); j++ {
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q", string(ch))
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	return
+}
+
+type policyParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *policyParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *policyParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of rule")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *policyParser) expect(tok string) error {
+	got, err := p.next()
+	if err != nil {
+		return err
+	}
+	if got != tok {
+		return fmt.Errorf("want %q, got %q", tok, got)
+	}
+	return nil
+}
+
+func (p *policyParser) parseOr() (policyCond, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(r *policyRequest) (bool, error) {
+			if ok, err := l(r); ok || err != nil {
+				return ok, err
+			}
+			return right(r)
+		}
+	}
+	return left, nil
+}
+
+func (p *policyParser) parseAnd() (policyCond, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(r *policyRequest) (bool, error) {
+			if ok, err := l(r); !ok || err != nil {
+				return false, err
+			}
+			return right(r)
+		}
+	}
+	return left, nil
+}
+
+func (p *policyParser) parseUnary() (policyCond, error) {
+	switch p.peek() {
+	case "not":
+		p.pos++
+		cond, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *policyRequest) (bool, error) {
+			ok, err := cond(r)
+			return !ok, err
+		}, nil
+	case "(":
+		p.pos++
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return cond, p.expect(")")
+	}
+	return p.parseCond()
+}
+
+// parseValues parses a value or a parenthesized, comma separated list
+func (p *policyParser) parseValues() (values []string, err error) {
+	if p.peek() != "(" {
+		v, err := p.value()
+		return []string{v}, err
+	}
+	p.pos++
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok == ")" {
+			return values, nil
+		}
+		if tok != "," {
+			return nil, fmt.Errorf("want \",\" or \")\", got %q", tok)
+		}
+	}
+}
+
+func (p *policyParser) value() (string, error) {
+	tok, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(tok, "\"") {
+		return strconv.Unquote(tok)
+	}
+	if tok == "(" || tok == ")" || tok == "," {
+		return "", fmt.Errorf("unexpected %q", tok)
+	}
+	return tok, nil
+}
+
+// stringField returns the request attribute compared with ==, != and in
+func stringField(name string) func(r *policyRequest) string {
+	switch name {
+	case "user":
+		return func(r *policyRequest) string { return r.UserID }
+	case "domain":
+		return func(r *policyRequest) string { return r.Domain() }
+	case "device":
+		return func(r *policyRequest) string { return r.Device }
+	case "phase":
+		return func(r *policyRequest) string { return r.Phase }
+	}
+	return nil
+}
+
+func (p *policyParser) parseCond() (policyCond, error) {
+	name, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "true", "false":
+		v := name == "true"
+		return func(*policyRequest) (bool, error) { return v, nil }, nil
+	case "group":
+		dn, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *policyRequest) (bool, error) {
+			groups, err := r.Groups()
+			if err != nil {
+				return false, err
+			}
+			return containsDN(groups, dn), nil
+		}, nil
+	case "ip":
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		return p.parseIPIn()
+	case "time":
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		return p.parseTimeIn()
+	}
+
+	field := stringField(name)
+	if field == nil {
+		return nil, fmt.Errorf("unknown attribute %q", name)
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "==", "!=":
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		eq := op == "=="
+		return func(r *policyRequest) (bool, error) {
+			return strings.EqualFold(field(r), v) == eq, nil
+		}, nil
+	case "=~":
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *policyRequest) (bool, error) {
+			return re.MatchString(field(r)), nil
+		}, nil
+	case "in":
+		values, err := p.parseValues()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *policyRequest) (bool, error) {
+			for _, v := range values {
+				if strings.EqualFold(field(r), v) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q for %v", op, name)
+}
+
+func (p *policyParser) parseIPIn() (policyCond, error) {
+	values, err := p.parseValues()
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return func(r *policyRequest) (bool, error) {
+		for _, n := range nets {
+			if r.IP != nil && n.Contains(r.IP) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}, nil
+}
+
+func (p *policyParser) parseTimeIn() (policyCond, error) {
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(v, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid time window %q, want HH:MM-HH:MM", v)
+	}
+	var bounds [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window %q, want HH:MM-HH:MM", v)
+		}
+		bounds[i] = t.Hour()*60 + t.Minute()
+	}
+	from, to := bounds[0], bounds[1]
+	return func(r *policyRequest) (bool, error) {
+		now := r.Time.Hour()*60 + r.Time.Minute()
+		if from <= to {
+			return now >= from && now < to, nil
+		}
+		// The window spans midnight
+		return now >= from || now < to, nil
+	}, nil
+}
@@ -0,0 +1,132 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"./rpstest"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+const testPolicyRules = `
+# test policy
+deny if phase == permit and domain in (contractor.com, "temp.com")
+allow if user =~ "^admin-"
+deny if device == mobile and not ip in 10.0.0.0/8
+allow if ip in (10.0.0.0/8, 192.168.1.10) or (time in 08:00-18:00 and domain == "example.com")
+default deny
+`
+
+func TestAccessPolicyEvaluate(t *testing.T) {
+	p, err := parseAccessPolicy(testPolicyRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noon := time.Date(2016, 1, 4, 12, 0, 0, 0, time.Local)
+	night := time.Date(2016, 1, 4, 23, 0, 0, 0, time.Local)
+
+	for i, d := range []struct {
+		r     policyRequest
+		allow bool
+	}{
+		{policyRequest{Phase: "permit", UserID: "bob@contractor.com", IP: net.ParseIP("10.1.1.1")}, false},
+		{policyRequest{Phase: "authenticate", UserID: "bob@contractor.com", IP: net.ParseIP("10.1.1.1")}, true},
+		{policyRequest{Phase: "authenticate", UserID: "admin-bob@foo.com", Device: "mobile"}, true},
+		{policyRequest{Phase: "authenticate", UserID: "bob@example.com", Device: "mobile", IP: net.ParseIP("1.2.3.4"), Time: noon}, false},
+		{policyRequest{Phase: "authenticate", UserID: "bob@example.com", Device: "pc", IP: net.ParseIP("1.2.3.4"), Time: noon}, true},
+		{policyRequest{Phase: "authenticate", UserID: "bob@example.com", Device: "pc", IP: net.ParseIP("1.2.3.4"), Time: night}, false},
+		{policyRequest{Phase: "authenticate", UserID: "bob@foo.com", IP: net.ParseIP("192.168.1.10"), Time: night}, true},
+		{policyRequest{Phase: "authenticate", UserID: "bob@foo.com", IP: net.ParseIP("192.168.1.11"), Time: noon}, false},
+	} {
+		allow, _, err := p.Evaluate(&d.r)
+		if err != nil || allow != d.allow {
+			t.Errorf("case %d: allow = <%t> err = <%v> want <%t>", i, allow, err, d.allow)
+		}
+	}
+}
+
+func TestAccessPolicyTimeWindowMidnight(t *testing.T) {
+	p, _ := parseAccessPolicy("deny if time in 22:00-06:00")
+	for hour, allow := range map[int]bool{23: false, 3: false, 6: true, 12: true} {
+		r := policyRequest{Time: time.Date(2016, 1, 4, hour, 0, 0, 0, time.Local)}
+		if got, _, _ := p.Evaluate(&r); got != allow {
+			t.Errorf("%02d:00: allow = <%t> want <%t>", hour, got, allow)
+		}
+	}
+}
+
+func TestAccessPolicyParseErrors(t *testing.T) {
+	for _, rules := range []string{
+		"permit if true",
+		"allow when true",
+		"allow if user ~ bob",
+		"allow if color == red",
+		"allow if ip in 10.0.0.300/8",
+		"allow if time in 8-18",
+		"allow if (user == bob",
+		"allow if user == \"bob",
+		"allow if user == bob extra",
+		"default maybe",
+	} {
+		if _, err := parseAccessPolicy(rules); err == nil {
+			t.Errorf("%q: error expected", rules)
+		}
+	}
+}
+
+// Denials are sent to RPS, for the clients waiting for the login result
+func TestAuthenticateUserPolicy(t *testing.T) {
+	fake := rpstest.NewServer()
+	defer fake.Close()
+	body := `{"mpinResponse": {"authOTT": "1111111111111111111111111111111111111111111111111111111111111111"}}`
+	for _, shadow := range []bool{false, true} {
+		c, w, r := prepare("POST", "/mpinAuthenticate", bytes.NewBufferString(body))
+		c.App = testAppForRPS(fake.Host())
+		c.App.LoginResult = sendLoginResult
+		r.RemoteAddr = "1.2.3.4:5678"
+		opts := *c.App.Options
+		opts.PolicyShadow = shadow
+		c.App.Options = &opts
+		c.App.Policy, _ = parseAccessPolicy("allow if ip in 10.0.0.0/8\ndefault deny")
+		c.App.Authenticate = func(*context, string) (string, string, int) { return "foo", "OK", 200 }
+
+		want := 403
+		if shadow {
+			want = 200
+		}
+		var rq sendLoginResultReq
+		if s, _ := authenticateUserHandler(c, w, r); s != want {
+			t.Errorf("shadow %t: status = <%d> want <%d>", shadow, s, want)
+		}
+		if last, ok := fake.Last("/loginResult"); !ok || last.JSON(&rq) != nil || rq.Status != want {
+			t.Errorf("shadow %t: loginResult = <%d> want <%d>", shadow, rq.Status, want)
+		}
+	}
+}
+
+func TestPermitUserHandlerPolicy(t *testing.T) {
+	c, w, r := prepare("GET", "/mpinPermitUser?mpin_id="+testMpinID("bob@contractor.com"), new(bytes.Buffer))
+	c.App.Policy, _ = parseAccessPolicy("deny if phase == permit and domain == contractor.com")
+
+	if s, _ := permitUserHandler(c, w, r); s != 403 {
+		t.Errorf("status = <%d> want <403>", s)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Expired registrations are remembered this long, so that users asking for
+// the mail again learn that they have to register again
+const expiredMailKeep = 7 * 24 * time.Hour
+
+// activationMail is an activation mail sent for an identity, kept until
+// the identity is activated so it can be sent again
+type activationMail struct {
+	UserID         string
+	MpinID         string
+	DeviceName     string
+	ValidateURL    string
+	ActivationCode int
+	Expires        time.Time
+	Sends          int
+	LastSent       time.Time
+}
+
+// activationMails records the activation mails per mpinId
+type activationMails struct {
+	mu    sync.Mutex
+	mails map[string]*activationMail
+}
+
+func newActivationMails() *activationMails {
+	return &activationMails{mails: make(map[string]*activationMail)}
+}
+
+// Record adds a send of the mail of the identity and returns how many times
+// it was sent
+func (s *activationMails) Record(m activationMail) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, v := range s.mails {
+		if v.Expires.Add(expiredMailKeep).Before(now) {
+			delete(s.mails, k)
+		}
+	}
+	if m.Expires.IsZero() {
+		return 1
+	}
+	if prev, ok := s.mails[m.MpinID]; ok {
+		m.Sends = prev.Sends
+	}
+	m.Sends++
+	m.LastSent = now
+	s.mails[m.MpinID] = &m
+	return m.Sends
+}
+
+// Pending returns the mails of the user whose registration has not expired
+func (s *activationMails) Pending(userID string) []activationMail {
+	return s.find(userID, false)
+}
+
+// Expired returns the mails of the user whose registration has expired
+// before it was activated
+func (s *activationMails) Expired(userID string) []activationMail {
+	return s.find(userID, true)
+}
+
+func (s *activationMails) find(userID string, expired bool) (mails []activationMail) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, m := range s.mails {
+		if m.UserID == userID && m.Expires.Before(now) == expired {
+			mails = append(mails, *m)
+		}
+	}
+	return
+}
+
+// Remove forgets the mail of the identity, once it is activated or can not
+// be any more
+func (s *activationMails) Remove(mpinID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mails, mpinID)
+}
+
+// isResend reads the resend key of a verify request, which clients send as
+// a boolean or as a string like "on"
+func isResend(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		switch strings.ToLower(v) {
+		case "1", "on", "true", "yes":
+			return true
+		}
+	}
+	return false
+}
+
+// throttleResend limits activation mails sent again to the user, and from
+// the client IP unless ip is empty
+func throttleResend(c *context, w http.ResponseWriter, userID, ip string) (int, error) {
+	if ip != "" {
+		if ok, wait := c.App.ResendIPLimiter.Allow(ip); !ok {
+			atomic.AddInt64(&throttled, 1)
+			log.Printf("W %v %v Activation resend limit exceeded for %v", c.SessionID, userID, ip)
+			setRetryAfter(w, wait)
+			return 429, errTooManyRequests
+		}
+	}
+	if ok, wait := c.App.ResendUserLimiter.Allow(userID); !ok {
+		atomic.AddInt64(&throttled, 1)
+		log.Printf("W %v %v Activation resend limit exceeded", c.SessionID, userID)
+		setRetryAfter(w, wait)
+		return 429, errTooManyRequests
+	}
+	return 200, nil
+}
+
+// Send the activation mails of the pending registrations of a user again,
+// or tell the user to register again when they have expired. The answer
+// does not tell whether there were any.
+func resendActivationHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	data := make(map[string]interface{})
+	data["StaticURLBase"] = c.App.Options.StaticURLBase
+	data["UserID"] = r.FormValue("userId")
+	if r.Method == "GET" {
+		return renderTemplate(c.App, w, "resend.tmpl", data)
+	}
+
+	userID := strings.TrimSpace(r.PostFormValue("userId"))
+	if userID == "" || len(userID) > 256 {
+		data["Invalid"] = true
+		return renderTemplate(c.App, w, "resend.tmpl", data)
+	}
+	c.UserID = userID
+	if s, err := throttleResend(c, w, userID, clientIP(c, r)); err != nil {
+		return s, err
+	}
+	pending := c.App.ActivationMails.Pending(userID)
+	for _, m := range pending {
+		mailActivation(c, m)
+		m.Sends = c.App.ActivationMails.Record(m)
+		log.Printf("I %v %v Activation mail sent again for %v, send %d", c.SessionID, userID, m.MpinID, m.Sends)
+	}
+	if len(pending) == 0 {
+		mailRegistrationExpired(c, r, userID)
+	}
+	data["Sent"] = true
+	return renderTemplate(c.App, w, "resend.tmpl", data)
+}
+
+// mailRegistrationExpired tells the user that the registrations waiting
+// for activation have expired, and forgets them
+func mailRegistrationExpired(c *context, r *http.Request, userID string) {
+	expired := c.App.ActivationMails.Expired(userID)
+	if len(expired) == 0 {
+		log.Printf("D No pending registration to resend for user %v {%v}", userID, c.SessionID)
+		return
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	text := fmt.Sprintf("Your M-Pin registration has expired before it was activated. "+
+		"Please register again from the PIN pad at %v://%v/", proto, r.Host)
+	if err := c.App.Notify(userID, "M-Pin: Registration expired", text, c.App.Options); err != nil {
+		log.Printf("W %v %v Failed to send mail: %v", c.SessionID, userID, err)
+		return
+	}
+	for _, m := range expired {
+		c.App.ActivationMails.Remove(m.MpinID)
+	}
+	log.Printf("I %v %v Registration expired mail sent for %d identities", c.SessionID, userID, len(expired))
+}
@@ -0,0 +1,181 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsResend(t *testing.T) {
+	for _, d := range []struct {
+		v      interface{}
+		resend bool
+	}{
+		{true, true}, {false, false}, {"on", true}, {"true", true}, {"", false},
+		{"off", false}, {float64(1), true}, {float64(0), false}, {nil, false},
+	} {
+		if resend := isResend(d.v); resend != d.resend {
+			t.Errorf("isResend(%#v) = %v want %v", d.v, resend, d.resend)
+		}
+	}
+}
+
+func TestActivationMailsRecord(t *testing.T) {
+	mails := newActivationMails()
+	m := activationMail{UserID: "foo@example.com", MpinID: "aa", Expires: time.Now().Add(time.Hour)}
+	if sends := mails.Record(m); sends != 1 {
+		t.Errorf("sends = %d want 1", sends)
+	}
+	if sends := mails.Record(m); sends != 2 {
+		t.Errorf("sends = %d want 2", sends)
+	}
+	mails.Record(activationMail{UserID: "foo@example.com", MpinID: "bb", Expires: time.Now().Add(-time.Hour)})
+	if pending := mails.Pending("foo@example.com"); len(pending) != 1 || pending[0].MpinID != "aa" {
+		t.Errorf("pending = %+v", pending)
+	}
+	if pending := mails.Pending("bar@example.com"); len(pending) != 0 {
+		t.Errorf("pending = %+v", pending)
+	}
+	if expired := mails.Expired("foo@example.com"); len(expired) != 1 || expired[0].MpinID != "bb" {
+		t.Errorf("expired = %+v", expired)
+	}
+
+	mails.Remove("aa")
+	if pending := mails.Pending("foo@example.com"); len(pending) != 0 {
+		t.Errorf("pending = %+v after Remove", pending)
+	}
+}
+
+// testResendApp records the activation links mailed
+func testResendApp(sent *[]string) *app {
+	a := testApp()
+	opts := *a.Options
+	opts.ForceActivate = false
+	opts.LDAPVerify = false
+	a.Options = &opts
+	a.Templates = loadTemplates("./templates")
+	a.Mail = func(userID, deviceName, validateURL string, o *options) error {
+		*sent = append(*sent, validateURL)
+		return nil
+	}
+	a.ResendUserLimiter = newRateLimiterPer(2, time.Hour)
+	a.ResendIPLimiter = newRateLimiterPer(3, time.Hour)
+	return a
+}
+
+func TestVerifyUserResend(t *testing.T) {
+	var sent []string
+	a := testResendApp(&sent)
+	key := strings.Repeat("ab", 32)
+	verify := func(resend string) int {
+		body := fmt.Sprintf(`{"mpinId":"aa","userId":"foo@example.com","expireTime":"2100-01-01T00:00:00Z","mobile":1,"activateKey":%q,"resend":%v}`, key, resend)
+		c, w, r := prepare("POST", "/mpinVerify", bytes.NewBufferString(body))
+		c.App = a
+		s, _ := verifyUserHandler(c, w, r)
+		return s
+	}
+
+	if s := verify("false"); s != 200 || len(sent) != 1 {
+		t.Fatalf("status = <%d> sent = %v", s, sent)
+	}
+	for i := 0; i < 2; i++ {
+		if s := verify("true"); s != 200 || len(sent) != 2+i || sent[1+i] != sent[0] {
+			t.Fatalf("resend %d: status = <%d> sent = %v", i, s, sent)
+		}
+	}
+	if s := verify("true"); s != 429 || len(sent) != 3 {
+		t.Errorf("status = <%d> sent = %d want <429> 3", s, len(sent))
+	}
+	if pending := a.ActivationMails.Pending("foo@example.com"); len(pending) != 1 || pending[0].Sends != 3 {
+		t.Errorf("pending = %+v", pending)
+	}
+}
+
+func postResend(a *app, userID string) (int, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/activation/resend", strings.NewReader(url.Values{"userId": {userID}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "192.0.2.1:1234"
+	s, _ := resendActivationHandler(&context{App: a}, w, r)
+	return s, w
+}
+
+func TestResendActivationHandler(t *testing.T) {
+	var sent []string
+	a := testResendApp(&sent)
+	a.ActivationMails.Record(activationMail{
+		UserID: "foo@example.com", MpinID: "aa", DeviceName: "PC",
+		ValidateURL: "http://localhost/mpinActivate?i=aa", Expires: time.Now().Add(time.Hour),
+	})
+
+	w := httptest.NewRecorder()
+	if s, _ := resendActivationHandler(&context{App: a}, w, mustRequest("GET", "/activation/resend?userId=foo@example.com")); s != 200 || !strings.Contains(w.Body.String(), `value="foo@example.com"`) {
+		t.Fatalf("status = <%d> body = <%s>", s, w.Body.String())
+	}
+
+	s, w := postResend(a, "foo@example.com")
+	if s != 200 || len(sent) != 1 || sent[0] != "http://localhost/mpinActivate?i=aa" {
+		t.Fatalf("status = <%d> sent = %v", s, sent)
+	}
+	known := w.Body.String()
+
+	// Unknown users get the same answer
+	if s, w := postResend(a, "bar@example.com"); s != 200 || len(sent) != 1 || w.Body.String() != strings.Replace(known, "foo@", "bar@", -1) {
+		t.Errorf("status = <%d> body = <%s>", s, w.Body.String())
+	}
+
+	if s, _ := postResend(a, "baz@example.com"); s != 200 {
+		t.Fatalf("status = <%d>", s)
+	}
+	if s, _ := postResend(a, "foo@example.com"); s != 429 || len(sent) != 1 {
+		t.Errorf("status = <%d> sent = %d want <429> 1", s, len(sent))
+	}
+}
+
+func TestResendActivationExpired(t *testing.T) {
+	var sent []string
+	a := testResendApp(&sent)
+	var notified []string
+	a.Notify = func(userID, subject, text string, o *options) error {
+		notified = append(notified, subject)
+		return nil
+	}
+	a.ActivationMails.Record(activationMail{
+		UserID: "foo@example.com", MpinID: "aa", DeviceName: "PC",
+		ValidateURL: "http://localhost/mpinActivate?i=aa", Expires: time.Now().Add(-time.Hour),
+	})
+
+	// The expired link is not sent again, the user is told to register again
+	if s, _ := postResend(a, "foo@example.com"); s != 200 || len(sent) != 0 || len(notified) != 1 || notified[0] != "M-Pin: Registration expired" {
+		t.Fatalf("status = <%d> sent = %v notified = %v", s, sent, notified)
+	}
+	if expired := a.ActivationMails.Expired("foo@example.com"); len(expired) != 0 {
+		t.Errorf("expired = %+v", expired)
+	}
+	if s, _ := postResend(a, "foo@example.com"); s != 200 || len(notified) != 1 {
+		t.Errorf("status = <%d> notified = %v", s, notified)
+	}
+}
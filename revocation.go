@@ -0,0 +1,287 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"./ldap"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RevocationPolicy decides whether a user authenticated by RPS may log in.
+// Check returns 200 to allow the login, or the status to send to RPS and
+// the PIN pad instead:
+//
+//	403 - Login denied without deleting the client's token
+//	410 - Login denied permanently. The client's token is deleted
+type RevocationPolicy interface {
+	Check(c *context, userID string) (status int, message string, err error)
+}
+
+// revokedError is returned by sendLoginResult when a policy denied the login
+type revokedError struct {
+	Status  int
+	Message string
+}
+
+func (e *revokedError) Error() string {
+	return fmt.Sprintf("Login revoked (%d): %v", e.Status, e.Message)
+}
+
+// revocationChain applies the policies in order; the first denial wins
+type revocationChain []RevocationPolicy
+
+func (p revocationChain) Check(c *context, userID string) (int, string, error) {
+	for _, policy := range p {
+		if status, message, err := policy.Check(c, userID); err != nil || status != 200 {
+			return status, message, err
+		}
+	}
+	return 200, "", nil
+}
+
+// newRevocationPolicy builds the policy from the options. It returns nil
+// when no revocation check is configured.
+func newRevocationPolicy(o *options) (RevocationPolicy, error) {
+	var chain revocationChain
+	if o.RevokeDenylist != "" {
+		denylist := &denylistPolicy{Path: o.RevokeDenylist}
+		if err := denylist.reload(); err != nil {
+			return nil, err
+		}
+		chain = append(chain, denylist)
+	}
+	if o.RevokeRules != "" {
+		rules, err := parseRevocationRules(o.RevokeRules)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, rules)
+	}
+	if o.RevokeLDAP {
+		chain = append(chain, ldapPolicy{})
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// checkRevocation consults the revocation policy of the app. When the
+// check fails the login is denied with 403, unless fail open is set.
+func checkRevocation(c *context, userID string) (status int, message string) {
+	if c.App.Revocation == nil {
+		return 200, ""
+	}
+	status, message, err := c.App.Revocation.Check(c, userID)
+	if err != nil {
+		log.Printf("E %v %v Revocation check failed: %v", c.SessionID, userID, err)
+		if c.App.Options.RevokeFailOpen {
+			return 200, ""
+		}
+		return 403, "Revocation check failed"
+	}
+	if status != 200 {
+		log.Printf("W %v %v Login revoked with status %v: %v", c.SessionID, userID, status, message)
+	}
+	return status, message
+}
+
+// revocationRule matches userIds by domain or regular expression
+type revocationRule struct {
+	Domain string
+	Regexp *regexp.Regexp
+	Status int
+}
+
+func (r revocationRule) Match(userID string) bool {
+	if r.Domain != "" {
+		return strings.HasSuffix(strings.ToLower(userID), "@"+r.Domain)
+	}
+	return r.Regexp.MatchString(userID)
+}
+
+// parseRevocationRule parses "[status] pattern", where pattern is @domain,
+// a userId (in a denylist) or, when regexps is set, a regular expression.
+// The status defaults to 403.
+func parseRevocationRule(entry string, regexps bool) (rule revocationRule, err error) {
+	fields := strings.Fields(entry)
+	rule.Status = 403
+	if len(fields) == 2 {
+		if rule.Status, err = strconv.Atoi(fields[0]); err != nil || (rule.Status != 403 && rule.Status != 410) {
+			return rule, fmt.Errorf("Invalid revocation status in %q, want 403 or 410", entry)
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return rule, fmt.Errorf("Invalid revocation rule %q", entry)
+	}
+	pattern := fields[0]
+	switch {
+	case strings.HasPrefix(pattern, "@"):
+		rule.Domain = strings.ToLower(strings.TrimPrefix(pattern, "@"))
+	case regexps:
+		if rule.Regexp, err = regexp.Compile(pattern); err != nil {
+			return rule, fmt.Errorf("Invalid revocation rule %q: %v", entry, err)
+		}
+	default:
+		rule.Regexp = regexp.MustCompile("^" + regexp.QuoteMeta(pattern) + "$")
+	}
+	return
+}
+
+// rulesPolicy denies userIds matching a list of domain or regexp rules
+type rulesPolicy []revocationRule
+
+// parseRevocationRules parses rules separated by ';'
+func parseRevocationRules(s string) (rulesPolicy, error) {
+	var p rulesPolicy
+	for _, entry := range strings.Split(s, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		rule, err := parseRevocationRule(entry, true)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, rule)
+	}
+	return p, nil
+}
+
+func (p rulesPolicy) Check(c *context, userID string) (int, string, error) {
+	for _, rule := range p {
+		if rule.Match(userID) {
+			return rule.Status, "User not authorized", nil
+		}
+	}
+	return 200, "", nil
+}
+
+// denylistPolicy denies the userIds and @domains listed in a file, one per
+// line, optionally preceded by the status. Lines starting with # are
+// ignored. The file is read again when it changes.
+type denylistPolicy struct {
+	Path string
+
+	mu      sync.Mutex
+	rules   []revocationRule
+	modTime time.Time
+}
+
+func (p *denylistPolicy) Check(c *context, userID string) (int, string, error) {
+	if err := p.reload(); err != nil {
+		return 0, "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rule := range p.rules {
+		if rule.Match(userID) {
+			return rule.Status, "User not authorized", nil
+		}
+	}
+	return 200, "", nil
+}
+
+// reload reads the file if it changed since it was last read
+func (p *denylistPolicy) reload() error {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if info.ModTime().Equal(p.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rules []revocationRule
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		rule, err := parseRevocationRule(entry, false)
+		if err != nil {
+			return fmt.Errorf("%v:%d: %v", p.Path, line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	p.rules = rules
+	p.modTime = info.ModTime()
+	log.Printf("I Loaded %d revocation entries from %v", len(rules), p.Path)
+	return nil
+}
+
+// Active Directory userAccountControl flag of disabled accounts
+const adAccountDisable = 0x2
+
+// ldapPolicy denies users whose directory entry is missing or disabled,
+// with nsAccountLock (389 DS, OpenDJ) or the AD userAccountControl flag
+type ldapPolicy struct{}
+
+func (ldapPolicy) Check(c *context, userID string) (int, string, error) {
+	conn, err := dialLDAP(c, userID)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf(c.App.Options.LDAPFilter, ldap.EscapeFilter(userID))
+	searchRequest := ldap.NewSearchRequest(c.App.Options.LDAPBaseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 1, 600, false, filter,
+		[]string{"nsAccountLock", "userAccountControl"}, nil)
+	result, err := conn.Search(searchRequest)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(result.Entries) == 0 {
+		return 403, "User not found", nil
+	}
+	if ldapEntryDisabled(result.Entries[0]) {
+		return 403, "User disabled", nil
+	}
+	return 200, "", nil
+}
+
+func ldapEntryDisabled(e *ldap.Entry) bool {
+	if strings.EqualFold(e.GetAttributeValue("nsAccountLock"), "true") {
+		return true
+	}
+	if uac, err := strconv.Atoi(e.GetAttributeValue("userAccountControl")); err == nil && uac&adAccountDisable != 0 {
+		return true
+	}
+	return false
+}
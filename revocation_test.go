@@ -0,0 +1,206 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"./ldap"
+	"./rpstest"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testPolicy struct {
+	status int
+	err    error
+}
+
+func (p testPolicy) Check(c *context, userID string) (int, string, error) {
+	return p.status, "denied by test", p.err
+}
+
+func TestRevocationRules(t *testing.T) {
+	p, err := parseRevocationRules("@Example.com; 410 ^guest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for userID, want := range map[string]int{
+		"bob@example.COM":     403,
+		"guest-1@foo.com":     410,
+		"bob@example.com.org": 200,
+		"bob@foo.com":         200,
+	} {
+		if s, _, _ := p.Check(nil, userID); s != want {
+			t.Errorf("%v: status = <%d> want <%d>", userID, s, want)
+		}
+	}
+
+	for _, rules := range []string{"500 @example.com", "403 a b", "(["} {
+		if _, err := parseRevocationRules(rules); err == nil {
+			t.Errorf("%q: error expected", rules)
+		}
+	}
+}
+
+func TestDenylistReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "denylist")
+	ioutil.WriteFile(path, []byte("# revoked\nbob@example.com\n410 @evil.com\n"), 0600)
+
+	p := &denylistPolicy{Path: path}
+	for userID, want := range map[string]int{"bob@example.com": 403, "eve@evil.com": 410, "bob.b@example.com": 200} {
+		if s, _, err := p.Check(nil, userID); s != want || err != nil {
+			t.Errorf("%v: status = <%d> err = <%v> want <%d>", userID, s, err, want)
+		}
+	}
+
+	ioutil.WriteFile(path, []byte("alice@example.com\n"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if s, _, _ := p.Check(nil, "bob@example.com"); s != 200 {
+		t.Errorf("status = <%d> want <200> after reload", s)
+	}
+	if s, _, _ := p.Check(nil, "alice@example.com"); s != 403 {
+		t.Errorf("status = <%d> want <403> after reload", s)
+	}
+}
+
+func TestCheckRevocationFailure(t *testing.T) {
+	c := context{App: testApp()}
+	opts := *c.App.Options
+	c.App.Options = &opts
+	c.App.Revocation = testPolicy{err: errors.New("LDAP down")}
+
+	if s, _ := checkRevocation(&c, "foo"); s != 403 {
+		t.Errorf("status = <%d> want <403>", s)
+	}
+	opts.RevokeFailOpen = true
+	if s, _ := checkRevocation(&c, "foo"); s != 200 {
+		t.Errorf("status = <%d> want <200> with fail open", s)
+	}
+}
+
+func TestSendLoginResultRevoked(t *testing.T) {
+	fake := rpstest.NewServer()
+	defer fake.Close()
+	c := context{App: testAppForRPS(fake.Host()), SessionID: "345"}
+	c.App.Revocation = revocationChain{testPolicy{status: 200}, testPolicy{status: 410}}
+
+	err := sendLoginResult(&c, "foo", "ott", 200, "OK")
+	if revoked, ok := err.(*revokedError); !ok || revoked.Status != 410 {
+		t.Fatalf("err = <%v> want revokedError with status 410", err)
+	}
+	r, ok := fake.Last("/loginResult")
+	if !ok {
+		t.Fatal("/loginResult not called")
+	}
+	var rq sendLoginResultReq
+	if err := r.JSON(&rq); err != nil || rq.Status != 410 {
+		t.Errorf("request = <%s> err = <%v>", r.Body, err)
+	}
+	if _, err := c.App.Store.Get("345"); err == nil {
+		t.Error("session stored for a revoked user")
+	}
+}
+
+func TestAuthenticateUserRevoked(t *testing.T) {
+	body := `{"mpinResponse": {"authOTT": "1111111111111111111111111111111111111111111111111111111111111111"}}`
+	c, w, r := prepare("POST", "/mpinAuthenticate", bytes.NewBufferString(body))
+	c.App.Authenticate = func(*context, string) (string, string, int) { return "foo", "OK", 200 }
+	c.App.LoginResult = func(*context, string, string, int, string) error {
+		return &revokedError{Status: 410, Message: "User not authorized"}
+	}
+
+	if s, _ := authenticateUserHandler(c, w, r); s != 410 {
+		t.Fatalf("status = <%d> want <410>", s)
+	}
+}
+
+type searchLocked struct{}
+
+func (searchLocked) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	entries := []*ldap.Entry{
+		&ldap.Entry{"uid=active,o=testers,c=test", []*ldap.EntryAttribute{
+			&ldap.EntryAttribute{"uid", []string{"active"}, nil},
+			&ldap.EntryAttribute{"userAccountControl", []string{"512"}, nil},
+		}},
+		&ldap.Entry{"uid=disabled,o=testers,c=test", []*ldap.EntryAttribute{
+			&ldap.EntryAttribute{"uid", []string{"disabled"}, nil},
+			&ldap.EntryAttribute{"userAccountControl", []string{"514"}, nil},
+		}},
+		&ldap.Entry{"uid=locked,o=testers,c=test", []*ldap.EntryAttribute{
+			&ldap.EntryAttribute{"uid", []string{"locked"}, nil},
+			&ldap.EntryAttribute{"nsAccountLock", []string{"TRUE"}, nil},
+		}},
+	}
+	return ldap.ServerSearchResult{entries, []string{}, []ldap.Control{}, ldap.LDAPResultSuccess}, nil
+}
+
+// startTestLDAP runs an LDAP server on addr until stop is called
+func startTestLDAP(addr string, search ldap.Searcher) (stop func()) {
+	quit := make(chan bool)
+	go func() {
+		s := ldap.NewServer()
+		s.EnforceLDAP = true
+		s.QuitChannel(quit)
+		s.SearchFunc("", search)
+		s.BindFunc("", bindAnonOK{})
+		s.ListenAndServe(addr)
+	}()
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return func() { quit <- true }
+}
+
+// testLDAPContext returns a context using the LDAP server on port
+func testLDAPContext(port int) *context {
+	c := context{App: testApp()}
+	opts := *c.App.Options
+	opts.LDAPServer = "127.0.0.1"
+	opts.LDAPPort = port
+	opts.LDAPFilter = "(uid=%s)"
+	c.App.Options = &opts
+	return &c
+}
+
+func TestLDAPPolicy(t *testing.T) {
+	defer startTestLDAP("127.0.0.1:10391", searchLocked{})()
+	c := testLDAPContext(10391)
+
+	for userID, want := range map[string]int{"active": 200, "disabled": 403, "locked": 403, "missing": 403} {
+		s, _, err := ldapPolicy{}.Check(c, userID)
+		if err != nil || s != want {
+			t.Errorf("%v: status = <%d> err = <%v> want <%d>", userID, s, err, want)
+		}
+	}
+}
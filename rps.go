@@ -0,0 +1,263 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RPSClient talks to the RPS JSON API. It is created once per app and
+// shares its transport (and so its connection pool) with the RPS proxy.
+type RPSClient struct {
+	Pool      *rpsPool
+	Transport *http.Transport
+	Client    *http.Client
+	Retries   int
+	Backoff   time.Duration
+	Breaker   *circuitBreaker
+	// Fetch is used by the typed methods. It defaults to Do; the app
+	// routes it through app.Fetch so handlers can be tested without RPS.
+	Fetch func(url, method string, q, d interface{}) error
+}
+
+// rpsError is returned when RPS answers with an error status
+type rpsError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *rpsError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Error code %v", e.StatusCode)
+	}
+	return fmt.Sprintf("Error code %v: %v", e.StatusCode, e.Message)
+}
+
+const rpsErrorBodyLimit = 4096
+
+func newRPSClient(o *options, tlsConfig *tls.Config) *RPSClient {
+	timeout := o.RPSTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	rc := &RPSClient{
+		Pool:      newRPSPool(o.RPSSchema, o.RPSHost, o.RPSBalance),
+		Transport: transport,
+		Client:    &http.Client{Transport: transport, Timeout: timeout},
+		Retries:   o.RPSRetries,
+		Backoff:   o.RPSRetryBackoff,
+		Breaker:   newCircuitBreaker(o.RPSBreakerThreshold, o.RPSBreakerCooldown),
+	}
+	rc.Fetch = rc.Do
+	return rc
+}
+
+// URL returns the full RPS URL for the given path on one of the backends
+func (rc *RPSClient) URL(path string) string {
+	return rc.urlFor(rc.Pool.Pick().Host, path)
+}
+
+// SessionURL returns the URL on the backend pinned to the session
+func (rc *RPSClient) SessionURL(sessionID, path string) string {
+	return rc.urlFor(rc.Pool.ForSession(sessionID).Host, path)
+}
+
+func (rc *RPSClient) urlFor(host, path string) string {
+	return fmt.Sprintf("%v://%v/%v", rc.Pool.Schema, host, strings.TrimLeft(path, "/"))
+}
+
+// Do sends q as JSON and decodes the response into d (when not nil).
+// Idempotent methods are retried while RPS is unavailable, that is on
+// network errors and 5xx responses, moving to the next backend when
+// there is one. Other methods only fail over when the connection could
+// not be established. The outcome is fed to the breaker.
+func (rc *RPSClient) Do(rawurl, method string, q, d interface{}) (err error) {
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	if err = rc.Breaker.Allow(); err != nil {
+		return
+	}
+
+	attempts := 1
+	if isIdempotent(method) && rc.Retries > 0 {
+		attempts += rc.Retries
+	}
+	if n := len(rc.Pool.Backends); attempts < n {
+		attempts = n
+	}
+
+	var unavailable bool
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if !isIdempotent(method) && !isDialError(err) {
+				break
+			}
+			host := u.Host
+			if isDialError(err) {
+				rc.Pool.MarkDown(host)
+			}
+			u.Host = rc.Pool.Failover(host)
+			if u.Host == host {
+				wait := rc.Backoff << uint(i-1)
+				log.Printf("W RPS %v %v failed: %v; retry %d/%d in %v", method, u, err, i, attempts-1, wait)
+				time.Sleep(wait)
+			} else {
+				log.Printf("W RPS %v %v failed: %v; failing over to %v", method, host, err, u.Host)
+			}
+		}
+		unavailable, err = rc.do(u.String(), method, payload, d)
+		if !unavailable {
+			break
+		}
+	}
+	if unavailable {
+		rc.Breaker.Failure()
+	} else {
+		rc.Breaker.Success()
+	}
+	return
+}
+
+func (rc *RPSClient) do(rawurl, method string, payload []byte, d interface{}) (unavailable bool, err error) {
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := rc.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 399 {
+		return resp.StatusCode >= 500, decodeRPSError(resp)
+	}
+	if d == nil {
+		// Drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(d); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// decodeRPSError extracts the message from an RPS error body. RPS answers
+// either with a JSON object carrying "message" or "error", or plain text.
+func decodeRPSError(resp *http.Response) error {
+	e := &rpsError{StatusCode: resp.StatusCode}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, rpsErrorBodyLimit))
+	if err != nil || len(bytes.TrimSpace(body)) == 0 {
+		return e
+	}
+	var data struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal(body, &data) == nil {
+		if data.Message != "" {
+			e.Message = data.Message
+		} else {
+			e.Message = data.Error
+		}
+		return e
+	}
+	e.Message = strings.TrimSpace(string(body))
+	return e
+}
+
+func isDialError(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	oe, ok := err.(*net.OpError)
+	return ok && oe.Op == "dial"
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// Authenticate verifies authOTT against RPS
+func (rc *RPSClient) Authenticate(authOTT, sessionID, logoutToken string) (resp authRPSResponse, err error) {
+	var req authRPSRequest
+	req.AuthOTT = authOTT
+	req.LogoutData.SessionToken = logoutToken
+	// The authOTT pin wins, it may come from pass 2 of the mobile app
+	host := rc.Pool.ForKeys("ott:"+authOTT, sessionID).Host
+	err = rc.Fetch(rc.urlFor(host, "/authenticate"), "POST", &req, &resp)
+	return
+}
+
+// LoginResult reports the final login status to RPS, on the backend that
+// authenticated the session
+func (rc *RPSClient) LoginResult(sessionID string, req *sendLoginResultReq) error {
+	return rc.Fetch(rc.SessionURL(sessionID, "/loginResult"), "POST", req, nil)
+}
+
+// ActivateUser activates the identity in RPS
+func (rc *RPSClient) ActivateUser(identity, activateKey string) error {
+	var q struct {
+		ActivateKey string `json:"activateKey"`
+	}
+	q.ActivateKey = activateKey
+	return rc.Fetch(rc.URL("/user/"+identity), "POST", &q, nil)
+}
+
+// DeleteUser revokes the identity in RPS
+func (rc *RPSClient) DeleteUser(identity string) error {
+	return rc.Fetch(rc.URL("/user/"+identity), "DELETE", nil, nil)
+}
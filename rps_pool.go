@@ -0,0 +1,340 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+)
+
+type rpsBackend struct {
+	Host   string
+	Proxy  *httputil.ReverseProxy
+	down   int32
+	active int64
+}
+
+func (b *rpsBackend) Healthy() bool {
+	return atomic.LoadInt32(&b.down) == 0
+}
+
+func (b *rpsBackend) setHealthy(healthy bool) {
+	var down int32
+	if !healthy {
+		down = 1
+	}
+	if atomic.SwapInt32(&b.down, down) != down {
+		if healthy {
+			log.Printf("I RPS backend %v is up", b.Host)
+		} else {
+			log.Printf("W RPS backend %v is down", b.Host)
+		}
+	}
+}
+
+type stickyEntry struct {
+	Backend *rpsBackend
+	Expires time.Time
+}
+
+// rpsPool balances requests over the configured RPS backends. Requests of
+// the same session are pinned to one backend, because an authOTT can only
+// be completed on the RPS that issued it. The mobile app sends no session
+// cookie, so its requests are pinned by the mpin_id, access number and
+// authOTT they carry instead.
+type rpsPool struct {
+	Schema    string
+	Backends  []*rpsBackend
+	Balance   string
+	StickyTTL time.Duration
+
+	next    uint32
+	mu      sync.Mutex
+	sticky  map[string]stickyEntry
+	gcCount int
+}
+
+// newRPSPool creates a pool from a comma separated list of hosts
+func newRPSPool(schema, hosts, balance string) *rpsPool {
+	p := &rpsPool{
+		Schema:    schema,
+		Balance:   balance,
+		StickyTTL: 30 * time.Minute,
+		sticky:    make(map[string]stickyEntry),
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			p.Backends = append(p.Backends, &rpsBackend{Host: host})
+		}
+	}
+	if len(p.Backends) == 0 {
+		p.Backends = append(p.Backends, &rpsBackend{Host: hosts})
+	}
+	return p
+}
+
+// Pick selects a backend according to the balancing mode, skipping
+// unhealthy backends unless all of them are down
+func (p *rpsPool) Pick() *rpsBackend {
+	return p.pick(nil)
+}
+
+func (p *rpsPool) pick(exclude *rpsBackend) *rpsBackend {
+	var candidates []*rpsBackend
+	for _, b := range p.Backends {
+		if b != exclude && b.Healthy() {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, b := range p.Backends {
+			if b != exclude {
+				candidates = append(candidates, b)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return exclude
+	}
+
+	if p.Balance == balanceLeastConn {
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			if atomic.LoadInt64(&b.active) < atomic.LoadInt64(&best.active) {
+				best = b
+			}
+		}
+		return best
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return candidates[int(n-1)%len(candidates)]
+}
+
+// Failover returns another backend to try after host failed. When there is
+// no other backend the same host is returned.
+func (p *rpsPool) Failover(host string) string {
+	b := p.backend(host)
+	if b == nil {
+		return host
+	}
+	return p.pick(b).Host
+}
+
+// ForSession returns the backend pinned to the session, pinning one when
+// the session has none yet or its backend went down
+func (p *rpsPool) ForSession(sessionID string) *rpsBackend {
+	return p.ForKeys(sessionID)
+}
+
+// ForKeys returns the backend pinned to the first of keys that has a live
+// pin and pins all the keys to it. A new backend is picked when none of the
+// keys is pinned yet.
+func (p *rpsPool) ForKeys(keys ...string) *rpsBackend {
+	if len(p.Backends) == 1 {
+		return p.Pick()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var b *rpsBackend
+	for _, k := range keys {
+		if e, ok := p.sticky[k]; ok && k != "" && !e.Expires.Before(now) && e.Backend.Healthy() {
+			b = e.Backend
+			break
+		}
+	}
+	if b == nil {
+		b = p.pick(nil)
+	}
+	p.pin(b, now, keys)
+	return b
+}
+
+// Pin pins keys to the backend
+func (p *rpsPool) Pin(b *rpsBackend, keys ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pin(b, time.Now(), keys)
+}
+
+func (p *rpsPool) pin(b *rpsBackend, now time.Time, keys []string) {
+	for _, k := range keys {
+		if k != "" {
+			p.sticky[k] = stickyEntry{Backend: b, Expires: now.Add(p.StickyTTL)}
+		}
+	}
+
+	p.gcCount++
+	if p.gcCount >= 1000 {
+		for k, v := range p.sticky {
+			if v.Expires.Before(now) {
+				delete(p.sticky, k)
+			}
+		}
+		p.gcCount = 0
+	}
+}
+
+func (p *rpsPool) backend(host string) *rpsBackend {
+	for _, b := range p.Backends {
+		if b.Host == host {
+			return b
+		}
+	}
+	return nil
+}
+
+// MarkDown takes the backend out of rotation until a health check succeeds
+func (p *rpsPool) MarkDown(host string) {
+	if b := p.backend(host); b != nil && len(p.Backends) > 1 {
+		b.setHealthy(false)
+	}
+}
+
+// ServeHTTP proxies the request to the backend pinned to the session cookie
+// or to the flow values the request carries. Values issued in the response
+// are pinned to the same backend, so the next leg of the flow follows it.
+func (p *rpsPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	if r.Body != nil {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		keys = rpsPinKeys(body)
+	}
+	if mpinID := r.URL.Query().Get("mpin_id"); mpinID != "" {
+		keys = append(keys, "mpin:"+mpinID)
+	}
+	if cookie, err := r.Cookie("mpindemo_session"); err == nil {
+		keys = append(keys, cookie.Value)
+	}
+
+	b := p.ForKeys(keys...)
+	atomic.AddInt64(&b.active, 1)
+	defer atomic.AddInt64(&b.active, -1)
+	rw := &pinResponseWriter{ResponseWriter: w}
+	b.Proxy.ServeHTTP(rw, r)
+	if issued := rpsPinKeys(rw.body.Bytes()); len(issued) > 0 {
+		p.Pin(b, issued...)
+	}
+}
+
+// rpsPinKeys returns the pinning keys for the flow values in a JSON body.
+// The authOTT comes first because it must be completed where it was issued,
+// then the mpin_id which pass 2 must send to the backend of pass 1.
+func rpsPinKeys(body []byte) (keys []string) {
+	var m struct {
+		AuthOTT      string `json:"authOTT"`
+		MpinID       string `json:"mpin_id"`
+		WID          string `json:"WID"`
+		AccessNumber string `json:"accessNumber"`
+		MpinResponse struct {
+			AuthOTT string `json:"authOTT"`
+		} `json:"mpinResponse"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &m) != nil {
+		return nil
+	}
+	for _, ott := range []string{m.AuthOTT, m.MpinResponse.AuthOTT} {
+		if ott != "" {
+			keys = append(keys, "ott:"+ott)
+		}
+	}
+	if m.MpinID != "" {
+		keys = append(keys, "mpin:"+m.MpinID)
+	}
+	for _, an := range []string{m.WID, m.AccessNumber} {
+		if an != "" {
+			keys = append(keys, "an:"+an)
+		}
+	}
+	return
+}
+
+// pinResponseWriter keeps the start of the response body for rpsPinKeys
+type pinResponseWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *pinResponseWriter) Write(b []byte) (int, error) {
+	if n := 4096 - w.body.Len(); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		w.body.Write(b[:n])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type backendStatus struct {
+	Host    string `json:"host"`
+	Healthy bool   `json:"healthy"`
+	Active  int64  `json:"active"`
+}
+
+func (p *rpsPool) Status() (status []backendStatus) {
+	for _, b := range p.Backends {
+		status = append(status, backendStatus{b.Host, b.Healthy(), atomic.LoadInt64(&b.active)})
+	}
+	return
+}
+
+// HealthCheck requests path on every backend and updates its state
+func (p *rpsPool) HealthCheck(client *http.Client, path string) {
+	for _, b := range p.Backends {
+		url := fmt.Sprintf("%v://%v/%v", p.Schema, b.Host, strings.TrimLeft(path, "/"))
+		resp, err := client.Get(url)
+		if err != nil {
+			log.Printf("W RPS health check %v failed: %v", url, err)
+			b.setHealthy(false)
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		b.setHealthy(resp.StatusCode < 500)
+	}
+}
+
+// StartHealthChecks runs HealthCheck every interval in the background
+func (p *rpsPool) StartHealthChecks(client *http.Client, path string, interval time.Duration) {
+	if interval <= 0 || len(p.Backends) < 2 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			p.HealthCheck(client, path)
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"./rpstest"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedHost returns an address nothing listens on
+func closedHost(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := l.Addr().String()
+	l.Close()
+	return host
+}
+
+func TestRPSPoolRoundRobin(t *testing.T) {
+	p := newRPSPool("http", "a:1, b:2", balanceRoundRobin)
+	if len(p.Backends) != 2 {
+		t.Fatalf("len(backends) = <%d> want <%d>", len(p.Backends), 2)
+	}
+	first, second := p.Pick().Host, p.Pick().Host
+	if first == second {
+		t.Errorf("round robin picked <%s> twice", first)
+	}
+
+	p.MarkDown("a:1")
+	for i := 0; i < 4; i++ {
+		if host := p.Pick().Host; host != "b:2" {
+			t.Errorf("picked <%s>, want healthy backend <b:2>", host)
+		}
+	}
+}
+
+func TestRPSPoolLeastConn(t *testing.T) {
+	p := newRPSPool("http", "a:1,b:2", balanceLeastConn)
+	p.Backends[0].active = 3
+	p.Backends[1].active = 1
+	if host := p.Pick().Host; host != "b:2" {
+		t.Errorf("picked <%s> want <%s>", host, "b:2")
+	}
+}
+
+func TestRPSPoolSticky(t *testing.T) {
+	p := newRPSPool("http", "a:1,b:2,c:3", balanceRoundRobin)
+	b := p.ForSession("session")
+	for i := 0; i < 5; i++ {
+		if host := p.ForSession("session").Host; host != b.Host {
+			t.Fatalf("session moved from <%s> to <%s>", b.Host, host)
+		}
+	}
+	p.MarkDown(b.Host)
+	if host := p.ForSession("session").Host; host == b.Host {
+		t.Errorf("session still pinned to unhealthy backend <%s>", host)
+	}
+}
+
+func TestRPSPoolHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	up := strings.TrimPrefix(server.URL, "http://")
+	down := closedHost(t)
+
+	p := newRPSPool("http", up+","+down, balanceRoundRobin)
+	p.HealthCheck(&http.Client{Timeout: time.Second}, "/clientSettings")
+
+	if !p.Backends[0].Healthy() || p.Backends[1].Healthy() {
+		t.Errorf("status = <%+v>", p.Status())
+	}
+}
+
+func TestRPSClientFailover(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": 200, "userId": "foo"}`))
+	}))
+	defer server.Close()
+	down := closedHost(t)
+
+	o := options{
+		RPSSchema:  "http",
+		RPSHost:    down + "," + strings.TrimPrefix(server.URL, "http://"),
+		RPSTimeout: time.Second,
+	}
+	rc := newRPSClient(&o, nil)
+
+	var resp authRPSResponse
+	if err := rc.Do(rc.urlFor(down, "/authenticate"), "POST", nil, &resp); err != nil {
+		t.Fatalf("POST did not fail over: %v", err)
+	}
+	if resp.UserID != "foo" {
+		t.Errorf("userId = <%s> want <%s>", resp.UserID, "foo")
+	}
+	if rc.Pool.Backends[0].Healthy() {
+		t.Error("unreachable backend should be marked down")
+	}
+}
+
+func TestRPSPoolMobileFlow(t *testing.T) {
+	fakes := []*rpstest.Server{rpstest.NewServer(), rpstest.NewServer()}
+	for _, fake := range fakes {
+		defer fake.Close()
+	}
+	a := testAppForRPS(fakes[0].Host() + "," + fakes[1].Host())
+
+	// post sends a mobile app request, without session cookie, through the proxy
+	post := func(path string, q interface{}) (backend int, resp map[string]interface{}) {
+		body, _ := json.Marshal(q)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "http://rpa.example.com/rps"+path, bytes.NewReader(body))
+		c := context{App: a}
+		if s, err := rpsProxyHandler(&c, w, r); s != 200 || err != nil {
+			t.Fatalf("%v status = <%d> err = <%v>", path, s, err)
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		backend = -1
+		for i, fake := range fakes {
+			if _, ok := fake.Last(path); ok {
+				backend = i
+			}
+			fake.Reset()
+		}
+		return
+	}
+
+	for _, mpinID := range []string{"mobile1", "mobile2", "mobile3"} {
+		first, _ := post("/pass1", map[string]string{"mpin_id": mpinID})
+		second, resp := post("/pass2", map[string]string{"mpin_id": mpinID, "WID": "1234567"})
+		if second != first {
+			t.Fatalf("%v pass2 on backend <%d> want <%d>", mpinID, second, first)
+		}
+		authOTT, _ := resp["authOTT"].(string)
+		if authOTT == "" {
+			t.Fatalf("%v pass2 returned no authOTT: <%v>", mpinID, resp)
+		}
+		mpinResponse := map[string]interface{}{"mpinResponse": map[string]string{"authOTT": authOTT}}
+		if third, _ := post("/authenticate", mpinResponse); third != first {
+			t.Fatalf("%v authenticate on backend <%d> want <%d>", mpinID, third, first)
+		}
+		if host := a.RPS.Pool.ForKeys("ott:"+authOTT, "other-session").Host; host != fakes[first].Host() {
+			t.Errorf("%v authOTT pinned to <%s> want <%s>", mpinID, host, fakes[first].Host())
+		}
+	}
+}
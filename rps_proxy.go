@@ -0,0 +1,155 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// Paths the PIN pad and the mobile app need on RPS, relative to the proxy
+// prefix. Every URL of /clientSettings must be covered.
+const defaultRPSAllow = "GET /clientSettings; POST,PUT /user; GET,PUT /user/*; GET /signature/*; GET /timePermit/*; " +
+	"POST /pass1; POST /pass2; POST /getAccessNumber; POST /accessnumber; GET,POST /codeStatus; " +
+	"POST /authenticate; POST /getQrUrl"
+
+type rpsRoute struct {
+	Methods []string
+	Path    string
+	Prefix  bool
+}
+
+// rpsAllowlist lists the RPS paths and methods the browser may reach
+// through the proxy. A nil list allows everything.
+type rpsAllowlist []rpsRoute
+
+// parseRPSAllowlist parses entries separated by ';', each made of comma
+// separated methods and a path. A path ending with '*' matches by prefix
+// and '*' as method matches any method. An empty string or a single '*'
+// entry disables the check.
+func parseRPSAllowlist(s string) (l rpsAllowlist, err error) {
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Fields(entry)
+		if len(fields) == 1 && fields[0] == "*" {
+			return nil, nil
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid RPS allow entry %q, want \"METHODS /path\"", entry)
+		}
+		var route rpsRoute
+		for _, m := range strings.Split(fields[0], ",") {
+			if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+				route.Methods = append(route.Methods, m)
+			}
+		}
+		route.Path = fields[1]
+		if strings.HasSuffix(route.Path, "*") {
+			route.Prefix = true
+			route.Path = strings.TrimSuffix(route.Path, "*")
+		}
+		l = append(l, route)
+	}
+	return
+}
+
+// Allowed reports whether method may be used on the RPS path (without the
+// proxy prefix)
+func (l rpsAllowlist) Allowed(method, path string) bool {
+	if l == nil {
+		return true
+	}
+	for _, route := range l {
+		if route.Prefix {
+			if !strings.HasPrefix(path, route.Path) {
+				continue
+			}
+		} else if path != route.Path {
+			continue
+		}
+		for _, m := range route.Methods {
+			if m == "*" || m == method {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Request headers set by the proxy; copies sent by the client are dropped
+var rpsForwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded", "RPS-BASE-URL"}
+
+func newRPSProxy(a *app, b *rpsBackend) *httputil.ReverseProxy {
+	host := b.Host
+	strip := strings.Split(a.Options.RPSStripResponseHeaders, ",")
+
+	director := func(req *http.Request) {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		publicHost := req.Host
+
+		req.URL.Scheme = a.Options.RPSSchema
+		req.URL.Host = host
+
+		for _, h := range rpsForwardedHeaders {
+			req.Header.Del(h)
+		}
+		// X-Forwarded-For is filled in by the ReverseProxy with the client address
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", publicHost)
+		// RPS passes this back on /mpinVerify to build activation links
+		req.Header.Set("RPS-BASE-URL", fmt.Sprintf("%v://%v", proto, publicHost))
+
+		stripCookie(req, "mpindemo_session")
+	}
+
+	modifyResponse := func(resp *http.Response) error {
+		for _, h := range strip {
+			if h = strings.TrimSpace(h); h != "" {
+				resp.Header.Del(h)
+			}
+		}
+		return nil
+	}
+
+	return &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      &breakerTransport{Transport: a.RPS.Transport, Breaker: a.RPS.Breaker},
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   rpsProxyErrorHandler(a, b),
+	}
+}
+
+// stripCookie removes the named cookie from the request, keeping the others
+func stripCookie(req *http.Request, name string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			req.AddCookie(cookie)
+		}
+	}
+}
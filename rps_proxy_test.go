@@ -0,0 +1,194 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"./rpstest"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRPSAllowlist(t *testing.T) {
+	l, err := parseRPSAllowlist(defaultRPSAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		Method  string
+		Path    string
+		Allowed bool
+	}{
+		{"GET", "/clientSettings", true},
+		{"POST", "/clientSettings", false},
+		{"GET", "/user/1234", true},
+		{"POST", "/user/1234", false},
+		{"POST", "/pass1", true},
+		{"POST", "/loginResult", false},
+		{"POST", "/authenticate", true},
+		{"GET", "/authenticate", false},
+	}
+	for _, c := range cases {
+		if l.Allowed(c.Method, c.Path) != c.Allowed {
+			t.Errorf("Allowed(%v, %v) = <%t> want <%t>", c.Method, c.Path, !c.Allowed, c.Allowed)
+		}
+	}
+}
+
+// The clients use every URL RPS gives in /clientSettings
+func TestRPSAllowlistClientSettings(t *testing.T) {
+	l, err := parseRPSAllowlist(defaultRPSAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Method and path suffix the clients use with each URL
+	requests := map[string][][2]string{
+		"registerURL":           {{"PUT", ""}, {"POST", ""}, {"GET", "/aa"}},
+		"signatureURL":          {{"GET", "/aa"}},
+		"timePermitsURL":        {{"GET", "/aa"}},
+		"mpinAuthServerURL":     {{"POST", "/pass1"}, {"POST", "/pass2"}},
+		"accessNumberURL":       {{"POST", ""}},
+		"getAccessNumberURL":    {{"POST", ""}},
+		"getQrUrl":              {{"POST", ""}},
+		"mobileAuthenticateURL": {{"POST", ""}},
+	}
+
+	w := httptest.NewRecorder()
+	rpstest.NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/rps/clientSettings", nil))
+	var settings map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &settings); err != nil {
+		t.Fatal(err)
+	}
+	for key, v := range settings {
+		u, ok := v.(string)
+		if !ok || !strings.HasPrefix(u, "/rps") {
+			continue
+		}
+		reqs, ok := requests[key]
+		if !ok {
+			t.Errorf("No request known for %v", key)
+		}
+		for _, req := range reqs {
+			if path := strings.TrimPrefix(u, "/rps") + req[1]; !l.Allowed(req[0], path) {
+				t.Errorf("%v: %v %v not allowed", key, req[0], path)
+			}
+		}
+	}
+}
+
+func TestRPSAllowlistAll(t *testing.T) {
+	for _, s := range []string{"", "*", " * "} {
+		l, err := parseRPSAllowlist(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !l.Allowed("DELETE", "/anything") {
+			t.Errorf("%q should allow everything", s)
+		}
+	}
+}
+
+func TestRPSAllowlistInvalid(t *testing.T) {
+	if _, err := parseRPSAllowlist("GET"); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func testProxyApp(t *testing.T, handler http.HandlerFunc) (*app, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	return testAppForRPS(strings.TrimPrefix(server.URL, "http://")), server
+}
+
+func TestRPSProxyHeaders(t *testing.T) {
+	var got *http.Request
+	a, server := testProxyApp(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Server", "TornadoServer")
+		w.Header().Set("Set-Cookie", "rps=1")
+		w.Write([]byte(`{}`))
+	})
+	defer server.Close()
+
+	c := context{App: a}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://rpa.example.com/rps/clientSettings", nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Set("RPS-BASE-URL", "http://evil.example.com")
+	r.AddCookie(&http.Cookie{Name: "mpindemo_session", Value: "secret"})
+	r.AddCookie(&http.Cookie{Name: "other", Value: "kept"})
+
+	if s, err := rpsProxyHandler(&c, w, r); s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v>", s, err)
+	}
+	if got == nil {
+		t.Fatal("request not forwarded")
+	}
+	if xff := got.Header.Get("X-Forwarded-For"); xff != "192.0.2.1" {
+		t.Errorf("X-Forwarded-For = <%s> want <%s>", xff, "192.0.2.1")
+	}
+	if base := got.Header.Get("RPS-BASE-URL"); base != "http://rpa.example.com" {
+		t.Errorf("RPS-BASE-URL = <%s> want <%s>", base, "http://rpa.example.com")
+	}
+	if host := got.Header.Get("X-Forwarded-Host"); host != "rpa.example.com" {
+		t.Errorf("X-Forwarded-Host = <%s> want <%s>", host, "rpa.example.com")
+	}
+	if _, err := got.Cookie("mpindemo_session"); err == nil {
+		t.Error("session cookie forwarded to RPS")
+	}
+	if cookie, err := got.Cookie("other"); err != nil || cookie.Value != "kept" {
+		t.Errorf("other cookie = <%v> err = <%v>", cookie, err)
+	}
+	if w.Header().Get("Server") != "" || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("response headers not filtered: %v", w.Header())
+	}
+}
+
+func TestRPSProxyNotAllowed(t *testing.T) {
+	a, server := testProxyApp(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not be forwarded")
+	})
+	defer server.Close()
+
+	c := context{App: a}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/rps/loginResult", new(bytes.Buffer))
+
+	if s, _ := rpsProxyHandler(&c, w, r); s != 403 {
+		t.Errorf("status = <%d> want <%d>", s, 403)
+	}
+}
+
+func TestRPSProxyBodyLimit(t *testing.T) {
+	a, server := testProxyApp(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not be forwarded")
+	})
+	defer server.Close()
+	a.Options.RPSMaxBody = 10
+
+	c := context{App: a}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/rps/pass1", strings.NewReader(`{"too": "large"}`))
+
+	if s, _ := rpsProxyHandler(&c, w, r); s != 413 {
+		t.Errorf("status = <%d> want <%d>", s, 413)
+	}
+}
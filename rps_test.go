@@ -0,0 +1,136 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRPSClient(server *httptest.Server) *RPSClient {
+	o := options{
+		RPSSchema:       "http",
+		RPSHost:         strings.TrimPrefix(server.URL, "http://"),
+		RPSTimeout:      200 * time.Millisecond,
+		RPSRetries:      2,
+		RPSRetryBackoff: time.Millisecond,
+	}
+	return newRPSClient(&o, nil)
+}
+
+// testAppForRPS returns an app talking to the RPS on host
+func testAppForRPS(host string) *app {
+	a := testApp()
+	opts := *a.Options
+	opts.RPSHost = host
+	a.Options = &opts
+	a.Fetch = fetchJSON
+	a.RPS = newRPSClient(&opts, nil)
+	for _, b := range a.RPS.Pool.Backends {
+		b.Proxy = newRPSProxy(a, b)
+	}
+	a.RpsProxy = a.RPS.Pool
+	a.RPSAllow, _ = parseRPSAllowlist(opts.RPSAllow)
+	return a
+}
+
+func TestRPSClientRetryIdempotent(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status": 200}`))
+	}))
+	defer server.Close()
+
+	rc := testRPSClient(server)
+	var d authRPSResponse
+	if err := rc.Do(rc.URL("/clientSettings"), "GET", nil, &d); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("calls = <%d> want <%d>", calls, 3)
+	}
+	if d.Status != 200 {
+		t.Errorf("status = <%d> want <%d>", d.Status, 200)
+	}
+}
+
+func TestRPSClientNoRetryPost(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	rc := testRPSClient(server)
+	if _, err := rc.Authenticate("ott", "session", "token"); err == nil {
+		t.Error("error expected")
+	}
+	if calls != 1 {
+		t.Errorf("calls = <%d> want <%d>", calls, 1)
+	}
+}
+
+func TestRPSClientErrorBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "User not found"}`))
+	}))
+	defer server.Close()
+
+	rc := testRPSClient(server)
+	err := rc.ActivateUser("1234", "5678")
+	errMessage := "Error code 404: User not found"
+	if err == nil || err.Error() != errMessage {
+		t.Errorf("err = <%s> want <%s>", err, errMessage)
+	}
+	if e, ok := err.(*rpsError); !ok || e.StatusCode != http.StatusNotFound {
+		t.Errorf("err = <%#v> want *rpsError with status 404", err)
+	}
+}
+
+func TestRPSClientTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	rc := testRPSClient(server)
+	rc.Retries = 0
+	start := time.Now()
+	if err := rc.LoginResult("session", &sendLoginResultReq{AuthOTT: "ott"}); err == nil {
+		t.Error("error expected")
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("request took <%v>, timeout not applied", elapsed)
+	}
+}
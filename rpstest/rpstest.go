@@ -0,0 +1,289 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+
+/*
+Package rpstest provides an in-process fake RPS for tests and local
+development.
+
+The fake answers the RPS endpoints used by the RPA (/authenticate,
+/loginResult, /user/{mpinId}) and by the PIN pad through the RPA proxy
+(/clientSettings, /user, /signature, /timePermit, /pass1, /pass2 and the
+access number and mobile endpoints), with or without the RPS prefix. Answers can be
+scripted per path and every received request is recorded.
+*/
+package rpstest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Raw is written to the response body verbatim, e.g. to send malformed JSON
+type Raw string
+
+// Response is a scripted answer. Body is encoded as JSON unless it is Raw.
+type Response struct {
+	Status int
+	Body   interface{}
+	Delay  time.Duration
+}
+
+// Auth returns the answer of /authenticate for the given login status
+// (200, 401, 403, 408 or 410). Like RPS, the status is sent in the body
+// of a 200 response.
+func Auth(status int, userID string) Response {
+	return Response{
+		Status: 200,
+		Body: map[string]interface{}{
+			"status":  status,
+			"userId":  userID,
+			"message": http.StatusText(status),
+		},
+	}
+}
+
+// AuthOTP is like Auth, for an RPS with the requestOTP option set
+func AuthOTP(status int, userID, otp string, ttlSeconds int) Response {
+	resp := Auth(status, userID)
+	body := resp.Body.(map[string]interface{})
+	body["otp"] = otp
+	body["ttlSeconds"] = ttlSeconds
+	return resp
+}
+
+// Request is a request received by the fake
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+	Time   time.Time
+}
+
+// JSON decodes the request body into v
+func (r Request) JSON(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Handler is the fake RPS. It can be mounted on any server; NewServer
+// starts one on a local port.
+type Handler struct {
+	// Prefix is stripped from request paths when present
+	Prefix string
+	// UserID is returned by /authenticate when no answer is scripted
+	UserID string
+
+	mu        sync.Mutex
+	scripted  map[string][]Response
+	requests  []Request
+	activated map[string]bool
+}
+
+func NewHandler() *Handler {
+	return &Handler{
+		Prefix:    "rps",
+		UserID:    "test@example.com",
+		scripted:  make(map[string][]Response),
+		activated: make(map[string]bool),
+	}
+}
+
+// Server is a fake RPS listening on a local port
+type Server struct {
+	*Handler
+	*httptest.Server
+}
+
+func NewServer() *Server {
+	h := NewHandler()
+	return &Server{Handler: h, Server: httptest.NewServer(h)}
+}
+
+// Host returns the address to use as the RPA rps-host option
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// Script queues answers for the path (without prefix). They are used in
+// order; the last one is repeated until the path is scripted again.
+func (h *Handler) Script(path string, responses ...Response) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.scripted[path] = responses
+}
+
+// Requests returns the requests received so far
+func (h *Handler) Requests() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Request(nil), h.requests...)
+}
+
+// Last returns the last request received for the path (without prefix)
+func (h *Handler) Last(path string) (r Request, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.requests) - 1; i >= 0; i-- {
+		if h.requests[i].Path == path {
+			return h.requests[i], true
+		}
+	}
+	return
+}
+
+// Activated reports whether the RPA has activated the identity
+func (h *Handler) Activated(mpinID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.activated[mpinID]
+}
+
+// Reset forgets recorded requests, scripted answers and activations
+func (h *Handler) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.scripted = make(map[string][]Response)
+	h.requests = nil
+	h.activated = make(map[string]bool)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if h.Prefix != "" {
+		path = strings.TrimPrefix(path, "/"+h.Prefix)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	resp, ok := h.record(Request{Method: r.Method, Path: path, Header: r.Header, Body: body, Time: time.Now()})
+	if !ok {
+		resp = h.answer(r.Method, path, body)
+	}
+	if resp.Delay > 0 {
+		time.Sleep(resp.Delay)
+	}
+	write(w, resp)
+}
+
+// record stores the request and returns the scripted answer for it, if any
+func (h *Handler) record(r Request) (resp Response, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests = append(h.requests, r)
+	queue, ok := h.scripted[r.Path]
+	if !ok || len(queue) == 0 {
+		return resp, false
+	}
+	resp = queue[0]
+	if len(queue) > 1 {
+		h.scripted[r.Path] = queue[1:]
+	}
+	return resp, true
+}
+
+// answer implements the default behaviour of every endpoint
+func (h *Handler) answer(method, path string, body []byte) Response {
+	prefix := ""
+	if h.Prefix != "" {
+		prefix = "/" + h.Prefix
+	}
+	switch {
+	case path == "/clientSettings":
+		return Response{Status: 200, Body: map[string]interface{}{
+			"registerURL":           prefix + "/user",
+			"signatureURL":          prefix + "/signature",
+			"timePermitsURL":        prefix + "/timePermit",
+			"mpinAuthServerURL":     prefix,
+			"accessNumberURL":       prefix + "/accessnumber",
+			"getAccessNumberURL":    prefix + "/getAccessNumber",
+			"getQrUrl":              prefix + "/getQrUrl",
+			"authenticateURL":       "/mpinAuthenticate",
+			"mobileAuthenticateURL": prefix + "/authenticate",
+			"requestOTP":            false,
+		}}
+	case path == "/authenticate":
+		return Auth(200, h.UserID)
+	case path == "/loginResult":
+		return Response{Status: 200, Body: map[string]interface{}{}}
+	case path == "/user" && (method == "PUT" || method == "POST"):
+		return Response{Status: 200, Body: map[string]interface{}{
+			"mpinId": randomHex(32),
+			"active": false,
+		}}
+	case strings.HasPrefix(path, "/user/"):
+		mpinID := strings.TrimPrefix(path, "/user/")
+		if method == "POST" {
+			var q struct {
+				ActivateKey string `json:"activateKey"`
+			}
+			if err := json.Unmarshal(body, &q); err != nil || q.ActivateKey == "" {
+				return Response{Status: 400, Body: map[string]string{"message": "Invalid activateKey"}}
+			}
+			h.mu.Lock()
+			h.activated[mpinID] = true
+			h.mu.Unlock()
+			return Response{Status: 200, Body: map[string]interface{}{}}
+		}
+		return Response{Status: 200, Body: map[string]interface{}{"active": h.Activated(mpinID)}}
+	case strings.HasPrefix(path, "/signature/"):
+		return Response{Status: 200, Body: map[string]interface{}{"clientSecretShare": randomHex(64), "params": ""}}
+	case strings.HasPrefix(path, "/timePermit/"):
+		return Response{Status: 200, Body: map[string]interface{}{"timePermit": randomHex(64)}}
+	case path == "/pass1":
+		return Response{Status: 200, Body: map[string]interface{}{"y": randomHex(32)}}
+	case path == "/pass2":
+		return Response{Status: 200, Body: map[string]interface{}{"authOTT": randomHex(32)}}
+	case path == "/getAccessNumber":
+		return Response{Status: 200, Body: map[string]interface{}{"accessNumber": "1234567", "ttlSeconds": 60}}
+	case path == "/getQrUrl":
+		return Response{Status: 200, Body: map[string]interface{}{"qrUrl": "http://localhost/#1234567", "ttlSeconds": 60}}
+	case path == "/accessnumber", path == "/codeStatus":
+		return Response{Status: 200, Body: map[string]interface{}{"status": "wid"}}
+	}
+	return Response{Status: 404, Body: map[string]string{"message": "Not found"}}
+}
+
+func write(w http.ResponseWriter, resp Response) {
+	status := resp.Status
+	if status == 0 {
+		status = 200
+	}
+	if raw, ok := resp.Body.(Raw); ok {
+		w.WriteHeader(status)
+		w.Write([]byte(raw))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if resp.Body != nil {
+		json.NewEncoder(w).Encode(resp.Body)
+	}
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,128 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package rpstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func post(t *testing.T, url string, v interface{}) *http.Response {
+	b, _ := json.Marshal(v)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAuthenticateDefault(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	resp := post(t, s.URL+"/authenticate", map[string]string{"authOTT": "1234"})
+	defer resp.Body.Close()
+	var d struct {
+		Status int    `json:"status"`
+		UserID string `json:"userId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != 200 || d.UserID != s.UserID {
+		t.Errorf("response = <%+v>", d)
+	}
+
+	r, ok := s.Last("/authenticate")
+	if !ok {
+		t.Fatal("request not recorded")
+	}
+	var q struct {
+		AuthOTT string `json:"authOTT"`
+	}
+	if err := r.JSON(&q); err != nil || q.AuthOTT != "1234" {
+		t.Errorf("recorded body = <%s> err = <%v>", r.Body, err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Script("/authenticate", Auth(401, ""), Response{Status: 200, Body: Raw("{not json")})
+
+	resp := post(t, s.URL+"/rps/authenticate", nil)
+	var d struct {
+		Status int `json:"status"`
+	}
+	json.NewDecoder(resp.Body).Decode(&d)
+	resp.Body.Close()
+	if d.Status != 401 {
+		t.Errorf("status = <%d> want <%d>", d.Status, 401)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp = post(t, s.URL+"/authenticate", nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "{not json" {
+			t.Errorf("body = <%s> want malformed JSON", body)
+		}
+	}
+	if n := len(s.Requests()); n != 3 {
+		t.Errorf("len(requests) = <%d> want <%d>", n, 3)
+	}
+}
+
+func TestScriptDelay(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Script("/loginResult", Response{Status: 503, Delay: 50 * time.Millisecond})
+	start := time.Now()
+	resp := post(t, s.URL+"/loginResult", nil)
+	resp.Body.Close()
+	if resp.StatusCode != 503 {
+		t.Errorf("status = <%d> want <%d>", resp.StatusCode, 503)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("delay not applied")
+	}
+}
+
+func TestActivateUser(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	resp := post(t, s.URL+"/user/abcd", map[string]string{"activateKey": "1234"})
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !s.Activated("abcd") {
+		t.Errorf("status = <%d>, identity not activated", resp.StatusCode)
+	}
+
+	resp = post(t, s.URL+"/user/ef01", map[string]string{})
+	resp.Body.Close()
+	if resp.StatusCode != 400 || s.Activated("ef01") {
+		t.Errorf("status = <%d> want <%d>", resp.StatusCode, 400)
+	}
+}
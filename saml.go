@@ -0,0 +1,664 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	xmlDSigNS       = "http://www.w3.org/2000/09/xmldsig#"
+
+	samlRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPOSTBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	samlNameIDEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	samlNameIDUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+	xmlExcC14N          = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	xmlEnvelopedSig     = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	xmlDigestSHA256     = "http://www.w3.org/2001/04/xmlenc#sha256"
+	xmlSigRSASHA256     = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	xmlSigECDSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	samlTimeFormat      = "2006-01-02T15:04:05Z"
+	samlMaxRequestBytes = 64 * 1024
+)
+
+// samlServiceProvider is a service provider registered in the -saml-sps
+// file
+type samlServiceProvider struct {
+	EntityID string `json:"entity_id"`
+	Name     string `json:"name,omitempty"`
+	// ACSURLs are the assertion consumer service URLs, the first one is
+	// used when the request does not name one and for IdP-initiated login
+	ACSURLs      []string `json:"acs_urls"`
+	NameIDFormat string   `json:"name_id_format,omitempty"`
+	// Attributes maps LDAP attributes of the user to SAML attribute names
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// RelayState is sent with IdP-initiated logins
+	RelayState string `json:"relay_state,omitempty"`
+}
+
+// ACSURL returns the registered ACS URL matching url exactly, or the first
+// one when url is empty
+func (sp *samlServiceProvider) ACSURL(url string) (string, bool) {
+	if url == "" {
+		return sp.ACSURLs[0], true
+	}
+	for _, u := range sp.ACSURLs {
+		if u == url {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// DisplayName returns the name of the service provider shown to users
+func (sp *samlServiceProvider) DisplayName() string {
+	if sp.Name != "" {
+		return sp.Name
+	}
+	return sp.EntityID
+}
+
+// samlIdP signs the assertions of the users logged in with the PIN pad for
+// the registered service providers
+type samlIdP struct {
+	EntityID string
+	// URL is the base URL of the SAML endpoints
+	URL  string
+	SPs  map[string]*samlServiceProvider
+	Key  *signingKey
+	Cert *x509.Certificate
+	TTL  time.Duration
+}
+
+// newSAMLIdP returns nil when no SAML URL is configured
+func newSAMLIdP(o *options) (*samlIdP, error) {
+	if o.SAMLURL == "" {
+		return nil, nil
+	}
+	idp := &samlIdP{
+		EntityID: o.SAMLEntityID,
+		URL:      strings.TrimSuffix(o.SAMLURL, "/"),
+		SPs:      make(map[string]*samlServiceProvider),
+		TTL:      o.SAMLAssertionTTL,
+	}
+	if idp.EntityID == "" {
+		idp.EntityID = idp.URL + "/saml/metadata"
+	}
+	if o.SAMLServiceProviders != "" {
+		data, err := ioutil.ReadFile(o.SAMLServiceProviders)
+		if err != nil {
+			return nil, err
+		}
+		var sps []*samlServiceProvider
+		if err := json.Unmarshal(data, &sps); err != nil {
+			return nil, fmt.Errorf("Invalid SAML service providers %v: %v", o.SAMLServiceProviders, err)
+		}
+		for _, sp := range sps {
+			if sp.EntityID == "" || len(sp.ACSURLs) == 0 {
+				return nil, fmt.Errorf("SAML service provider %q needs entity_id and acs_urls", sp.EntityID)
+			}
+			idp.SPs[sp.EntityID] = sp
+		}
+	}
+	var err error
+	if o.SAMLCert == "" && o.SAMLKey == "" {
+		log.Printf("W No SAML certificate configured, assertions are signed with a generated key")
+		idp.Key, idp.Cert, err = generateSAMLCert(idp.EntityID)
+	} else {
+		idp.Key, idp.Cert, err = loadSAMLCert(o.SAMLCert, o.SAMLKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return idp, nil
+}
+
+func loadSAMLCert(certPath, keyPath string) (*signingKey, *x509.Certificate, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parseSigningKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", keyPath, err)
+	}
+	data, err = ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("%v: No PEM certificate found", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", certPath, err)
+	}
+	pub, ok := key.Key.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, nil, fmt.Errorf("%v does not match the key %v", certPath, keyPath)
+	}
+	return key, cert, nil
+}
+
+// generateSAMLCert creates an RSA key with a self-signed certificate
+func generateSAMLCert(entityID string) (*signingKey, *x509.Certificate, error) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := newSigningKey(rsaKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: entityID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, rsaKey.Public(), rsaKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+// ServiceProviders returns the registered service providers by name
+func (idp *samlIdP) ServiceProviders() []*samlServiceProvider {
+	var sps []*samlServiceProvider
+	for _, sp := range idp.SPs {
+		sps = append(sps, sp)
+	}
+	sort.Slice(sps, func(i, j int) bool { return sps[i].DisplayName() < sps[j].DisplayName() })
+	return sps
+}
+
+// samlID returns a random XML ID
+func samlID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "_" + hex.EncodeToString(b), nil
+}
+
+// xmlWriter writes XML in exclusive canonical form (no comments): start
+// and end tags for empty elements, namespace declarations before sorted
+// attributes, and canonical escaping. Signed elements are written in this
+// form, so the bytes digested are the bytes sent.
+type xmlWriter struct {
+	bytes.Buffer
+}
+
+// validXML drops the characters XML can not carry
+func validXML(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == 0x9 || r == 0xA || r == 0xD || (r >= 0x20 && r != utf8.RuneError && r != 0xFFFE && r != 0xFFFF) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+var (
+	c14nTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	c14nAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", "\"", "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+// Open writes a start tag. attrs are name, value pairs; namespace
+// declarations are written first, then the attributes sorted by name.
+// Only unqualified attributes are supported.
+func (x *xmlWriter) Open(name string, attrs ...string) {
+	type attr struct{ name, value string }
+	var ns, plain []attr
+	for i := 0; i+1 < len(attrs); i += 2 {
+		a := attr{attrs[i], attrs[i+1]}
+		if a.name == "xmlns" || strings.HasPrefix(a.name, "xmlns:") {
+			ns = append(ns, a)
+		} else {
+			plain = append(plain, a)
+		}
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].name < ns[j].name })
+	sort.Slice(plain, func(i, j int) bool { return plain[i].name < plain[j].name })
+	x.WriteString("<" + name)
+	for _, a := range append(ns, plain...) {
+		x.WriteString(" " + a.name + "=\"" + c14nAttrEscaper.Replace(validXML(a.value)) + "\"")
+	}
+	x.WriteString(">")
+}
+
+// Close writes an end tag
+func (x *xmlWriter) Close(name string) {
+	x.WriteString("</" + name + ">")
+}
+
+// Text writes escaped character data
+func (x *xmlWriter) Text(s string) {
+	x.WriteString(c14nTextEscaper.Replace(validXML(s)))
+}
+
+// Element writes an element with text content
+func (x *xmlWriter) Element(name, text string, attrs ...string) {
+	x.Open(name, attrs...)
+	x.Text(text)
+	x.Close(name)
+}
+
+// sign returns the enveloped signature of the canonical element with the
+// given ID
+func (idp *samlIdP) sign(id string, canonical []byte) (string, error) {
+	digest := sha256.Sum256(canonical)
+	sigAlg := xmlSigRSASHA256
+	if idp.Key.Alg == "ES256" {
+		sigAlg = xmlSigECDSASHA256
+	}
+
+	var si xmlWriter
+	si.Open("ds:SignedInfo", "xmlns:ds", xmlDSigNS)
+	si.Element("ds:CanonicalizationMethod", "", "Algorithm", xmlExcC14N)
+	si.Element("ds:SignatureMethod", "", "Algorithm", sigAlg)
+	si.Open("ds:Reference", "URI", "#"+id)
+	si.Open("ds:Transforms")
+	si.Element("ds:Transform", "", "Algorithm", xmlEnvelopedSig)
+	si.Element("ds:Transform", "", "Algorithm", xmlExcC14N)
+	si.Close("ds:Transforms")
+	si.Element("ds:DigestMethod", "", "Algorithm", xmlDigestSHA256)
+	si.Element("ds:DigestValue", base64.StdEncoding.EncodeToString(digest[:]))
+	si.Close("ds:Reference")
+	si.Close("ds:SignedInfo")
+
+	sig, err := idp.Key.sign(si.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	var x xmlWriter
+	x.Open("ds:Signature", "xmlns:ds", xmlDSigNS)
+	x.Write(si.Bytes())
+	x.Element("ds:SignatureValue", base64.StdEncoding.EncodeToString(sig))
+	x.Open("ds:KeyInfo")
+	x.Open("ds:X509Data")
+	x.Element("ds:X509Certificate", base64.StdEncoding.EncodeToString(idp.Cert.Raw))
+	x.Close("ds:X509Data")
+	x.Close("ds:KeyInfo")
+	x.Close("ds:Signature")
+	return x.String(), nil
+}
+
+// samlAssertion holds what is asserted about the user to a service provider
+type samlAssertion struct {
+	SP           *samlServiceProvider
+	ACSURL       string
+	InResponseTo string
+	UserID       string
+	AuthTime     time.Time
+	Attributes   map[string][]string
+}
+
+// Assertion returns the signed assertion
+func (idp *samlIdP) Assertion(a samlAssertion) (string, error) {
+	id, err := samlID()
+	if err != nil {
+		return "", err
+	}
+	sessionIndex, err := samlID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	notOnOrAfter := now.Add(idp.TTL).Format(samlTimeFormat)
+	authTime := a.AuthTime
+	if authTime.IsZero() {
+		authTime = now
+	}
+	nameIDFormat := a.SP.NameIDFormat
+	if nameIDFormat == "" {
+		nameIDFormat = samlNameIDUnspecified
+		if strings.Contains(a.UserID, "@") {
+			nameIDFormat = samlNameIDEmail
+		}
+	}
+
+	var x xmlWriter
+	x.Open("saml:Assertion", "xmlns:saml", samlAssertionNS, "ID", id, "IssueInstant", now.Format(samlTimeFormat), "Version", "2.0")
+	x.Element("saml:Issuer", idp.EntityID)
+	issuerEnd := x.Len()
+
+	x.Open("saml:Subject")
+	x.Element("saml:NameID", a.UserID, "Format", nameIDFormat)
+	x.Open("saml:SubjectConfirmation", "Method", "urn:oasis:names:tc:SAML:2.0:cm:bearer")
+	confirmation := []string{"NotOnOrAfter", notOnOrAfter, "Recipient", a.ACSURL}
+	if a.InResponseTo != "" {
+		confirmation = append(confirmation, "InResponseTo", a.InResponseTo)
+	}
+	x.Element("saml:SubjectConfirmationData", "", confirmation...)
+	x.Close("saml:SubjectConfirmation")
+	x.Close("saml:Subject")
+
+	x.Open("saml:Conditions", "NotBefore", now.Add(-time.Minute).Format(samlTimeFormat), "NotOnOrAfter", notOnOrAfter)
+	x.Open("saml:AudienceRestriction")
+	x.Element("saml:Audience", a.SP.EntityID)
+	x.Close("saml:AudienceRestriction")
+	x.Close("saml:Conditions")
+
+	x.Open("saml:AuthnStatement", "AuthnInstant", authTime.UTC().Format(samlTimeFormat), "SessionIndex", sessionIndex)
+	x.Open("saml:AuthnContext")
+	x.Element("saml:AuthnContextClassRef", "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified")
+	x.Close("saml:AuthnContext")
+	x.Close("saml:AuthnStatement")
+
+	if len(a.Attributes) > 0 {
+		var names []string
+		for name := range a.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		x.Open("saml:AttributeStatement")
+		for _, name := range names {
+			x.Open("saml:Attribute", "Name", name, "NameFormat", "urn:oasis:names:tc:SAML:2.0:attrname-format:basic")
+			for _, v := range a.Attributes[name] {
+				x.Element("saml:AttributeValue", v)
+			}
+			x.Close("saml:Attribute")
+		}
+		x.Close("saml:AttributeStatement")
+	}
+	x.Close("saml:Assertion")
+
+	// The enveloped signature follows the Issuer
+	assertion := x.String()
+	signature, err := idp.sign(id, x.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return assertion[:issuerEnd] + signature + assertion[issuerEnd:], nil
+}
+
+// Response returns the successful response carrying the signed assertion
+func (idp *samlIdP) Response(a samlAssertion) (string, error) {
+	assertion, err := idp.Assertion(a)
+	if err != nil {
+		return "", err
+	}
+	id, err := samlID()
+	if err != nil {
+		return "", err
+	}
+	attrs := []string{"xmlns:samlp", samlProtocolNS, "xmlns:saml", samlAssertionNS,
+		"Destination", a.ACSURL, "ID", id, "IssueInstant", time.Now().UTC().Format(samlTimeFormat), "Version", "2.0"}
+	if a.InResponseTo != "" {
+		attrs = append(attrs, "InResponseTo", a.InResponseTo)
+	}
+	var x xmlWriter
+	x.Open("samlp:Response", attrs...)
+	x.Element("saml:Issuer", idp.EntityID)
+	x.Open("samlp:Status")
+	x.Element("samlp:StatusCode", "", "Value", "urn:oasis:names:tc:SAML:2.0:status:Success")
+	x.Close("samlp:Status")
+	x.WriteString(assertion)
+	x.Close("samlp:Response")
+	return x.String(), nil
+}
+
+// Metadata returns the IdP metadata
+func (idp *samlIdP) Metadata() string {
+	var x xmlWriter
+	x.WriteString(xml.Header)
+	x.Open("md:EntityDescriptor", "xmlns:md", samlMetadataNS, "entityID", idp.EntityID)
+	x.Open("md:IDPSSODescriptor", "WantAuthnRequestsSigned", "false", "protocolSupportEnumeration", samlProtocolNS)
+	x.Open("md:KeyDescriptor", "use", "signing")
+	x.Open("ds:KeyInfo", "xmlns:ds", xmlDSigNS)
+	x.Open("ds:X509Data")
+	x.Element("ds:X509Certificate", base64.StdEncoding.EncodeToString(idp.Cert.Raw))
+	x.Close("ds:X509Data")
+	x.Close("ds:KeyInfo")
+	x.Close("md:KeyDescriptor")
+	x.Element("md:NameIDFormat", samlNameIDEmail)
+	x.Element("md:NameIDFormat", samlNameIDUnspecified)
+	x.Element("md:SingleSignOnService", "", "Binding", samlRedirectBinding, "Location", idp.URL+"/saml/sso")
+	x.Element("md:SingleSignOnService", "", "Binding", samlPOSTBinding, "Location", idp.URL+"/saml/sso")
+	x.Close("md:IDPSSODescriptor")
+	x.Close("md:EntityDescriptor")
+	return x.String()
+}
+
+type samlAuthnRequest struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID              string   `xml:"ID,attr"`
+	Version         string   `xml:"Version,attr"`
+	ACSURL          string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding string   `xml:"ProtocolBinding,attr"`
+	Issuer          string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+// decodeAuthnRequest decodes the SAMLRequest parameter. HTTP-Redirect
+// requests are deflated, HTTP-POST ones are not.
+func decodeAuthnRequest(encoded string) (*samlAuthnRequest, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("Invalid SAMLRequest encoding")
+	}
+	data := raw
+	if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("<")) {
+		data, err = ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(raw)), samlMaxRequestBytes+1))
+		if err != nil {
+			return nil, errors.New("Invalid SAMLRequest compression")
+		}
+	}
+	if len(data) > samlMaxRequestBytes {
+		return nil, errors.New("SAMLRequest too large")
+	}
+	var req samlAuthnRequest
+	if err := xml.Unmarshal(data, &req); err != nil {
+		return nil, errors.New("Invalid AuthnRequest")
+	}
+	if req.ID == "" || req.Version != "2.0" || req.Issuer == "" {
+		return nil, errors.New("Invalid AuthnRequest")
+	}
+	return &req, nil
+}
+
+// samlAttributes looks up the LDAP attributes mapped for the service
+// provider. The assertion is sent without them when LDAP fails.
+func samlAttributes(c *context, sp *samlServiceProvider, userID string) map[string][]string {
+	if len(sp.Attributes) == 0 || c.App.Options.LDAPServer == "" {
+		return nil
+	}
+	var names []string
+	for name := range sp.Attributes {
+		names = append(names, name)
+	}
+	entry, err := ldapUserEntry(c, userID, names)
+	if err != nil {
+		log.Printf("E %v %v LDAP attributes for %v failed: %v", c.SessionID, userID, sp.EntityID, err)
+		return nil
+	}
+	if entry == nil {
+		return nil
+	}
+	attrs := make(map[string][]string)
+	for ldapName, samlName := range sp.Attributes {
+		if values := entry.GetAttributeValues(ldapName); len(values) > 0 {
+			attrs[samlName] = values
+		}
+	}
+	return attrs
+}
+
+// samlPost sends the response to the ACS URL of the service provider with
+// the HTTP-POST binding
+func samlPost(c *context, w http.ResponseWriter, sp *samlServiceProvider, acsURL, inResponseTo, relayState string) (int, error) {
+	var authTime time.Time
+	if item, err := c.App.Store.Get(c.SessionID); err == nil {
+		authTime = item.AuthTime
+	}
+	response, err := c.App.SAML.Response(samlAssertion{
+		SP:           sp,
+		ACSURL:       acsURL,
+		InResponseTo: inResponseTo,
+		UserID:       c.LoggedUser,
+		AuthTime:     authTime,
+		Attributes:   samlAttributes(c, sp, c.LoggedUser),
+	})
+	if err != nil {
+		log.Printf("E %v %v Failed to sign SAML response: %v", c.SessionID, c.LoggedUser, err)
+		return 500, err
+	}
+	c.UserID = c.LoggedUser
+	log.Printf("I %v %v SAML assertion issued to %v", c.SessionID, c.LoggedUser, sp.EntityID)
+
+	data := make(map[string]interface{})
+	data["StaticURLBase"] = c.App.Options.StaticURLBase
+	data["User"] = c.LoggedUser
+	data["ACSURL"] = acsURL
+	data["SAMLResponse"] = base64.StdEncoding.EncodeToString([]byte(response))
+	data["RelayState"] = relayState
+	data["ServiceProvider"] = sp.DisplayName()
+	return renderTemplate(c.App, w, "saml_post.tmpl", data)
+}
+
+// samlHandler answers 404 when the SAML IdP is not enabled
+func samlHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.App.SAML == nil {
+		return 404, errors.New("SAML IdP disabled")
+	}
+	return 200, nil
+}
+
+// IdP metadata
+func samlMetadataHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	io.WriteString(w, c.App.SAML.Metadata())
+	return 200, nil
+}
+
+// SP-initiated login with the HTTP-Redirect or HTTP-POST binding. The user
+// logs in with the PIN pad, which resumes the request afterwards.
+func samlSSOHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET", "POST"); err != nil {
+		return s, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return 400, err
+	}
+	encoded := r.Form.Get("SAMLRequest")
+	relayState := r.Form.Get("RelayState")
+	req, err := decodeAuthnRequest(encoded)
+	if err != nil {
+		log.Printf("W %v %v %v", c.SessionID, c.LoggedUser, err)
+		return 400, err
+	}
+	sp, ok := c.App.SAML.SPs[req.Issuer]
+	if !ok {
+		log.Printf("W %v %v Unknown SAML service provider %q", c.SessionID, c.LoggedUser, req.Issuer)
+		return 400, errors.New("Unknown service provider")
+	}
+	acsURL, ok := sp.ACSURL(req.ACSURL)
+	if !ok {
+		log.Printf("W %v %v Unregistered ACS URL %q for %v", c.SessionID, c.LoggedUser, req.ACSURL, sp.EntityID)
+		return 400, errors.New("Invalid AssertionConsumerServiceURL")
+	}
+	if req.ProtocolBinding != "" && req.ProtocolBinding != samlPOSTBinding {
+		return 400, errors.New("Unsupported ProtocolBinding")
+	}
+
+	if c.LoggedUser == "" {
+		resume := url.Values{"SAMLRequest": {encoded}}
+		if relayState != "" {
+			resume.Set("RelayState", relayState)
+		}
+		setLoginNext(c, r.URL.Path+"?"+resume.Encode())
+		http.Redirect(w, r, "/", 302)
+		return 302, nil
+	}
+	if next := loginNext(c); strings.HasPrefix(next, r.URL.Path+"?") {
+		clearLoginNext(c)
+	}
+	return samlPost(c, w, sp, acsURL, req.ID, relayState)
+}
+
+// IdP-initiated login to the service provider given by the sp parameter
+func samlLoginHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	sp, ok := c.App.SAML.SPs[r.URL.Query().Get("sp")]
+	if !ok {
+		return 404, errors.New("Unknown service provider")
+	}
+	if c.LoggedUser == "" {
+		setLoginNext(c, r.URL.RequestURI())
+		http.Redirect(w, r, "/", 302)
+		return 302, nil
+	}
+	if next := loginNext(c); next == r.URL.RequestURI() {
+		clearLoginNext(c)
+	}
+	relayState := r.URL.Query().Get("RelayState")
+	if relayState == "" {
+		relayState = sp.RelayState
+	}
+	return samlPost(c, w, sp, sp.ACSURLs[0], "", relayState)
+}
@@ -0,0 +1,282 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"html"
+	"html/template"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAuthnRequest = `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"
+    ID="_req1" Version="2.0" IssueInstant="2016-05-01T10:00:00Z"
+    AssertionConsumerServiceURL="https://wiki.example.com/saml/acs"
+    ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST">
+  <saml:Issuer>https://wiki.example.com</saml:Issuer>
+</samlp:AuthnRequest>`
+
+func testSAMLApp(t *testing.T) *app {
+	a := testApp()
+	key, cert, err := generateSAMLCert("https://rpa.example.com/saml/metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SAML = &samlIdP{
+		EntityID: "https://rpa.example.com/saml/metadata",
+		URL:      "https://rpa.example.com",
+		SPs: map[string]*samlServiceProvider{
+			"https://wiki.example.com": {
+				EntityID:   "https://wiki.example.com",
+				Name:       "Wiki",
+				ACSURLs:    []string{"https://wiki.example.com/saml/acs", "https://wiki.example.com/saml/acs2"},
+				RelayState: "/home",
+			},
+		},
+		Key:  key,
+		Cert: cert,
+		TTL:  5 * time.Minute,
+	}
+	a.Templates["saml_post.tmpl"] = template.Must(template.New("base").Parse(
+		`{{ define "base" }}{{ .ACSURL }} {{ .RelayState }} {{ .SAMLResponse }}{{ end }}`))
+	return a
+}
+
+func deflateRequest(s string) string {
+	var b bytes.Buffer
+	fw, _ := flate.NewWriter(&b, flate.DefaultCompression)
+	fw.Write([]byte(s))
+	fw.Close()
+	return base64.StdEncoding.EncodeToString(b.Bytes())
+}
+
+func between(s, start, end string) string {
+	i := strings.Index(s, start)
+	if i < 0 {
+		return ""
+	}
+	j := strings.Index(s[i:], end)
+	if j < 0 {
+		return ""
+	}
+	return s[i : i+j+len(end)]
+}
+
+// verifySAMLSignature checks the enveloped signature of the assertion,
+// relying on the assertion being sent in canonical form
+func verifySAMLSignature(t *testing.T, idp *samlIdP, response string) {
+	assertion := between(response, "<saml:Assertion ", "</saml:Assertion>")
+	signature := between(assertion, "<ds:Signature ", "</ds:Signature>")
+	signedInfo := between(signature, "<ds:SignedInfo ", "</ds:SignedInfo>")
+	if assertion == "" || signature == "" || signedInfo == "" {
+		t.Fatalf("signed assertion not found in %s", response)
+	}
+
+	digest := sha256.Sum256([]byte(strings.Replace(assertion, signature, "", 1)))
+	if want := "<ds:DigestValue>" + base64.StdEncoding.EncodeToString(digest[:]) + "</ds:DigestValue>"; !strings.Contains(signedInfo, want) {
+		t.Errorf("digest mismatch, want %v in %v", want, signedInfo)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(
+		between(signature, "<ds:SignatureValue>", "</ds:SignatureValue>"), "<ds:SignatureValue>"), "</ds:SignatureValue>"))
+	sum := sha256.Sum256([]byte(signedInfo))
+	if err := rsa.VerifyPKCS1v15(idp.Cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+}
+
+func TestSAMLResponse(t *testing.T) {
+	a := testSAMLApp(t)
+	sp := a.SAML.SPs["https://wiki.example.com"]
+	response, err := a.SAML.Response(samlAssertion{
+		SP:           sp,
+		ACSURL:       "https://wiki.example.com/saml/acs",
+		InResponseTo: "_req1",
+		UserID:       "foo@example.com",
+		AuthTime:     time.Now(),
+		Attributes:   map[string][]string{"displayName": {"Foo <Bar> & Co"}, "groups": {"staff", "admins"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifySAMLSignature(t, a.SAML, response)
+
+	var r struct {
+		InResponseTo string `xml:"InResponseTo,attr"`
+		Destination  string `xml:"Destination,attr"`
+		Assertion    struct {
+			NameID struct {
+				Format string `xml:"Format,attr"`
+				Value  string `xml:",chardata"`
+			} `xml:"Subject>NameID"`
+			Confirmation struct {
+				InResponseTo string `xml:"InResponseTo,attr"`
+				Recipient    string `xml:"Recipient,attr"`
+			} `xml:"Subject>SubjectConfirmation>SubjectConfirmationData"`
+			Audience   string `xml:"Conditions>AudienceRestriction>Audience"`
+			Attributes []struct {
+				Name   string   `xml:"Name,attr"`
+				Values []string `xml:"AttributeValue"`
+			} `xml:"AttributeStatement>Attribute"`
+		}
+	}
+	if err := xml.Unmarshal([]byte(response), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.InResponseTo != "_req1" || r.Destination != "https://wiki.example.com/saml/acs" ||
+		r.Assertion.NameID.Value != "foo@example.com" || r.Assertion.NameID.Format != samlNameIDEmail ||
+		r.Assertion.Confirmation.InResponseTo != "_req1" || r.Assertion.Confirmation.Recipient != "https://wiki.example.com/saml/acs" ||
+		r.Assertion.Audience != "https://wiki.example.com" {
+		t.Errorf("response = %+v", r)
+	}
+	if len(r.Assertion.Attributes) != 2 || r.Assertion.Attributes[0].Values[0] != "Foo <Bar> & Co" || len(r.Assertion.Attributes[1].Values) != 2 {
+		t.Errorf("attributes = %+v", r.Assertion.Attributes)
+	}
+}
+
+func TestXMLWriterCanonical(t *testing.T) {
+	var x xmlWriter
+	x.Open("a:e", "z", "1", "xmlns:a", "urn:a", "b", "x\"\n<&>")
+	x.Element("a:f", "<&>\r")
+	x.Element("a:g", "")
+	x.Close("a:e")
+	want := `<a:e xmlns:a="urn:a" b="x&quot;&#xA;&lt;&amp;>" z="1"><a:f>&lt;&amp;&gt;&#xD;</a:f><a:g></a:g></a:e>`
+	if x.String() != want {
+		t.Errorf("got  %s\nwant %s", x.String(), want)
+	}
+}
+
+func TestDecodeAuthnRequest(t *testing.T) {
+	for _, encoded := range []string{
+		deflateRequest(testAuthnRequest),
+		base64.StdEncoding.EncodeToString([]byte(testAuthnRequest)),
+	} {
+		req, err := decodeAuthnRequest(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.ID != "_req1" || req.Issuer != "https://wiki.example.com" || req.ACSURL != "https://wiki.example.com/saml/acs" {
+			t.Errorf("request = %+v", req)
+		}
+	}
+	for _, encoded := range []string{
+		"%%%",
+		base64.StdEncoding.EncodeToString([]byte("<foo/>")),
+		deflateRequest(strings.Replace(testAuthnRequest, `ID="_req1"`, "", 1)),
+		deflateRequest(strings.Repeat(" ", samlMaxRequestBytes) + testAuthnRequest),
+	} {
+		if _, err := decodeAuthnRequest(encoded); err == nil {
+			t.Errorf("decodeAuthnRequest(%.40q) succeeded", encoded)
+		}
+	}
+}
+
+func TestSAMLSSOHandler(t *testing.T) {
+	a := testSAMLApp(t)
+	a.Store.Put("345", session{})
+	query := url.Values{"SAMLRequest": {deflateRequest(testAuthnRequest)}, "RelayState": {"token"}}.Encode()
+	c := &context{App: a, SessionID: "345"}
+
+	// Anonymous users log in with the PIN pad first
+	w := httptest.NewRecorder()
+	if s, _ := samlSSOHandler(c, w, mustRequest("GET", "/saml/sso?"+query)); s != 302 || w.Header().Get("Location") != "/" {
+		t.Fatalf("status = <%d> location = <%v>", s, w.Header().Get("Location"))
+	}
+	next := loginNext(c)
+	if !strings.HasPrefix(next, "/saml/sso?") {
+		t.Fatalf("next = <%v>", next)
+	}
+
+	a.Store.Put("345", session{User: "foo@example.com", AuthTime: time.Now(), Next: next})
+	c.LoggedUser = "foo@example.com"
+	w = httptest.NewRecorder()
+	if s, err := samlSSOHandler(c, w, mustRequest("GET", next)); s != 200 {
+		t.Fatalf("status = <%d> %v", s, err)
+	}
+	fields := strings.Fields(w.Body.String())
+	if len(fields) != 3 || fields[0] != "https://wiki.example.com/saml/acs" || fields[1] != "token" {
+		t.Fatalf("post form = %v", fields)
+	}
+	response, _ := base64.StdEncoding.DecodeString(html.UnescapeString(fields[2]))
+	verifySAMLSignature(t, a.SAML, string(response))
+	if loginNext(c) != "" {
+		t.Error("next URL not cleared")
+	}
+
+	for _, req := range []string{
+		strings.Replace(testAuthnRequest, "https://wiki.example.com</saml:Issuer>", "https://evil.example.com</saml:Issuer>", 1),
+		strings.Replace(testAuthnRequest, "https://wiki.example.com/saml/acs", "https://evil.example.com/acs", 1),
+		strings.Replace(testAuthnRequest, "HTTP-POST", "HTTP-Artifact", 1),
+	} {
+		query := url.Values{"SAMLRequest": {deflateRequest(req)}}.Encode()
+		if s, _ := samlSSOHandler(c, httptest.NewRecorder(), mustRequest("GET", "/saml/sso?"+query)); s != 400 {
+			t.Errorf("status = <%d> want <400>", s)
+		}
+	}
+}
+
+func TestSAMLLoginHandler(t *testing.T) {
+	a := testSAMLApp(t)
+	a.Store.Put("345", session{User: "foo", AuthTime: time.Now()})
+	c := &context{App: a, SessionID: "345", LoggedUser: "foo"}
+
+	w := httptest.NewRecorder()
+	if s, _ := samlLoginHandler(c, w, mustRequest("GET", "/saml/login?sp="+url.QueryEscape("https://wiki.example.com"))); s != 200 {
+		t.Fatalf("status = <%d>", s)
+	}
+	fields := strings.Fields(w.Body.String())
+	if len(fields) != 3 || fields[0] != "https://wiki.example.com/saml/acs" || fields[1] != "/home" {
+		t.Fatalf("post form = %v", fields)
+	}
+	response, _ := base64.StdEncoding.DecodeString(html.UnescapeString(fields[2]))
+	if strings.Contains(string(response), "InResponseTo") {
+		t.Errorf("IdP-initiated response has InResponseTo: %s", response)
+	}
+	verifySAMLSignature(t, a.SAML, string(response))
+
+	if s, _ := samlLoginHandler(c, httptest.NewRecorder(), mustRequest("GET", "/saml/login?sp=nope")); s != 404 {
+		t.Errorf("unknown SP: status = <%d> want <404>", s)
+	}
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	a := testSAMLApp(t)
+	w := httptest.NewRecorder()
+	samlMetadataHandler(&context{App: a}, w, mustRequest("GET", "/saml/metadata"))
+	body := w.Body.String()
+	if !strings.Contains(body, `entityID="https://rpa.example.com/saml/metadata"`) ||
+		!strings.Contains(body, base64.StdEncoding.EncodeToString(a.SAML.Cert.Raw)) ||
+		!regexp.MustCompile(`Binding="[^"]*HTTP-Redirect" Location="https://rpa.example.com/saml/sso"`).MatchString(body) {
+		t.Errorf("metadata = %s", body)
+	}
+	var md struct{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &md); err != nil {
+		t.Error(err)
+	}
+}
@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 func createNewSession(c *context, w http.ResponseWriter) {
@@ -42,3 +44,65 @@ func generateSessionID() string {
 	}
 	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
+
+// safeNext validates a URL to redirect to after the login. Only paths on
+// this host are accepted: no scheme, host or user info, no "//" or "/\"
+// prefix that browsers read as another host, and no control characters or
+// backslashes. It returns the URL as it should be used.
+func safeNext(next string) (string, bool) {
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		return "", false
+	}
+	for _, ch := range next {
+		if ch < 0x20 || ch == 0x7f || ch == '\\' {
+			return "", false
+		}
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return "", false
+	}
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") {
+		return "", false
+	}
+	return u.RequestURI(), true
+}
+
+// setLoginNext keeps the URL to resume after the login in the session. An
+// unsafe URL is ignored.
+func setLoginNext(c *context, next string) {
+	next, ok := safeNext(next)
+	if !ok {
+		log.Printf("W %v %v Ignoring unsafe next URL", c.SessionID, c.LoggedUser)
+		return
+	}
+	item, err := c.App.Store.Get(c.SessionID)
+	if err != nil {
+		return
+	}
+	item.Next = next
+	c.App.Store.Put(c.SessionID, item)
+}
+
+// loginNext returns the URL to resume after the login, if any
+func loginNext(c *context) string {
+	if c.SessionID == "" {
+		return ""
+	}
+	item, err := c.App.Store.Get(c.SessionID)
+	if err != nil {
+		return ""
+	}
+	next, _ := safeNext(item.Next)
+	return next
+}
+
+// clearLoginNext forgets the URL to resume once it has been reached
+func clearLoginNext(c *context) {
+	item, err := c.App.Store.Get(c.SessionID)
+	if err != nil || item.Next == "" {
+		return
+	}
+	item.Next = ""
+	c.App.Store.Put(c.SessionID, item)
+}
@@ -79,3 +79,44 @@ func TestGenerateSessionID(t *testing.T) {
 		t.Errorf("generate session ID <%s> want XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX", sessionId)
 	}
 }
+
+func TestSafeNext(t *testing.T) {
+	for next, want := range map[string]string{
+		"/protected":                "/protected",
+		"/protected/account?tab=1":  "/protected/account?tab=1",
+		"/protected/a%20b":          "/protected/a%20b",
+		"":                          "",
+		"protected":                 "",
+		"//evil.example.com":        "",
+		"/\\evil.example.com":       "",
+		"/%2F/evil.example.com":     "",
+		"/\t/evil.example.com":      "",
+		"https://evil.example.com/": "",
+		"javascript:alert(1)":       "",
+		"http:/evil.example.com":    "",
+	} {
+		got, ok := safeNext(next)
+		if got != want || ok != (want != "") {
+			t.Errorf("safeNext(%q) = <%q, %v> want <%q>", next, got, ok, want)
+		}
+	}
+}
+
+func TestLoginNext(t *testing.T) {
+	a := app{Store: make(storage), Options: &options{}}
+	c := context{App: &a, SessionID: "345"}
+	a.Store.Put(c.SessionID, session{})
+
+	setLoginNext(&c, "//evil.example.com/")
+	if next := loginNext(&c); next != "" {
+		t.Errorf("unsafe next URL <%v> kept", next)
+	}
+	setLoginNext(&c, "/protected/account")
+	if next := loginNext(&c); next != "/protected/account" {
+		t.Errorf("next = <%v> want </protected/account>", next)
+	}
+	clearLoginNext(&c)
+	if next := loginNext(&c); next != "" {
+		t.Errorf("next = <%v> not cleared", next)
+	}
+}
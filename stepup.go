@@ -0,0 +1,99 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// stepUpRule requires a login within MaxAge for the pages under Prefix
+type stepUpRule struct {
+	Prefix string
+	MaxAge time.Duration
+}
+
+type stepUpRules []stepUpRule
+
+// parseStepUpRules parses comma separated "path=duration" entries, e.g.
+// "/protected/account=5m,/protected/admin=1m"
+func parseStepUpRules(s string) (rules stepUpRules, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("Invalid step-up rule %q, want /path=duration", entry)
+		}
+		maxAge, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("Invalid step-up duration in %q", entry)
+		}
+		rules = append(rules, stepUpRule{Prefix: strings.TrimSpace(parts[0]), MaxAge: maxAge})
+	}
+	return
+}
+
+// MaxAge returns the freshness required for path by the rule with the
+// longest matching prefix
+func (rules stepUpRules) MaxAge(path string) (maxAge time.Duration, ok bool) {
+	matched := -1
+	for _, rule := range rules {
+		prefix := strings.TrimSuffix(rule.Prefix, "/")
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		if len(prefix) > matched {
+			matched = len(prefix)
+			maxAge = rule.MaxAge
+			ok = true
+		}
+	}
+	return
+}
+
+// stepUp sends the user back to the PIN pad when the page requires a more
+// recent login than the one of the session, and reports whether it did. The
+// requested URL is kept in the session, so the PIN pad resumes there after
+// the login.
+func stepUp(c *context, w http.ResponseWriter, r *http.Request) bool {
+	maxAge, ok := c.App.StepUp.MaxAge(r.URL.Path)
+	if !ok || c.LoggedUser == "" {
+		return false
+	}
+	item, err := c.App.Store.Get(c.SessionID)
+	if err != nil {
+		return false
+	}
+	authTime := item.AuthTime
+	if !c.AuthTime.IsZero() {
+		authTime = c.AuthTime
+	}
+	if !authTime.IsZero() && time.Since(authTime) <= maxAge {
+		return false
+	}
+	log.Printf("I %v %v Login within %v required for %v, stepping up", c.SessionID, c.LoggedUser, maxAge, r.URL.Path)
+	setLoginNext(c, r.URL.RequestURI())
+	http.Redirect(w, r, "/", 302)
+	return true
+}
@@ -0,0 +1,133 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"testing"
+	"time"
+)
+
+func TestParseStepUpRules(t *testing.T) {
+	rules, err := parseStepUpRules("/protected/account=5m, /protected/account/keys=30s,/protected/admin/=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []struct {
+		path   string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{"/protected", 0, false},
+		{"/protected/accounts", 0, false},
+		{"/protected/account", 5 * time.Minute, true},
+		{"/protected/account/profile", 5 * time.Minute, true},
+		{"/protected/account/keys", 30 * time.Second, true},
+		{"/protected/admin", time.Minute, true},
+	} {
+		if maxAge, ok := rules.MaxAge(d.path); maxAge != d.maxAge || ok != d.ok {
+			t.Errorf("MaxAge(%v) = <%v, %v> want <%v, %v>", d.path, maxAge, ok, d.maxAge, d.ok)
+		}
+	}
+
+	for _, s := range []string{"account=5m", "/protected/account", "/protected/account=soon", "/protected/account=-1m"} {
+		if _, err := parseStepUpRules(s); err == nil {
+			t.Errorf("parseStepUpRules(%q) succeeded", s)
+		}
+	}
+}
+
+func TestProtectedHandlerStepUp(t *testing.T) {
+	c, w, r := prepare("GET", "/protected/account?tab=keys", new(bytes.Buffer))
+	c.App.StepUp, _ = parseStepUpRules("/protected/account=5m")
+	c.SessionID = "345"
+	c.LoggedUser = "foo"
+	c.App.Store.Put(c.SessionID, session{User: "foo", AuthTime: time.Now().Add(-10 * time.Minute)})
+
+	if s, _ := protectedHandler(c, w, r); s != 302 || w.Header().Get("Location") != "/" {
+		t.Fatalf("status = <%d> location = <%v> want <302> </>", s, w.Header().Get("Location"))
+	}
+	if next := loginNext(c); next != "/protected/account?tab=keys" {
+		t.Fatalf("next = <%v>", next)
+	}
+
+	// The PIN pad resumes the request after the login
+	c.App.Templates["index.tmpl"] = template.Must(template.New("base").Parse(`{{ define "base" }}{{ .SuccessLoginURL }}{{ end }}`))
+	_, w, r = prepare("GET", "/", new(bytes.Buffer))
+	indexHandler(c, w, r)
+	if w.Body.String() != "/protected/account?tab=keys" {
+		t.Errorf("next URL not passed to the PIN pad: %s", w.Body.String())
+	}
+
+	c.App.RPS.Fetch = func(url, method string, q, d interface{}) error { return nil }
+	sendLoginResult(c, "foo", "ott", 200, "OK")
+	item, _ := c.App.Store.Get(c.SessionID)
+	if item.User != "foo" || time.Since(item.AuthTime) > time.Minute || item.Next == "" {
+		t.Fatalf("session after login = %+v", item)
+	}
+
+	_, w, r = prepare("GET", "/protected/account?tab=keys", new(bytes.Buffer))
+	if s, _ := protectedHandler(c, w, r); s != 200 || w.Header().Get("Location") != "" {
+		t.Fatalf("status = <%d> location = <%v> want <200>", s, w.Header().Get("Location"))
+	}
+	if next := loginNext(c); next != "" {
+		t.Errorf("next = <%v> not cleared", next)
+	}
+}
+
+func TestProtectedHandlerNoStepUp(t *testing.T) {
+	c, w, r := prepare("GET", "/protected", new(bytes.Buffer))
+	c.App.StepUp, _ = parseStepUpRules("/protected/account=5m")
+	c.SessionID = "345"
+	c.LoggedUser = "foo"
+	c.App.Store.Put(c.SessionID, session{User: "foo"})
+
+	if s, _ := protectedHandler(c, w, r); s != 200 || w.Header().Get("Location") != "" {
+		t.Fatalf("status = <%d> location = <%v> want <200>", s, w.Header().Get("Location"))
+	}
+}
+
+func TestProtectedHandlerDeepLink(t *testing.T) {
+	c, w, r := prepare("GET", "/protected/reports?year=2016", new(bytes.Buffer))
+	c.SessionID = "345"
+	c.App.Store.Put(c.SessionID, session{})
+
+	if s, _ := protectedHandler(c, w, r); s != 302 || w.Header().Get("Location") != "/" {
+		t.Fatalf("status = <%d> location = <%v> want <302> </>", s, w.Header().Get("Location"))
+	}
+	c.App.Templates["index.tmpl"] = template.Must(template.New("base").Parse(`{{ define "base" }}{{ .SuccessLoginURL }}{{ end }}`))
+	_, w, r = prepare("GET", "/", new(bytes.Buffer))
+	indexHandler(c, w, r)
+	if w.Body.String() != "/protected/reports?year=2016" {
+		t.Errorf("SuccessLoginURL = <%s>", w.Body.String())
+	}
+
+	// An unsafe next parameter does not replace the saved URL
+	_, w, r = prepare("GET", "/?next=%2F%2Fevil.example.com", new(bytes.Buffer))
+	indexHandler(c, w, r)
+	if w.Body.String() != "/protected/reports?year=2016" {
+		t.Errorf("SuccessLoginURL = <%s>", w.Body.String())
+	}
+	_, w, r = prepare("GET", "/?next=%2Fprotected%2Faccount", new(bytes.Buffer))
+	indexHandler(c, w, r)
+	if w.Body.String() != "/protected/account" {
+		t.Errorf("SuccessLoginURL = <%s>", w.Body.String())
+	}
+}
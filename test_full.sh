@@ -3,6 +3,9 @@ set -e
 cd asn1-ber
 go test -v
 cd ..
+cd rpstest
+go test -v
+cd ..
 
 ulimit -n 102400
 go build -o new-mpin-rpa-go
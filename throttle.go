@@ -0,0 +1,374 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errTooManyRequests = errors.New("Too many requests")
+	errAccountLocked   = errors.New("Account locked")
+)
+
+// Entries without activity for this long are forgotten
+const throttleForget = 24 * time.Hour
+
+type tokenBucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// rateLimiter is a token bucket per key. Each bucket holds up to Burst
+// tokens and refills at Rate tokens per second. A nil limiter allows
+// everything.
+type rateLimiter struct {
+	Rate  float64
+	Burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	gcCount int
+}
+
+// newRateLimiter allows perMinute requests per key, in bursts of up to
+// perMinute. It returns nil when perMinute is not positive.
+func newRateLimiter(perMinute int) *rateLimiter {
+	return newRateLimiterPer(perMinute, time.Minute)
+}
+
+// newRateLimiterPer allows n requests per key in each period, in bursts of
+// up to n. It returns nil when n is not positive.
+func newRateLimiterPer(n int, period time.Duration) *rateLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		Rate:    float64(n) / period.Seconds(),
+		Burst:   float64(n),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token for key. When none is left it returns false and the
+// time until the next token.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{Tokens: l.Burst, Last: now}
+		l.buckets[key] = b
+	}
+	b.Tokens = math.Min(l.Burst, b.Tokens+now.Sub(b.Last).Seconds()*l.Rate)
+	b.Last = now
+
+	l.gcCount++
+	if l.gcCount >= 1000 {
+		for k, v := range l.buckets {
+			if now.Sub(v.Last).Seconds()*l.Rate >= l.Burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.gcCount = 0
+	}
+
+	if b.Tokens < 1 {
+		return false, time.Duration((1 - b.Tokens) / l.Rate * float64(time.Second))
+	}
+	b.Tokens--
+	return true, 0
+}
+
+type lockoutEntry struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// lockoutStore counts failed logins per user. After Threshold failures in
+// a row the user is locked for Duration, doubled on every further failure
+// up to Max. When Path is set the state is saved there on every change and
+// loaded at start, so locks survive restarts.
+type lockoutStore struct {
+	Threshold int
+	Duration  time.Duration
+	Max       time.Duration
+	Path      string
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+func newLockoutStore(threshold int, duration, max time.Duration, path string) (*lockoutStore, error) {
+	s := &lockoutStore{
+		Threshold: threshold,
+		Duration:  duration,
+		Max:       max,
+		Path:      path,
+		entries:   make(map[string]*lockoutEntry),
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, fmt.Errorf("Invalid lockout state %v: %v", path, err)
+	}
+	return s, nil
+}
+
+// Locked returns for how long the user is still locked
+func (s *lockoutStore) Locked(userID string) time.Duration {
+	if s == nil || userID == "" {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[userID]
+	if !ok {
+		return 0
+	}
+	if wait := e.LockedUntil.Sub(time.Now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Failure records a failed login and returns for how long the user is
+// locked because of it
+func (s *lockoutStore) Failure(userID string) (locked time.Duration) {
+	if s == nil || s.Threshold <= 0 || userID == "" {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.entries[userID]
+	if !ok || now.Sub(e.LastFailure) > throttleForget {
+		e = &lockoutEntry{}
+		s.entries[userID] = e
+	}
+	e.Failures++
+	e.LastFailure = now
+	if e.Failures >= s.Threshold {
+		locked = s.Duration
+		for i := s.Threshold; i < e.Failures && locked < s.Max; i++ {
+			locked *= 2
+		}
+		if s.Max > 0 && locked > s.Max {
+			locked = s.Max
+		}
+		e.LockedUntil = now.Add(locked)
+	}
+	s.gc(now)
+	s.save()
+	return
+}
+
+// Success clears the failures of the user
+func (s *lockoutStore) Success(userID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[userID]; ok {
+		delete(s.entries, userID)
+		s.save()
+	}
+}
+
+// Unlock clears the lock and failures of the user. It reports whether
+// there was anything to clear.
+func (s *lockoutStore) Unlock(userID string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[userID]; !ok {
+		return false
+	}
+	delete(s.entries, userID)
+	s.save()
+	return true
+}
+
+// LockedUsers returns the number of users currently locked
+func (s *lockoutStore) LockedUsers() (n int) {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, e := range s.entries {
+		if e.LockedUntil.After(now) {
+			n++
+		}
+	}
+	return
+}
+
+func (s *lockoutStore) gc(now time.Time) {
+	for k, e := range s.entries {
+		if now.Sub(e.LastFailure) > throttleForget && e.LockedUntil.Before(now) {
+			delete(s.entries, k)
+		}
+	}
+}
+
+// save writes the state to Path. The caller holds the lock.
+func (s *lockoutStore) save() {
+	if s.Path == "" {
+		return
+	}
+	if err := writeJSONFile(s.Path, s.entries); err != nil {
+		log.Printf("E Failed to save lockout state: %v", err)
+	}
+}
+
+// throttled counts requests answered with 429
+var throttled int64
+
+// trustedProxies are the reverse proxies allowed to give the client
+// address in X-Forwarded-For
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses comma separated IP addresses and CIDR ranges
+func parseTrustedProxies(s string) (l trustedProxies, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %q", entry)
+		}
+		l = append(l, n)
+	}
+	return
+}
+
+// Contains reports whether the address is a trusted proxy
+func (l trustedProxies) Contains(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client without port. Behind trusted
+// proxies it is the last address in X-Forwarded-For not added by one of
+// them.
+func clientIP(c *context, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !c.App.TrustedProxies.Contains(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		host = addr
+		if !c.App.TrustedProxies.Contains(addr) {
+			break
+		}
+	}
+	return host
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+}
+
+// throttleHandler limits the request rate per client IP
+func throttleHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	ip := clientIP(c, r)
+	if ok, wait := c.App.IPLimiter.Allow(ip); !ok {
+		atomic.AddInt64(&throttled, 1)
+		log.Printf("W %v %v Rate limit exceeded for %v on %v", c.SessionID, "", ip, r.URL.Path)
+		setRetryAfter(w, wait)
+		return 429, errTooManyRequests
+	}
+	return 200, nil
+}
+
+// throttleUser rejects requests for a locked user or above the per user
+// rate
+func throttleUser(c *context, w http.ResponseWriter, userID string) (int, error) {
+	if userID == "" {
+		return 200, nil
+	}
+	if wait := c.App.Lockouts.Locked(userID); wait > 0 {
+		atomic.AddInt64(&throttled, 1)
+		log.Printf("W %v %v Account locked for %v", c.SessionID, userID, wait)
+		setRetryAfter(w, wait)
+		return 429, errAccountLocked
+	}
+	if ok, wait := c.App.UserLimiter.Allow(userID); !ok {
+		atomic.AddInt64(&throttled, 1)
+		log.Printf("W %v %v Rate limit exceeded", c.SessionID, userID)
+		setRetryAfter(w, wait)
+		return 429, errTooManyRequests
+	}
+	return 200, nil
+}
@@ -0,0 +1,194 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"./rpstest"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("1.2.3.4"); !ok {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	ok, wait := l.Allow("1.2.3.4")
+	if ok || wait <= 0 || wait > 20*time.Second {
+		t.Errorf("ok = <%t> wait = <%v> want <false> <=20s", ok, wait)
+	}
+	if ok, _ := l.Allow("5.6.7.8"); !ok {
+		t.Error("other key refused")
+	}
+
+	var disabled *rateLimiter = newRateLimiter(0)
+	if ok, _ := disabled.Allow("1.2.3.4"); !ok {
+		t.Error("disabled limiter refused")
+	}
+}
+
+func TestLockoutProgressive(t *testing.T) {
+	s, _ := newLockoutStore(3, time.Minute, 3*time.Minute, "")
+	for i := 0; i < 2; i++ {
+		if locked := s.Failure("foo"); locked != 0 {
+			t.Fatalf("locked = <%v> after %d failures", locked, i+1)
+		}
+	}
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if locked := s.Failure("foo"); locked != want {
+			t.Errorf("locked = <%v> want <%v>", locked, want)
+		}
+	}
+	if s.Locked("foo") <= 0 {
+		t.Error("user not locked")
+	}
+	if !s.Unlock("foo") || s.Locked("foo") != 0 {
+		t.Error("user not unlocked")
+	}
+}
+
+func TestLockoutPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lockout.json")
+
+	s, _ := newLockoutStore(1, time.Minute, time.Hour, path)
+	s.Failure("foo")
+
+	s, err = newLockoutStore(1, time.Minute, time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Locked("foo") <= 0 {
+		t.Error("lockout not restored")
+	}
+}
+
+func TestThrottleHandler(t *testing.T) {
+	c, w, r := prepare("POST", "/mpinAuthenticate", new(bytes.Buffer))
+	r.RemoteAddr = "1.2.3.4:5678"
+	c.App.IPLimiter = newRateLimiter(1)
+
+	if s, err := throttleHandler(c, w, r); s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v> want <200> <nil>", s, err)
+	}
+	if s, err := throttleHandler(c, w, r); s != 429 || err != errTooManyRequests {
+		t.Fatalf("status = <%d> err = <%v> want <429> <%v>", s, err, errTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After not set")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	a := testApp()
+	var err error
+	if a.TrustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		RemoteAddr string
+		Forwarded  []string
+		IP         string
+	}{
+		{"1.2.3.4:5678", nil, "1.2.3.4"},
+		// Only trusted proxies are believed
+		{"1.2.3.4:5678", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"192.0.2.1:5678", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"192.0.2.1:5678", nil, "192.0.2.1"},
+		// The client can prepend anything
+		{"10.1.2.3:5678", []string{"6.6.6.6, 5.6.7.8, 10.0.0.1"}, "5.6.7.8"},
+		{"10.1.2.3:5678", []string{"6.6.6.6", "5.6.7.8"}, "5.6.7.8"},
+		{"10.1.2.3:5678", []string{"garbage, 10.0.0.1"}, "10.0.0.1"},
+	}
+	for _, d := range cases {
+		r := mustRequest("GET", "/mpinAuthenticate")
+		r.RemoteAddr = d.RemoteAddr
+		r.Header["X-Forwarded-For"] = d.Forwarded
+		if ip := clientIP(&context{App: a}, r); ip != d.IP {
+			t.Errorf("clientIP(%v, %v) = <%v> want <%v>", d.RemoteAddr, d.Forwarded, ip, d.IP)
+		}
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestAuthenticateUserLockout(t *testing.T) {
+	fake := rpstest.NewServer()
+	defer fake.Close()
+	body := `{"mpinResponse": {"authOTT": "1111111111111111111111111111111111111111111111111111111111111111"}}`
+	a := testAppForRPS(fake.Host())
+	a.LoginResult = sendLoginResult
+	a.Lockouts, _ = newLockoutStore(2, time.Minute, time.Hour, "")
+
+	// Two wrong PINs lock the account, the correct PIN is then refused
+	for i, att := range []struct{ rps, want int }{{401, 401}, {401, 401}, {200, 429}} {
+		rpsStatus := att.rps
+		a.Authenticate = func(*context, string) (string, string, int) { return "foo", "", rpsStatus }
+		c, w, r := prepare("POST", "/mpinAuthenticate", bytes.NewBufferString(body))
+		c.App = a
+		if s, _ := authenticateUserHandler(c, w, r); s != att.want {
+			t.Fatalf("attempt %d: status = <%d> want <%d>", i+1, s, att.want)
+		}
+		if _, ok := fake.Last("/loginResult"); ok != (att.rps == 200) {
+			t.Errorf("attempt %d: loginResult sent = <%t> want <%t>", i+1, ok, att.rps == 200)
+		}
+	}
+
+	var rq sendLoginResultReq
+	if last, ok := fake.Last("/loginResult"); !ok || last.JSON(&rq) != nil || rq.Status != 403 {
+		t.Errorf("loginResult status = <%d> want <403> for a locked user", rq.Status)
+	}
+}
+
+func TestAdminUnlockHandler(t *testing.T) {
+	c, w, r := prepare("POST", "/admin/unlock", bytes.NewBufferString(`{"userId": "foo"}`))
+	opts := *c.App.Options
+	c.App.Options = &opts
+	c.App.Lockouts.Failure("foo")
+
+	if s, _ := adminHandler(c, w, r); s != 404 {
+		t.Fatalf("status = <%d> want <404> without admin token", s)
+	}
+	opts.AdminToken = "secret"
+	r.Header.Set("Authorization", "Bearer wrong")
+	if s, _ := adminHandler(c, w, r); s != 401 {
+		t.Fatalf("status = <%d> want <401>", s)
+	}
+	r.Header.Set("Authorization", "Bearer secret")
+	if s, err := adminHandler(c, w, r); s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v> want <200> <nil>", s, err)
+	}
+	if s, err := adminUnlockHandler(c, w, r); s != 200 || err != nil {
+		t.Fatalf("status = <%d> err = <%v> want <200> <nil>", s, err)
+	}
+	if c.App.Lockouts.Unlock("foo") {
+		t.Error("failures not cleared")
+	}
+}
@@ -0,0 +1,319 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errTokenRevoked   = errors.New("Token revoked")
+	errTokenExpired   = errors.New("Token expired")
+	errInvalidRefresh = errors.New("Invalid or expired refresh token")
+)
+
+// accessClaims are the claims of the JWT access tokens. Grant identifies
+// the login the token was issued for; revoking it invalidates all tokens
+// of that login.
+type accessClaims struct {
+	jwtClaims
+	AuthTime int64  `json:"auth_time,omitempty"`
+	Grant    string `json:"sid"`
+}
+
+// tokenGrant is a login for which tokens were issued. It lives as long as
+// its refresh token.
+type tokenGrant struct {
+	UserID    string
+	SessionID string
+	MpinID    string
+	AuthTime  time.Time
+	Expires   time.Time
+}
+
+type refreshEntry struct {
+	Grant   string
+	Expires time.Time
+}
+
+// tokenPair is returned to API clients after the login and on refresh
+type tokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+// tokenIssuer issues short lived JWT access tokens with single use refresh
+// tokens to clients that can not use the session cookie
+type tokenIssuer struct {
+	Keys       jwtKeys
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+
+	mu      sync.Mutex
+	grants  map[string]*tokenGrant
+	refresh map[string]refreshEntry
+	gcCount int
+}
+
+// newTokenIssuer returns nil when JWT tokens are not enabled
+func newTokenIssuer(o *options) (*tokenIssuer, error) {
+	if !o.JWTTokens {
+		return nil, nil
+	}
+	keys, err := loadJWTKeys(o.JWTKeys)
+	if err != nil {
+		return nil, err
+	}
+	if o.JWTKeys == "" {
+		log.Printf("W No JWT signing key configured, access tokens are signed with a generated key")
+	}
+	return &tokenIssuer{
+		Keys:       keys,
+		Issuer:     o.JWTIssuer,
+		AccessTTL:  o.JWTAccessTTL,
+		RefreshTTL: o.JWTRefreshTTL,
+		grants:     make(map[string]*tokenGrant),
+		refresh:    make(map[string]refreshEntry),
+	}, nil
+}
+
+// gc drops expired grants and refresh tokens every 1000 calls. The caller
+// holds the lock.
+func (t *tokenIssuer) gc(now time.Time) {
+	t.gcCount++
+	if t.gcCount < 1000 {
+		return
+	}
+	for k, v := range t.grants {
+		if v.Expires.Before(now) {
+			delete(t.grants, k)
+		}
+	}
+	for k, v := range t.refresh {
+		if v.Expires.Before(now) {
+			delete(t.refresh, k)
+		}
+	}
+	t.gcCount = 0
+}
+
+// Issue returns the tokens for a new login of the user in the session,
+// with the identity mpinID
+func (t *tokenIssuer) Issue(sessionID, userID, mpinID string, authTime time.Time) (tokenPair, error) {
+	grantID, err := randomToken()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.grants[grantID] = &tokenGrant{UserID: userID, SessionID: sessionID, MpinID: mpinID, AuthTime: authTime}
+	return t.issue(grantID)
+}
+
+// issue signs an access token and stores a refresh token for the grant.
+// The caller holds the lock.
+func (t *tokenIssuer) issue(grantID string) (tokenPair, error) {
+	now := time.Now()
+	grant := t.grants[grantID]
+	grant.Expires = now.Add(t.RefreshTTL)
+
+	jti, err := randomToken()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	var claims accessClaims
+	claims.Issuer = t.Issuer
+	claims.Subject = grant.UserID
+	claims.IssuedAt = now.Unix()
+	claims.Expires = now.Add(t.AccessTTL).Unix()
+	claims.ID = jti
+	claims.AuthTime = grant.AuthTime.Unix()
+	claims.Grant = grantID
+	access, err := t.Keys.Sign(&claims)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refresh, err := randomToken()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	t.gc(now)
+	t.refresh[refresh] = refreshEntry{Grant: grantID, Expires: grant.Expires}
+
+	return tokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(t.AccessTTL / time.Second),
+	}, nil
+}
+
+// Refresh exchanges a refresh token for new tokens. The refresh token can
+// not be used again.
+func (t *tokenIssuer) Refresh(refreshToken string) (tokenPair, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.refresh[refreshToken]
+	delete(t.refresh, refreshToken)
+	if !ok || entry.Expires.Before(time.Now()) {
+		return tokenPair{}, "", errInvalidRefresh
+	}
+	grant, ok := t.grants[entry.Grant]
+	if !ok {
+		return tokenPair{}, "", errInvalidRefresh
+	}
+	pair, err := t.issue(entry.Grant)
+	return pair, grant.UserID, err
+}
+
+// Verify checks an access token and returns its claims
+func (t *tokenIssuer) Verify(token string) (accessClaims, error) {
+	var claims accessClaims
+	if err := t.Keys.Verify(token, &claims); err != nil {
+		return claims, err
+	}
+	if claims.Issuer != t.Issuer || claims.Subject == "" {
+		return claims, errInvalidJWT
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return claims, errTokenExpired
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.grants[claims.Grant]; !ok {
+		return claims, errTokenRevoked
+	}
+	return claims, nil
+}
+
+// Revoke invalidates the access and refresh tokens of the grant
+func (t *tokenIssuer) Revoke(grantID string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.revoke(func(id string, g *tokenGrant) bool { return id == grantID })
+}
+
+// RevokeSession invalidates the tokens issued for logins in the session
+func (t *tokenIssuer) RevokeSession(sessionID string) {
+	if t == nil || sessionID == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.revoke(func(id string, g *tokenGrant) bool { return g.SessionID == sessionID })
+}
+
+// RevokeMpinID invalidates the tokens issued for logins with the identity
+func (t *tokenIssuer) RevokeMpinID(mpinID string) {
+	if t == nil || mpinID == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.revoke(func(id string, g *tokenGrant) bool { return g.MpinID == mpinID })
+}
+
+// revoke removes the matching grants and their refresh tokens. The caller
+// holds the lock.
+func (t *tokenIssuer) revoke(match func(string, *tokenGrant) bool) {
+	revoked := make(map[string]bool)
+	for id, g := range t.grants {
+		if match(id, g) {
+			revoked[id] = true
+			delete(t.grants, id)
+		}
+	}
+	if len(revoked) == 0 {
+		return
+	}
+	for k, v := range t.refresh {
+		if revoked[v.Grant] {
+			delete(t.refresh, k)
+		}
+	}
+}
+
+// bearerHandler authenticates requests with an Authorization: Bearer access
+// token. Requests without one go on with the session cookie.
+func bearerHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth := r.Header.Get("Authorization")
+	if c.App.Tokens == nil || !strings.HasPrefix(auth, "Bearer ") {
+		return 200, nil
+	}
+	claims, err := c.App.Tokens.Verify(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		log.Printf("W %v %v Bearer token rejected: %v", c.SessionID, "", err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return 401, err
+	}
+	c.LoggedUser = claims.Subject
+	c.UserID = claims.Subject
+	c.Grant = claims.Grant
+	c.AuthTime = time.Unix(claims.AuthTime, 0)
+	return 200, nil
+}
+
+// Exchange a refresh token for new tokens
+func tokenRefreshHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "POST"); err != nil {
+		return s, err
+	}
+	var rq struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rq); err != nil || rq.RefreshToken == "" {
+		log.Printf("E %v %v Can not decode body as JSON", c.SessionID, "")
+		return 400, errors.New("BAD REQUEST. INVALID JSON")
+	}
+	pair, userID, err := c.App.Tokens.Refresh(rq.RefreshToken)
+	if err != nil {
+		log.Printf("W %v %v Token refresh failed from %v: %v", c.SessionID, "", clientIP(c, r), err)
+		return 401, err
+	}
+	c.UserID = userID
+	log.Printf("D Refreshed tokens of %v", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := encodeJSONResponse(w, &pair); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return 200, nil
+}
+
+// tokensHandler answers 404 when JWT tokens are not enabled
+func tokensHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.App.Tokens == nil {
+		return 404, errors.New("JWT tokens disabled")
+	}
+	return 200, nil
+}
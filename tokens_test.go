@@ -0,0 +1,147 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTokenIssuer(t *testing.T) *tokenIssuer {
+	o := options{JWTTokens: true, JWTIssuer: "mpin-rpa", JWTAccessTTL: time.Minute, JWTRefreshTTL: time.Hour}
+	tokens, err := newTokenIssuer(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestTokenIssuer(t *testing.T) {
+	tokens := testTokenIssuer(t)
+	pair, err := tokens.Issue("345", "foo", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.Verify(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "foo" || claims.Grant == "" || claims.Grant == "345" || pair.ExpiresIn != 60 {
+		t.Errorf("claims = %+v pair = %+v", claims, pair)
+	}
+
+	// Refresh tokens are single use
+	refreshed, userID, err := tokens.Refresh(pair.RefreshToken)
+	if err != nil || userID != "foo" {
+		t.Fatalf("Refresh = <%v> <%v>", userID, err)
+	}
+	if _, _, err := tokens.Refresh(pair.RefreshToken); err != errInvalidRefresh {
+		t.Errorf("refresh token reused: %v", err)
+	}
+	if _, err := tokens.Verify(refreshed.AccessToken); err != nil {
+		t.Error(err)
+	}
+
+	other, _ := tokens.Issue("678", "bar", "", time.Now())
+	tokens.RevokeSession("345")
+	if _, err := tokens.Verify(refreshed.AccessToken); err != errTokenRevoked {
+		t.Errorf("Verify after logout = <%v> want <%v>", err, errTokenRevoked)
+	}
+	if _, _, err := tokens.Refresh(refreshed.RefreshToken); err != errInvalidRefresh {
+		t.Errorf("Refresh after logout = <%v> want <%v>", err, errInvalidRefresh)
+	}
+	if _, err := tokens.Verify(other.AccessToken); err != nil {
+		t.Errorf("token of another session revoked: %v", err)
+	}
+
+	tokens.AccessTTL = -time.Minute
+	expired, _ := tokens.Issue("345", "foo", "", time.Now())
+	if _, err := tokens.Verify(expired.AccessToken); err != errTokenExpired {
+		t.Errorf("Verify expired = <%v> want <%v>", err, errTokenExpired)
+	}
+	if _, err := testTokenIssuer(t).Verify(other.AccessToken); err != errInvalidJWT {
+		t.Errorf("token of another key accepted: %v", err)
+	}
+}
+
+func TestBearerHandler(t *testing.T) {
+	c, w, r := prepare("GET", "/protected", new(bytes.Buffer))
+	c.App.Tokens = testTokenIssuer(t)
+	pair, _ := c.App.Tokens.Issue("345", "foo", "", time.Now())
+
+	r.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+	if s, err := bearerHandler(c, w, r); s != 200 || c.LoggedUser != "foo" {
+		t.Fatalf("status = <%d> %v user = <%v>", s, err, c.LoggedUser)
+	}
+
+	// Logging out with the token revokes it
+	c.SessionID = "678"
+	_, w, r = prepare("GET", "/logout", new(bytes.Buffer))
+	logoutHandler(c, w, r)
+	c.LoggedUser = ""
+	r.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+	if s, _ := bearerHandler(c, w, r); s != 401 || c.LoggedUser != "" {
+		t.Fatalf("status = <%d> user = <%v> want <401>", s, c.LoggedUser)
+	}
+
+	// Without token the session cookie applies
+	_, w, r = prepare("GET", "/protected", new(bytes.Buffer))
+	if s, _ := bearerHandler(c, w, r); s != 200 {
+		t.Errorf("status = <%d> want <200>", s)
+	}
+}
+
+func TestAuthenticateUserTokens(t *testing.T) {
+	body := `{"mpinResponse": {"authOTT": "` + strings.Repeat("a", 64) + `"}}`
+	c, w, r := prepare("POST", "/mpinAuthenticate", bytes.NewBufferString(body))
+	c.App.Tokens = testTokenIssuer(t)
+	c.SessionID = "345"
+	c.App.Authenticate = func(*context, string) (string, string, int) { return "foo", "OK", 200 }
+
+	if s, err := authenticateUserHandler(c, w, r); s != 200 {
+		t.Fatalf("status = <%d> %v", s, err)
+	}
+	var resp authRPAResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.SomeUserData != "" || resp.TokenType != "Bearer" || resp.RefreshToken == "" {
+		t.Fatalf("response = %s", w.Body.String())
+	}
+	if claims, err := c.App.Tokens.Verify(resp.AccessToken); err != nil || claims.Subject != "foo" {
+		t.Fatalf("claims = %+v %v", claims, err)
+	}
+
+	_, w, r = prepare("POST", "/api/token/refresh", bytes.NewBufferString(`{"refreshToken": "`+resp.RefreshToken+`"}`))
+	if s, err := tokenRefreshHandler(c, w, r); s != 200 {
+		t.Fatalf("status = <%d> %v", s, err)
+	}
+	var pair tokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	if _, err := c.App.Tokens.Verify(pair.AccessToken); err != nil {
+		t.Error(err)
+	}
+	_, w, r = prepare("POST", "/api/token/refresh", bytes.NewBufferString(`{"refreshToken": "`+resp.RefreshToken+`"}`))
+	if s, _ := tokenRefreshHandler(c, w, r); s != 401 {
+		t.Errorf("refresh token reused: status = <%d> want <401>", s)
+	}
+}
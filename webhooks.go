@@ -0,0 +1,449 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook events
+const (
+	webhookRegistered  = "user.registered"
+	webhookActivated   = "user.activated"
+	webhookLogin       = "user.login"
+	webhookLoginDenied = "user.login_denied"
+	webhookLogout      = "user.logout"
+	webhookRevoked     = "identity.revoked"
+)
+
+var webhookEvents = []string{webhookRegistered, webhookActivated, webhookLogin, webhookLoginDenied, webhookLogout, webhookRevoked}
+
+const (
+	// Delays between the attempts double from webhookBackoff up to
+	// webhookMaxBackoff
+	webhookBackoff    = 10 * time.Second
+	webhookMaxBackoff = time.Hour
+	// Delivered and failed deliveries kept for the admin status
+	webhookHistory = 100
+)
+
+// Delivery states
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+// webhookSubscription is an URL receiving events, read from the -webhooks
+// file. No Events means all of them.
+type webhookSubscription struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// Wants reports whether the subscription receives the event
+func (s *webhookSubscription) Wants(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookEvent is the JSON payload of the webhooks
+type webhookEvent struct {
+	ID     string            `json:"id"`
+	Event  string            `json:"event"`
+	Time   time.Time         `json:"time"`
+	UserID string            `json:"userId"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// webhookDelivery is an event to send to a subscription
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	Created     time.Time       `json:"created"`
+	NextAttempt time.Time       `json:"nextAttempt,omitempty"`
+	LastStatus  int             `json:"lastStatus,omitempty"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+// webhooks sends signed events to the subscriptions. Deliveries are queued
+// and retried with exponential backoff up to MaxAttempts times. When Path
+// is set the queue is saved there on every change and loaded at start, so
+// pending deliveries survive restarts.
+type webhooks struct {
+	Subscriptions []*webhookSubscription
+	MaxAttempts   int
+	Path          string
+	Client        *http.Client
+
+	mu         sync.Mutex
+	deliveries []*webhookDelivery
+	wake       chan struct{}
+}
+
+// newWebhooks returns nil when no subscriptions are configured
+func newWebhooks(o *options) (*webhooks, error) {
+	if o.Webhooks == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(o.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+	var subs []*webhookSubscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return nil, fmt.Errorf("Invalid webhooks %v: %v", o.Webhooks, err)
+	}
+	for _, s := range subs {
+		u, err := url.Parse(s.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("Invalid webhook URL %q", s.URL)
+		}
+		if s.Secret == "" {
+			return nil, fmt.Errorf("Webhook %v needs a secret", s.URL)
+		}
+		for _, e := range s.Events {
+			if !validWebhookEvent(e) {
+				return nil, fmt.Errorf("Unknown webhook event %q for %v", e, s.URL)
+			}
+		}
+	}
+	h := &webhooks{
+		Subscriptions: subs,
+		MaxAttempts:   o.WebhooksMaxAttempts,
+		Path:          o.WebhooksQueue,
+		Client:        &http.Client{Timeout: o.WebhooksTimeout},
+		wake:          make(chan struct{}, 1),
+	}
+	if h.Path == "" {
+		return h, nil
+	}
+	data, err = ioutil.ReadFile(h.Path)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &h.deliveries); err != nil {
+		return nil, fmt.Errorf("Invalid webhook queue %v: %v", h.Path, err)
+	}
+	// Pending deliveries to removed subscriptions are dropped
+	kept := h.deliveries[:0]
+	for _, d := range h.deliveries {
+		if d.State != webhookPending || h.subscription(d.URL) != nil {
+			kept = append(kept, d)
+		}
+	}
+	h.deliveries = kept
+	return h, nil
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *webhooks) subscription(url string) *webhookSubscription {
+	for _, s := range h.Subscriptions {
+		if s.URL == url {
+			return s
+		}
+	}
+	return nil
+}
+
+// Fire queues the event for the subscriptions that want it
+func (h *webhooks) Fire(event, userID string, data map[string]string) {
+	if h == nil {
+		return
+	}
+	id, err := randomToken()
+	if err != nil {
+		log.Printf("E Failed to queue webhook %v: %v", event, err)
+		return
+	}
+	now := time.Now()
+	payload, err := json.Marshal(&webhookEvent{ID: id, Event: event, Time: now.UTC(), UserID: userID, Data: data})
+	if err != nil {
+		log.Printf("E Failed to encode webhook %v: %v", event, err)
+		return
+	}
+
+	h.mu.Lock()
+	queued := false
+	for i, s := range h.Subscriptions {
+		if !s.Wants(event) {
+			continue
+		}
+		h.deliveries = append(h.deliveries, &webhookDelivery{
+			ID:          fmt.Sprintf("%v-%d", id, i),
+			URL:         s.URL,
+			Event:       event,
+			Payload:     payload,
+			State:       webhookPending,
+			Created:     now,
+			NextAttempt: now,
+		})
+		queued = true
+	}
+	if queued {
+		h.save()
+	}
+	h.mu.Unlock()
+
+	if queued {
+		select {
+		case h.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start sends the queued deliveries in the background
+func (h *webhooks) Start() {
+	if h == nil {
+		return
+	}
+	go func() {
+		for {
+			h.process(time.Now())
+			select {
+			case <-h.wake:
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+// process sends the deliveries due at now
+func (h *webhooks) process(now time.Time) {
+	h.mu.Lock()
+	var due []*webhookDelivery
+	for _, d := range h.deliveries {
+		if d.State == webhookPending && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, d := range due {
+		status, err := h.send(d)
+		h.mu.Lock()
+		d.Attempts++
+		d.LastStatus = status
+		d.LastError = ""
+		switch {
+		case err == nil:
+			d.State = webhookDelivered
+			d.NextAttempt = time.Time{}
+		case d.Attempts >= h.MaxAttempts:
+			d.State = webhookFailed
+			d.LastError = err.Error()
+			d.NextAttempt = time.Time{}
+			log.Printf("E Webhook %v %v to %v failed after %d attempts: %v", d.Event, d.ID, d.URL, d.Attempts, err)
+		default:
+			d.LastError = err.Error()
+			d.NextAttempt = time.Now().Add(webhookRetryDelay(d.Attempts))
+			log.Printf("W Webhook %v %v to %v failed, retrying at %v: %v", d.Event, d.ID, d.URL, d.NextAttempt.Format(time.RFC3339), err)
+		}
+		h.gc()
+		h.save()
+		h.mu.Unlock()
+	}
+}
+
+// webhookRetryDelay returns the delay after the given number of attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+// webhookSignature returns the X-RPA-Signature header for the payload. The
+// receiver computes the HMAC-SHA256 of "<t>.<body>" with the shared secret
+// and compares it to v1.
+func webhookSignature(secret string, t time.Time, payload []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send posts the delivery. Any 2xx answer is a success.
+func (h *webhooks) send(d *webhookDelivery) (int, error) {
+	sub := h.subscription(d.URL)
+	if sub == nil {
+		return 0, errors.New("Subscription removed")
+	}
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-RPA-Event", d.Event)
+	req.Header.Set("X-RPA-Delivery", d.ID)
+	req.Header.Set("X-RPA-Signature", webhookSignature(sub.Secret, time.Now(), d.Payload))
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// gc keeps the last webhookHistory finished deliveries. The caller holds
+// the lock.
+func (h *webhooks) gc() {
+	finished := 0
+	for _, d := range h.deliveries {
+		if d.State != webhookPending {
+			finished++
+		}
+	}
+	if finished <= webhookHistory {
+		return
+	}
+	kept := h.deliveries[:0]
+	for _, d := range h.deliveries {
+		if d.State != webhookPending && finished > webhookHistory {
+			finished--
+			continue
+		}
+		kept = append(kept, d)
+	}
+	h.deliveries = kept
+}
+
+// save writes the queue to Path. The caller holds the lock.
+func (h *webhooks) save() {
+	if h.Path == "" {
+		return
+	}
+	if err := writeJSONFile(h.Path, h.deliveries); err != nil {
+		log.Printf("E Failed to save webhook queue: %v", err)
+	}
+}
+
+// webhookStatus is the admin view of a delivery, without the payload
+type webhookStatus struct {
+	ID          string     `json:"id"`
+	URL         string     `json:"url"`
+	Event       string     `json:"event"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	Created     time.Time  `json:"created"`
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	LastStatus  int        `json:"lastStatus,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// Status returns the number of deliveries per state and the deliveries,
+// newest first
+func (h *webhooks) Status() (map[string]int, []webhookStatus) {
+	counts := map[string]int{webhookPending: 0, webhookDelivered: 0, webhookFailed: 0}
+	var list []webhookStatus
+	if h == nil {
+		return counts, list
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, d := range h.deliveries {
+		counts[d.State]++
+		s := webhookStatus{
+			ID:         d.ID,
+			URL:        d.URL,
+			Event:      d.Event,
+			State:      d.State,
+			Attempts:   d.Attempts,
+			Created:    d.Created,
+			LastStatus: d.LastStatus,
+			LastError:  d.LastError,
+		}
+		if d.State == webhookPending {
+			next := d.NextAttempt
+			s.NextAttempt = &next
+		}
+		list = append(list, s)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return counts, list
+}
+
+// Show the webhook deliveries
+func adminWebhooksHandler(c *context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if s, err := checkAllowedMethods(r, w, "GET"); err != nil {
+		return s, err
+	}
+	if c.App.Webhooks == nil {
+		return 404, errors.New("Webhooks disabled")
+	}
+	var ret struct {
+		Counts     map[string]int  `json:"counts"`
+		Deliveries []webhookStatus `json:"deliveries"`
+	}
+	ret.Counts, ret.Deliveries = c.App.Webhooks.Status()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := encodeJSONResponse(w, &ret); err != nil {
+		return 500, errors.New("Failed to encode response")
+	}
+	return 200, nil
+}
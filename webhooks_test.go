@@ -0,0 +1,225 @@
+/*
+ Licensed to the Apache Software Foundation (ASF) under one
+ or more contributor license agreements.  See the NOTICE file
+ distributed with this work for additional information
+ regarding copyright ownership.  The ASF licenses this file
+ to you under the Apache License, Version 2.0 (the
+ "License"); you may not use this file except in compliance
+ with the License.  You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing,
+ software distributed under the License is distributed on an
+ "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ KIND, either express or implied.  See the License for the
+ specific language governing permissions and limitations
+ under the License.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	mu     sync.Mutex
+	status int
+	got    []*http.Request
+	bodies [][]byte
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.got = append(rc.got, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(rc.status)
+}
+
+// testWebhooks writes the subscriptions file and returns the webhooks
+func testWebhooks(t *testing.T, dir string, subs []webhookSubscription) *webhooks {
+	data, _ := json.Marshal(subs)
+	path := filepath.Join(dir, "webhooks.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	o := options{Webhooks: path, WebhooksQueue: filepath.Join(dir, "queue.json"), WebhooksMaxAttempts: 3, WebhooksTimeout: time.Second}
+	h, err := newWebhooks(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestNewWebhooksInvalid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhooks")
+	defer os.RemoveAll(dir)
+	for _, subs := range []string{
+		`[{"url": "hooks.example.com", "secret": "s"}]`,
+		`[{"url": "https://hooks.example.com"}]`,
+		`[{"url": "https://hooks.example.com", "secret": "s", "events": ["user.deleted"]}]`,
+		`{"url": "https://hooks.example.com"}`,
+	} {
+		path := filepath.Join(dir, "webhooks.json")
+		ioutil.WriteFile(path, []byte(subs), 0600)
+		if _, err := newWebhooks(&options{Webhooks: path}); err == nil {
+			t.Errorf("newWebhooks(%s) succeeded", subs)
+		}
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	sig := webhookSignature("secret", time.Unix(1500000000, 0), []byte(`{"event":"user.login"}`))
+	// echo -n '1500000000.{"event":"user.login"}' | openssl dgst -sha256 -hmac secret
+	want := "t=1500000000,v1=7e05bab5a0ce9c3cd57bea39c2a655eaa800bb46be06202f7ac713cf063583d5"
+	if sig != want {
+		t.Errorf("signature = <%v> want <%v>", sig, want)
+	}
+	if sig == webhookSignature("other", time.Unix(1500000000, 0), []byte(`{"event":"user.login"}`)) {
+		t.Errorf("signature does not depend on the secret")
+	}
+}
+
+func TestWebhooksDeliver(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhooks")
+	defer os.RemoveAll(dir)
+	rc := &webhookReceiver{status: 200}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	h := testWebhooks(t, dir, []webhookSubscription{
+		{URL: srv.URL + "/all", Secret: "s1"},
+		{URL: srv.URL + "/logins", Secret: "s2", Events: []string{webhookLogin}},
+	})
+	h.Fire(webhookRegistered, "foo@example.com", map[string]string{"mpinId": "ab"})
+	h.Fire(webhookLogin, "foo@example.com", nil)
+	h.process(time.Now())
+
+	if len(rc.got) != 3 {
+		t.Fatalf("got %d requests want 3", len(rc.got))
+	}
+	for i, r := range rc.got {
+		secret := "s1"
+		if r.URL.Path == "/logins" {
+			secret = "s2"
+			if r.Header.Get("X-RPA-Event") != webhookLogin {
+				t.Errorf("/logins got %v", r.Header.Get("X-RPA-Event"))
+			}
+		}
+		sig := r.Header.Get("X-RPA-Signature")
+		ts := strings.TrimPrefix(strings.Split(sig, ",")[0], "t=")
+		tt, _ := strconv.ParseInt(ts, 10, 64)
+		if !hmac.Equal([]byte(sig), []byte(webhookSignature(secret, time.Unix(tt, 0), rc.bodies[i]))) {
+			t.Errorf("invalid signature %v", sig)
+		}
+		var ev webhookEvent
+		if err := json.Unmarshal(rc.bodies[i], &ev); err != nil || ev.UserID != "foo@example.com" || ev.Event != r.Header.Get("X-RPA-Event") {
+			t.Errorf("payload = %s", rc.bodies[i])
+		}
+	}
+
+	counts, list := h.Status()
+	if counts[webhookDelivered] != 3 || counts[webhookPending] != 0 || len(list) != 3 {
+		t.Errorf("status = %v %v", counts, list)
+	}
+}
+
+func TestWebhooksRetry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhooks")
+	defer os.RemoveAll(dir)
+	rc := &webhookReceiver{status: 503}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	h := testWebhooks(t, dir, []webhookSubscription{{URL: srv.URL, Secret: "s"}})
+	h.Fire(webhookLogout, "foo@example.com", nil)
+	h.process(time.Now())
+	if len(rc.got) != 1 {
+		t.Fatalf("got %d requests want 1", len(rc.got))
+	}
+	d := h.deliveries[0]
+	if d.State != webhookPending || d.Attempts != 1 || d.LastStatus != 503 || d.NextAttempt.Before(time.Now().Add(webhookBackoff-time.Second)) {
+		t.Fatalf("delivery = %+v", d)
+	}
+	// Not due yet
+	h.process(time.Now())
+	if len(rc.got) != 1 {
+		t.Fatalf("retried before the backoff")
+	}
+
+	// The queue survives a restart
+	h = testWebhooks(t, dir, []webhookSubscription{{URL: srv.URL, Secret: "s"}})
+	if len(h.deliveries) != 1 || h.deliveries[0].Attempts != 1 {
+		t.Fatalf("queue not loaded: %+v", h.deliveries)
+	}
+	h.process(time.Now().Add(time.Hour))
+	h.process(time.Now().Add(2 * time.Hour))
+	if d := h.deliveries[0]; d.State != webhookFailed || d.Attempts != 3 || d.LastError == "" {
+		t.Errorf("delivery = %+v", d)
+	}
+
+	// Pending deliveries of removed subscriptions are dropped
+	h.Fire(webhookLogout, "foo@example.com", nil)
+	h = testWebhooks(t, dir, []webhookSubscription{{URL: srv.URL + "/new", Secret: "s"}})
+	if counts, _ := h.Status(); counts[webhookPending] != 0 || counts[webhookFailed] != 1 {
+		t.Errorf("status = %v", counts)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	for _, d := range []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, webhookBackoff},
+		{2, 2 * webhookBackoff},
+		{4, 8 * webhookBackoff},
+		{20, webhookMaxBackoff},
+	} {
+		if delay := webhookRetryDelay(d.attempts); delay != d.delay {
+			t.Errorf("webhookRetryDelay(%d) = %v want %v", d.attempts, delay, d.delay)
+		}
+	}
+}
+
+func TestAdminWebhooksHandler(t *testing.T) {
+	c, w, r := prepare("GET", "/admin/webhooks", nil)
+	if s, _ := adminWebhooksHandler(c, w, r); s != 404 {
+		t.Errorf("status = <%d> want <404> without webhooks", s)
+	}
+
+	dir, _ := ioutil.TempDir("", "webhooks")
+	defer os.RemoveAll(dir)
+	c.App.Webhooks = testWebhooks(t, dir, []webhookSubscription{{URL: "http://127.0.0.1:1/", Secret: "s"}})
+	c.App.Webhooks.Fire(webhookActivated, "foo@example.com", nil)
+	w = httptest.NewRecorder()
+	if s, _ := adminWebhooksHandler(c, w, r); s != 200 {
+		t.Fatalf("status = <%d>", s)
+	}
+	var ret struct {
+		Counts     map[string]int
+		Deliveries []map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret.Counts[webhookPending] != 1 || len(ret.Deliveries) != 1 || ret.Deliveries[0]["event"] != webhookActivated {
+		t.Errorf("response = %s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "payload") || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("payload or secret in the admin status: %s", w.Body.String())
+	}
+}